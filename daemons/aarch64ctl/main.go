@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"github.com/nsqio/go-nsq"
+)
+
+const usage = `Usage: aarch64ctl [flags] <action>
+
+Publishes an action to the daemon responsible for it. The action is a name
+such as add_domain or change_state, or its number. Fields without a flag of
+their own are read from -data, a JSON message body, e.g.
+  {"vm_data": {"_id": "...", "pop": "ams", "host": 1, ...}}
+
+Flags:
+`
+
+// Actions Reported by Hypervisors, Never Sent to them
+var reportActions = map[message.Action]bool{
+	message.NewVMState:     true,
+	message.ImageInventory: true,
+	message.CapacityReport: true,
+}
+
+// Actions Handled Without Publishing to aarch64-results
+var noResultActions = map[message.Action]bool{
+	message.ChangeState:  true,
+	message.DeleteDomain: true,
+	message.AddProxy:     true,
+	message.DeleteProxy:  true,
+	message.WipeProxy:    true,
+}
+
+var events = map[string]message.ActionEvent{
+	"shutdown": message.StateShutdown,
+	"startup":  message.StateStartup,
+	"reset":    message.StateReset,
+	"reboot":   message.StateReboot,
+	"stop":     message.StateStop,
+}
+
+// -host Value when the Flag is Not Given. Hosts are Numbered from 0
+const hostUnset = -1
+
+// Values Given as Flags, Applied Over the -data Body
+type options struct {
+	Pop   string
+	Host  int
+	VM    string
+	Event string
+	Name  string
+	IP    string
+}
+
+func isProxyAction(action message.Action) bool {
+	return action == message.AddProxy || action == message.DeleteProxy || action == message.WipeProxy
+}
+
+// Topic a Message has to be Published on. Beryllium Instances Each have a
+// Channel on aarch64-proxy, Every Other Action Goes to a Hypervisor's Hydrogen
+func topic(msg *message.Message, pop string, host int) (string, error) {
+	if isProxyAction(msg.Action) {
+		return "aarch64-proxy", nil
+	}
+	if pop == "" || host < 0 {
+		return "", fmt.Errorf("%s needs a target hypervisor, set -pop and -host", msg.Action)
+	}
+	return "aarch64-libvirt-" + pop + strconv.Itoa(host), nil
+}
+
+// Build the Message for an Action, Starting from body if Given. The Target
+// Hypervisor Defaults to the VM's own
+func buildMessage(action message.Action, body io.Reader, opts options) (*message.Message, string, error) {
+	var msg message.Message
+	if body != nil {
+		if err := json.NewDecoder(body).Decode(&msg); err != nil {
+			return nil, "", fmt.Errorf("decoding message body: %w", err)
+		}
+	}
+	msg.Action = action
+	if opts.VM != "" {
+		msg.VMData.ID = opts.VM
+	}
+	if opts.Pop != "" {
+		msg.VMData.Pop = opts.Pop
+	}
+	if opts.Host != hostUnset {
+		msg.VMData.Host = opts.Host
+	}
+	if opts.Name != "" {
+		msg.MessageData.Name = opts.Name
+	}
+	if opts.IP != "" {
+		msg.MessageData.IP = opts.IP
+	}
+	if err := validate(&msg, opts); err != nil {
+		return nil, "", err
+	}
+	t, err := topic(&msg, msg.VMData.Pop, msg.VMData.Host)
+	if err != nil {
+		return nil, "", err
+	}
+	return &msg, t, nil
+}
+
+// Reject Messages the Receiving Daemon would Drop
+func validate(msg *message.Message, opts options) error {
+	if reportActions[msg.Action] {
+		return fmt.Errorf("%s is reported by hypervisors, not sent to them", msg.Action)
+	}
+	switch msg.Action {
+	case message.ChangeState:
+		event, ok := events[opts.Event]
+		if !ok {
+			return fmt.Errorf("change_state needs -event shutdown, startup, reset, reboot or stop")
+		}
+		if msg.VMData.ID == "" {
+			return errors.New("change_state needs -vm")
+		}
+		msg.MessageData.Name = msg.VMData.ID
+		msg.MessageData.Event = event
+	case message.AddProxy, message.DeleteProxy:
+		if msg.MessageData.Name == "" || msg.MessageData.IP == "" {
+			return fmt.Errorf("%s needs -name and -ip", msg.Action)
+		}
+	case message.SyncImage:
+		if msg.ImageData.Os == "" || msg.ImageData.Version == "" || msg.ImageData.URL == "" || msg.ImageData.Format == "" {
+			return errors.New("sync_image needs image_data os, version, url and format")
+		}
+	case message.CreateNetwork, message.DeleteNetwork:
+		if msg.Network.VNI <= 0 {
+			return fmt.Errorf("%s needs a network vni", msg.Action)
+		}
+	case message.CreateVolume, message.DeleteVolume, message.AttachVolume, message.DetachVolume, message.ResizeVolume:
+		if msg.Volume.ID == "" {
+			return fmt.Errorf("%s needs a volume _id", msg.Action)
+		}
+	case message.WipeProxy:
+	default:
+		if msg.VMData.ID == "" {
+			return fmt.Errorf("%s needs -vm or vm_data _id", msg.Action)
+		}
+	}
+	return nil
+}
+
+// Snowflake Node for Message IDs. Operators Share No Machine ID File with
+// the Hypervisors, so the Node is Given with -node or Drawn at Random,
+// Keeping IDs from Different Operators Apart
+func snowflakeNode(node int64) (*snowflake.Node, error) {
+	maxNode := int64(-1 ^ (-1 << snowflake.NodeBits))
+	if node < 0 {
+		random, err := rand.Int(rand.Reader, big.NewInt(maxNode+1))
+		if err != nil {
+			return nil, fmt.Errorf("picking a random snowflake node: %w", err)
+		}
+		node = random.Int64()
+	}
+	if node > maxNode {
+		return nil, fmt.Errorf("-node must be between 0 and %d, got %d", maxNode, node)
+	}
+	return snowflake.NewNode(node)
+}
+
+// Wait for the Result Published for a Message ID. The Consumer has to be
+// Connected Before the Message is Published, so it is Started Separately
+func subscribeResults(uri string, id int64) (*nsq.Consumer, <-chan message.Result, error) {
+	channel := fmt.Sprintf("aarch64ctl-%d#ephemeral", id)
+	consumer, err := nsq.NewConsumer("aarch64-results", channel, nsq.NewConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	consumer.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelError)
+	results := make(chan message.Result, 1)
+	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		var result message.Result
+		if err := json.Unmarshal(m.Body, &result); err == nil && result.ID == id {
+			select {
+			case results <- result:
+			default:
+			}
+		}
+		return nil
+	}))
+	if err := consumer.ConnectToNSQD(uri); err != nil {
+		return nil, nil, err
+	}
+	return consumer, results, nil
+}
+
+func main() {
+	var (
+		configPath    string
+		nsqConnectURI string
+		dataPath      string
+		wait          time.Duration
+		dryRun        bool
+		node          int64
+		opts          options
+	)
+	flag.StringVar(&configPath, "config", commons.ConfigPath, "The path to the daemon configuration file")
+	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", "", "The URI to use when connecting to NSQD")
+	flag.StringVar(&dataPath, "data", "", "A JSON message body to start from, - for stdin")
+	flag.StringVar(&opts.Pop, "pop", "", "The PoP of the target hypervisor, defaults to the VM's")
+	flag.IntVar(&opts.Host, "host", hostUnset, "The index of the target hypervisor within its PoP, defaults to the VM's")
+	flag.StringVar(&opts.VM, "vm", "", "The VM ID")
+	flag.StringVar(&opts.Event, "event", "", "The change_state event: shutdown, startup, reset, reboot or stop")
+	flag.StringVar(&opts.Name, "name", "", "The proxied domain name")
+	flag.StringVar(&opts.IP, "ip", "", "The address the proxied domain is sent to")
+	flag.DurationVar(&wait, "wait", 0, "How long to wait for the action's result, 0 to not wait")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the message and its topic instead of publishing it")
+	flag.Int64Var(&node, "node", -1, "The snowflake node for the message ID, 0-1023, random if unset")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := commons.LoadConfig(configPath)
+	if err != nil {
+		fail(err)
+	}
+	if nsqConnectURI != "" {
+		cfg.NSQ.URI = nsqConnectURI
+	}
+	if err := cfg.Validate(); err != nil {
+		fail(err)
+	}
+
+	action, err := message.ParseAction(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	var body io.Reader
+	switch dataPath {
+	case "":
+	case "-":
+		body = os.Stdin
+	default:
+		file, err := os.Open(dataPath)
+		if err != nil {
+			fail(err)
+		}
+		defer file.Close()
+		body = file
+	}
+	msg, t, err := buildMessage(action, body, opts)
+	if err != nil {
+		fail(err)
+	}
+	if wait > 0 && noResultActions[action] {
+		fail(fmt.Errorf("%s does not publish a result to wait for", action))
+	}
+	snow, err := snowflakeNode(node)
+	if err != nil {
+		fail(err)
+	}
+	msg.ID = int64(snow.Generate())
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		fail(err)
+	}
+	if dryRun {
+		fmt.Printf("%s %s\n", t, encoded)
+		return
+	}
+
+	var results <-chan message.Result
+	if wait > 0 {
+		consumer, r, err := subscribeResults(cfg.NSQ.URI, msg.ID)
+		if err != nil {
+			fail(fmt.Errorf("subscribing to aarch64-results: %w", err))
+		}
+		defer consumer.Stop()
+		results = r
+	}
+	producer, err := nsq.NewProducer(cfg.NSQ.URI, nsq.NewConfig())
+	if err != nil {
+		fail(err)
+	}
+	producer.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelError)
+	err = producer.Publish(t, encoded)
+	producer.Stop()
+	if err != nil {
+		fail(fmt.Errorf("publishing to %s: %w", t, err))
+	}
+	fmt.Fprintf(os.Stderr, "published %s %d to %s\n", action, msg.ID, t)
+	if wait == 0 {
+		return
+	}
+
+	select {
+	case result := <-results:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+		if !result.Success {
+			os.Exit(1)
+		}
+	case <-time.After(wait):
+		fail(fmt.Errorf("no result for %d within %s", msg.ID, wait))
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "aarch64ctl: %s\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func TestBuildMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    message.Action
+		body      string
+		opts      options
+		wantTopic string
+		wantErr   bool
+	}{
+		{"vm's own host", message.AddDomain, `{"vm_data": {"_id": "abc", "pop": "ams", "host": 2}}`, options{Host: hostUnset}, "aarch64-libvirt-ams2", false},
+		{"first host", message.AddDomain, `{"vm_data": {"_id": "abc", "pop": "ams", "host": 0}}`, options{Host: hostUnset}, "aarch64-libvirt-ams0", false},
+		{"first host flag", message.SetFirewall, `{"vm_data": {"_id": "abc", "pop": "ams", "host": 2}}`, options{Host: 0}, "aarch64-libvirt-ams0", false},
+		{"flags win over body", message.SetFirewall, `{"vm_data": {"_id": "abc", "pop": "ams", "host": 2}}`, options{Pop: "fra", Host: 1}, "aarch64-libvirt-fra1", false},
+		{"no target", message.DeleteDomain, "", options{VM: "abc", Host: hostUnset}, "", true},
+		{"no vm", message.QueryGuest, "", options{Pop: "ams", Host: 1}, "", true},
+		{"power", message.ChangeState, "", options{VM: "abc", Pop: "ams", Host: 1, Event: "reboot"}, "aarch64-libvirt-ams1", false},
+		{"unknown event", message.ChangeState, "", options{VM: "abc", Pop: "ams", Host: 1, Event: "hibernate"}, "", true},
+		{"network", message.CreateNetwork, `{"network": {"vni": 10}}`, options{Pop: "ams", Host: 1}, "aarch64-libvirt-ams1", false},
+		{"volume without id", message.AttachVolume, "", options{Pop: "ams", Host: 1}, "", true},
+		{"proxy", message.AddProxy, "", options{Name: "example.com", IP: "2001:db8::1", Host: hostUnset}, "aarch64-proxy", false},
+		{"proxy without ip", message.DeleteProxy, "", options{Name: "example.com", Host: hostUnset}, "", true},
+		{"wipe", message.WipeProxy, "", options{Host: hostUnset}, "aarch64-proxy", false},
+		{"report", message.CapacityReport, "", options{Pop: "ams", Host: 1}, "", true},
+		{"future action", message.Action(1000), "", options{VM: "abc", Pop: "ams", Host: 1}, "aarch64-libvirt-ams1", false},
+		{"bad body", message.AddDomain, `{"vm_data": [`, options{Host: hostUnset}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			msg, topic, err := buildMessage(tt.action, body, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildMessage error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if topic != tt.wantTopic {
+				t.Errorf("topic = %q, want %q", topic, tt.wantTopic)
+			}
+			if msg.Action != tt.action {
+				t.Errorf("action = %s, want %s", msg.Action, tt.action)
+			}
+		})
+	}
+}
+
+func TestBuildPowerMessage(t *testing.T) {
+	msg, _, err := buildMessage(message.ChangeState, nil, options{VM: "abc", Pop: "ams", Host: 1, Event: "stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageData.Name != "abc" || msg.MessageData.Event != message.StateStop {
+		t.Errorf("message data = %+v, want the VM and stop event", msg.MessageData)
+	}
+}
+
+func TestSnowflakeNode(t *testing.T) {
+	snow, err := snowflakeNode(5)
+	if err != nil {
+		t.Fatalf("snowflakeNode(5): %v", err)
+	}
+	if node := snow.Generate().Node(); node != 5 {
+		t.Errorf("generated ID node = %d, want 5", node)
+	}
+	if _, err := snowflakeNode(-1); err != nil {
+		t.Errorf("random snowflakeNode: %v", err)
+	}
+	if _, err := snowflakeNode(1024); err == nil {
+		t.Error("snowflakeNode accepted a node out of range")
+	}
+}
@@ -4,13 +4,13 @@ import (
 	_ "embed"
 	"flag"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"sync"
 	"text/template"
 
 	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
 	"github.com/fosshostorg/aarch64/daemons/internal/message"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nsqio/go-nsq"
@@ -22,19 +22,33 @@ var cfg_file string
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-func NewNSQHandler(l *zap.Logger, proxyConfigPath string, proxyCachePath string) *NSQHandler {
+// Current Proxy Cache Schema Version
+const proxyCacheVersion = 1
+
+var proxyCacheMigrations = map[int]commons.Migration{
+	// Unversioned Caches Hold the Bare Name to IP Map
+	0: func(data []byte) ([]byte, error) {
+		return data, nil
+	},
+}
+
+func NewNSQHandler(l *zap.Logger, ex executor.Executor, proxyConfigPath string, proxyCachePath string, openrestyPath string) *NSQHandler {
 	return &NSQHandler{
 		l:               l,
+		ex:              ex,
 		proxyConfigPath: proxyConfigPath,
-		proxyCachePath:  proxyCachePath,
+		cache:           commons.NewStore(proxyCachePath, proxyCacheVersion, proxyCacheMigrations),
+		openrestyPath:   openrestyPath,
 		data:            make(map[string]string),
 	}
 }
 
 type NSQHandler struct {
 	l               *zap.Logger
+	ex              executor.Executor
 	proxyConfigPath string
-	proxyCachePath  string
+	cache           *commons.Store
+	openrestyPath   string
 	data            map[string]string
 	mutex           sync.Mutex
 }
@@ -53,8 +67,8 @@ func (h *NSQHandler) HandleMessage(m *nsq.Message) error {
 		return nil
 	}
 
-	// Name and IP Should Not be Empty
-	if msg.MessageData.Name == "" || msg.MessageData.IP == "" {
+	// Name and IP Should Not be Empty, Unless Wiping Every Proxy
+	if msg.Action != message.WipeProxy && (msg.MessageData.Name == "" || msg.MessageData.IP == "") {
 		h.l.Error("name or ip is empty")
 		return nil
 	}
@@ -128,41 +142,34 @@ func (h *NSQHandler) GenerateConfig() error {
 }
 
 func (h *NSQHandler) ReloadProxy() error {
-	_, err := exec.Command("/bin/bash", "-c", "/usr/bin/openresty -s reload").Output()
-	if err != nil {
-		h.l.Info("Failed to Reload Proxy", zap.Error(err))
-		return nil
+	if output, err := h.ex.CombinedOutput(h.openrestyPath, "-s", "reload"); err != nil {
+		h.l.Info("Failed to Reload Proxy", zap.ByteString("output", output), zap.Error(err))
+		return err
 	}
 	return nil
 }
 
 func (h *NSQHandler) SaveProxies() error {
-	file, err := os.Create(h.proxyCachePath)
-	defer file.Close()
-	if err != nil {
-		h.l.Error("Failed to Create beryllium.json", zap.Error(err))
-		return nil
-	}
-	encoder := json.NewEncoder(file)
-	if err = encoder.Encode(h.data); err != nil {
-		h.l.Error("Failed to Save beryllium.json", zap.Error(err))
+	if err := h.cache.Save(h.data); err != nil {
+		h.l.Error("Failed to Save beryllium.json", zap.String("path", h.cache.Path), zap.Error(err))
 		return nil
 	}
 	return nil
 }
 
+// Load the Proxy Cache. Fails if the Cache is Corrupt, Rather than
+// Continuing with an Empty One
 func (h *NSQHandler) LoadProxies() error {
-	file, err := os.Open(h.proxyCachePath)
+	found, err := h.cache.Load(&h.data)
 	if err != nil {
-		h.l.Info("Unable to Open beryllium.json")
-		return nil
+		h.l.Error("Failed to Load beryllium.json", zap.String("path", h.cache.Path), zap.Error(err))
+		return err
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	if err = decoder.Decode(&h.data); err != nil {
-		h.l.Error("Failed to Load beryllium.json", zap.Error(err))
+	if !found {
+		h.l.Info("No beryllium.json Found, Starting with an Empty Cache", zap.String("path", h.cache.Path))
+	}
+	if h.data == nil {
 		h.data = make(map[string]string)
-		return nil
 	}
 	return nil
 }
@@ -171,27 +178,53 @@ func main() {
 	l, _ := zap.NewDevelopment()
 
 	var (
+		configPath      string
 		nsqConnectURI   string
 		proxyConfigPath string
 		proxyCachePath  string
 	)
 
-	// Parse Flags
-	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", commons.NSQCoreUrl, "The URI for NSQ producers & consumers to connect to")
-	flag.StringVar(&proxyConfigPath, "proxy-config-path", commons.ProxyConfigPath, "The path to the proxy configuration file")
-	flag.StringVar(&proxyCachePath, "proxy-cache-path", commons.ProxyCachePath, "The path to the proxy cache file")
+	// Parse Flags, Set Flags Override the Config File
+	flag.StringVar(&configPath, "config", commons.ConfigPath, "The path to the daemon configuration file")
+	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", "", "The URI for NSQ producers & consumers to connect to")
+	flag.StringVar(&proxyConfigPath, "proxy-config-path", "", "The path to the proxy configuration file")
+	flag.StringVar(&proxyCachePath, "proxy-cache-path", "", "The path to the proxy cache file")
 	flag.Parse()
 
+	// Load Configuration
+	cfg, err := commons.LoadConfig(configPath)
+	if err != nil {
+		l.Fatal("unable to load configuration", zap.Error(err))
+	}
+	if nsqConnectURI != "" {
+		cfg.NSQ.URI = nsqConnectURI
+	}
+	if proxyConfigPath != "" {
+		cfg.Beryllium.ProxyConfigPath = proxyConfigPath
+	}
+	if proxyCachePath != "" {
+		cfg.Beryllium.ProxyCachePath = proxyCachePath
+	}
+	if err = cfg.Validate(); err == nil {
+		err = cfg.Beryllium.Validate()
+	}
+	if err != nil {
+		l.Fatal("invalid configuration", zap.Error(err))
+	}
+	l.Info("Effective Configuration\n" + cfg.String())
+
 	// Connect to NSQ
 	hostname := commons.GetHostname()
 	if hostname == "" {
 		l.Fatal("failed to read hostname")
 	}
-	nh := NewNSQHandler(l, proxyConfigPath, proxyCachePath)
-	nh.LoadProxies()
+	nh := NewNSQHandler(l, executor.New(), cfg.Beryllium.ProxyConfigPath, cfg.Beryllium.ProxyCachePath, cfg.Beryllium.OpenrestyPath)
+	if err := nh.LoadProxies(); err != nil {
+		l.Fatal("refusing to start without a valid proxy cache", zap.Error(err))
+	}
 	nh.GenerateConfig()
 	nh.ReloadProxy()
-	nsqConsumer := commons.CreateNSQConsumer(nsqConnectURI, "aarch64-proxy", hostname, nh)
+	nsqConsumer := commons.CreateNSQConsumer(cfg.NSQ.URI, "aarch64-proxy", hostname, nh)
 	l.Info(
 		"Successfully Connected to NSQ",
 		zap.String("topic", "aarch64-proxy"),
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func testHandler(t *testing.T, ex executor.Executor) *NSQHandler {
+	t.Helper()
+	dir := t.TempDir()
+	return NewNSQHandler(
+		zap.NewNop(),
+		ex,
+		filepath.Join(dir, "nginx.conf"),
+		filepath.Join(dir, "beryllium.json"),
+		"/usr/bin/openresty",
+	)
+}
+
+func TestReloadProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"reloaded", nil, false},
+		{"openresty fails", errors.New("exit status 1"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := executor.NewFake().Expect("/usr/bin/openresty -s reload", "", tt.err)
+			if err := testHandler(t, fake).ReloadProxy(); (err != nil) != tt.wantErr {
+				t.Errorf("ReloadProxy error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAddProxyRendersAndReloads(t *testing.T) {
+	fake := executor.NewFake().Expect("/usr/bin/openresty -s reload", "", nil)
+	h := testHandler(t, fake)
+	h.addProxy(&message.MessageData{Name: "www.example.com", IP: "2001:db8::2"})
+	h.GenerateConfig()
+	h.ReloadProxy()
+
+	content, err := os.ReadFile(h.proxyConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "2001:db8::2") {
+		t.Errorf("proxy config does not route to the backend:\n%s", content)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
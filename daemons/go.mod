@@ -5,12 +5,13 @@ go 1.16
 require (
 	github.com/bwmarrin/snowflake v0.3.0 // direct
 	github.com/digitalocean/go-libvirt v0.0.0-20210713173912-57a78005145c // direct
-	github.com/json-iterator/go v1.1.11 // indirect
+	github.com/json-iterator/go v1.1.11
 	github.com/nsqio/go-nsq v1.0.8 // direct
 	go.mongodb.org/mongo-driver v1.6.0 // direct
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.7.0 // indirect
 	go.uber.org/tools v0.0.0-20190618225709-2cfd321de3ee // indirect
-	go.uber.org/zap v1.19.0 // indirect
+	go.uber.org/zap v1.19.0
+	gopkg.in/yaml.v2 v2.4.0
 	honnef.co/go/tools v0.0.1-2019.2.3 // indirect
 )
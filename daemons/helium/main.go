@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/fosshostorg/aarch64/daemons/internal/commons"
@@ -33,11 +34,10 @@ func handleMessage(m *nsq.Message) error {
 	}
 
 	// NSQ does not guarantee messages are not duplicated. We'll check
-	if seenIDs[msg.ID] {
+	if !seenIDs.add(msg.ID) {
 		log.Printf("Dropped duplicate message, ID %d\n", msg.ID) // No need to send this to the error logger, it's natural
 		return nil
 	}
-	seenIDs[msg.ID] = true
 	log.Printf("Received message: %s\n", m.Body)
 
 	if msg.Action == message.NewVMState {
@@ -46,38 +46,111 @@ func handleMessage(m *nsq.Message) error {
 			log.Println(err)
 			return nil
 		}
+		updateState(objID, msg.MessageData.Num)
+	}
+	if msg.Action == message.CapacityReport {
+		updateCapacity(&msg.Capacity)
+	}
+	return nil
+}
 
-		_, err = vms_col.UpdateOne(
-			ctx,
-			bson.M{"_id": objID},
-			bson.M{
-				"$set": bson.M{
-					"state": msg.MessageData.Num,
-				},
+// Message IDs Already Handled. The Power and Capacity Consumers Share it,
+// and NSQ Runs their Handlers Concurrently
+type idSet struct {
+	mutex sync.Mutex
+	ids   map[int64]bool
+}
+
+// Record an ID, Reporting Whether it was New
+func (s *idSet) add(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	return true
+}
+
+// MongoDB Writes, Swapped Out in Tests
+var (
+	updateState    = storeState
+	updateCapacity = storeCapacity
+)
+
+func storeState(id primitive.ObjectID, state int) {
+	if _, err := vms_col.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{
+			"$set": bson.M{
+				"state": state,
 			},
-		)
+		},
+	); err != nil {
+		log.Printf("Unable to store state of %s: %s\n", id.Hex(), err)
+	}
+}
+
+// Store a Hypervisor's Capacity Report on its Host Entry in the pops Collection
+func storeCapacity(capacity *message.Capacity) {
+	result, err := pops_col.UpdateOne(
+		ctx,
+		bson.M{"name": capacity.Pop},
+		bson.M{
+			"$set": bson.M{
+				fmt.Sprintf("hosts.%d.capacity", capacity.Index): capacity,
+			},
+		},
+	)
+	if err != nil {
+		log.Printf("Unable to store capacity of %s: %s\n", capacity.Host, err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		log.Printf("Unable to store capacity of %s: pop %s does not exist\n", capacity.Host, capacity.Pop)
 	}
-	return nil
 }
 
 // Let's define our variables needed through the program
 var (
-	seenIDs  = make(map[int64]bool)
+	seenIDs  = &idSet{ids: make(map[int64]bool)}
 	hostname string
 	ctx      context.Context
 	vms_col  *mongo.Collection
+	pops_col *mongo.Collection
 )
 
 func main() {
-	var nsqConnectURI, mongoConnectURI string
-	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", commons.NSQCoreUrl, "The URI for NSQ producers & consumers to connect to")
-	flag.StringVar(&mongoConnectURI, "mongo-connect-uri", "mongodb://localhost/aarch64", "The URI for MongoDB to connect to")
+	var configPath, nsqConnectURI, mongoConnectURI string
+	flag.StringVar(&configPath, "config", commons.ConfigPath, "The path to the daemon configuration file")
+	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", "", "The URI for NSQ producers & consumers to connect to")
+	flag.StringVar(&mongoConnectURI, "mongo-connect-uri", "", "The URI for MongoDB to connect to")
 	flag.Parse()
 
+	// Flags Take Precedence over the Config File and Environment
+	cfg, err := commons.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Unable to load configuration: %s\n", err)
+	}
+	if nsqConnectURI != "" {
+		cfg.NSQ.URI = nsqConnectURI
+	}
+	if mongoConnectURI != "" {
+		cfg.Helium.MongoURI = mongoConnectURI
+	}
+	if err = cfg.Validate(); err == nil {
+		err = cfg.Helium.Validate()
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s\n", err)
+	}
+	log.Printf("Effective configuration:\n%s", cfg)
+
 	ctx = context.Background()
 
 	// Options to the database.
-	clientOpts := options.Client().ApplyURI(mongoConnectURI)
+	clientOpts := options.Client().ApplyURI(cfg.Helium.MongoURI)
 	client, err := mongo.Connect(ctx, clientOpts)
 	if err != nil {
 		fmt.Println(err)
@@ -85,13 +158,16 @@ func main() {
 	}
 	mg_db := client.Database("aarch64")
 	vms_col = mg_db.Collection("vms")
+	pops_col = mg_db.Collection("pops")
 
 	// Set seenID to true so that packets without an ID get dropped
-	seenIDs[0] = true
+	seenIDs.add(0)
 
 	// Time for NSQ
-	hostControlConsumer := commons.CreateNSQConsumer(nsqConnectURI, "aarch64-power", "helium", nsq.HandlerFunc(handleMessage))
+	hostControlConsumer := commons.CreateNSQConsumer(cfg.NSQ.URI, "aarch64-power", "helium", nsq.HandlerFunc(handleMessage))
 	defer hostControlConsumer.Stop()
+	capacityConsumer := commons.CreateNSQConsumer(cfg.NSQ.URI, "aarch64-capacity", "helium", nsq.HandlerFunc(handleMessage))
+	defer capacityConsumer.Stop()
 
 	// Let's allow our queues to drain properly during shutdown.
 	// We'll create a channel to listen for SIGINT (Ctrl+C) to signal
@@ -106,6 +182,8 @@ func main() {
 		select {
 		case <-hostControlConsumer.StopChan:
 			return
+		case <-capacityConsumer.StopChan:
+			return
 		case <-shutdown:
 			return
 		}
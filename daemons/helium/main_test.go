@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"github.com/nsqio/go-nsq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func nsqMessage(t *testing.T, msg message.Message) *nsq.Message {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nsq.NewMessage(nsq.MessageID{}, body)
+}
+
+// The Power and Capacity Consumers Call handleMessage Concurrently, and
+// Each Message ID must Still be Handled Once. Run with -race
+func TestHandleMessageConcurrentConsumers(t *testing.T) {
+	oldSeen, oldState, oldCapacity := seenIDs, updateState, updateCapacity
+	t.Cleanup(func() { seenIDs, updateState, updateCapacity = oldSeen, oldState, oldCapacity })
+	seenIDs = &idSet{ids: map[int64]bool{0: true}}
+	var states, capacities int64
+	updateState = func(primitive.ObjectID, int) { atomic.AddInt64(&states, 1) }
+	updateCapacity = func(*message.Capacity) { atomic.AddInt64(&capacities, 1) }
+
+	const perConsumer = 200
+	vmID := primitive.NewObjectID().Hex()
+	var power, capacity []*nsq.Message
+	for i := 1; i <= perConsumer; i++ {
+		power = append(power, nsqMessage(t, message.Message{
+			ID:          int64(i),
+			Action:      message.NewVMState,
+			MessageData: message.MessageData{Name: vmID, Num: 1},
+		}))
+		capacity = append(capacity, nsqMessage(t, message.Message{
+			ID:       int64(perConsumer + i),
+			Action:   message.CapacityReport,
+			Capacity: message.Capacity{Host: "ams1", Pop: "ams", Index: 1},
+		}))
+	}
+
+	var wg sync.WaitGroup
+	// Every Message is Delivered Twice, to Two Handler Goroutines per Consumer
+	for _, messages := range [][]*nsq.Message{power, capacity, power, capacity} {
+		wg.Add(1)
+		go func(messages []*nsq.Message) {
+			defer wg.Done()
+			for _, m := range messages {
+				handleMessage(m)
+			}
+		}(messages)
+	}
+	wg.Wait()
+
+	if states != perConsumer || capacities != perConsumer {
+		t.Errorf("handled %d state and %d capacity messages, want %d of each", states, capacities, perConsumer)
+	}
+}
+
+func TestHandleMessageDropsMissingID(t *testing.T) {
+	oldSeen, oldState := seenIDs, updateState
+	t.Cleanup(func() { seenIDs, updateState = oldSeen, oldState })
+	seenIDs = &idSet{ids: map[int64]bool{0: true}}
+	updateState = func(primitive.ObjectID, int) { t.Error("message without an ID was handled") }
+
+	handleMessage(nsqMessage(t, message.Message{
+		Action:      message.NewVMState,
+		MessageData: message.MessageData{Name: primitive.NewObjectID().Hex(), Num: 5},
+	}))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/hydrogen/utils"
+	"github.com/fosshostorg/aarch64/daemons/internal/admin"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"github.com/nsqio/go-nsq"
+	"go.uber.org/zap"
+)
+
+// Actions that Only Need a VM's Cached Data, and can be Replayed from it
+var replayableActions = map[message.Action]bool{
+	message.AddDomain:       true,
+	message.DeleteDomain:    true,
+	message.SetFirewall:     true,
+	message.SetBandwidth:    true,
+	message.SetIOTune:       true,
+	message.ExitRescue:      true,
+	message.QueryGuest:      true,
+	message.ThawFilesystems: true,
+}
+
+// libvirt Domain States, Indexed by virDomainState
+var domainStates = []string{"nostate", "running", "blocked", "paused", "shutdown", "shutoff", "crashed", "pmsuspended"}
+
+// What the Handler is Doing, Tracked Apart from the Handler Mutex so
+// Status Stays Available While a Long Action Runs
+type workerStatus struct {
+	mutex    sync.Mutex
+	busy     bool
+	action   message.Action
+	since    time.Time
+	handled  uint64
+	domains  int
+	networks int
+	volumes  int
+}
+
+func (w *workerStatus) begin(action message.Action) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.busy, w.action, w.since = true, action, time.Now()
+}
+
+func (w *workerStatus) end() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.busy, w.since = false, time.Now()
+	w.handled += 1
+}
+
+// Record Cache Sizes, Called with the Handler Mutex Held
+func (w *workerStatus) setCounts(domains int, networks int, volumes int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.domains, w.networks, w.volumes = domains, networks, volumes
+}
+
+// Serve the Control Socket hydrogenctl Talks to. A Socket Left Behind by a
+// Previous Run is Replaced
+func (h *NSQHandler) ServeAdmin(socket string, consumer *nsq.Consumer, topic string, channel string) error {
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		h.l.Error("unable to listen on control socket", zap.String("path", socket), zap.Error(err))
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		h.l.Error("unable to restrict control socket", zap.String("path", socket), zap.Error(err))
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(admin.PathVMs, onlyMethod(http.MethodGet, h.adminVMs))
+	mux.HandleFunc(admin.PathBridges, onlyMethod(http.MethodGet, h.adminBridges))
+	mux.HandleFunc(admin.PathStatus, onlyMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		h.adminStatus(w, consumer, topic, channel)
+	}))
+	mux.HandleFunc(admin.PathReconcile, onlyMethod(http.MethodPost, h.adminReconcile))
+	mux.HandleFunc(admin.PathResync, onlyMethod(http.MethodPost, h.adminResync))
+	mux.HandleFunc(admin.PathReplay, onlyMethod(http.MethodPost, h.adminReplay))
+	h.l.Info("Serving Control Socket", zap.String("path", socket))
+	return http.Serve(listener, mux)
+}
+
+func onlyMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s requires %s", r.URL.Path, method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Cached VMs with their libvirt State
+func (h *NSQHandler) adminVMs(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	vms := []admin.VM{}
+	for _, v := range h.data {
+		vm := admin.VM{VMData: v, State: h.domainState(v.ID)}
+		if v.Rescued {
+			vm.RescueState = h.domainState(utils.RescueDomain(&v))
+		}
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+	admin.WriteJSON(w, vms)
+}
+
+func (h *NSQHandler) domainState(name string) string {
+	domain, err := h.virt.DomainLookupByName(name)
+	if err != nil {
+		return "undefined"
+	}
+	state, _, err := h.virt.DomainGetState(domain, 0)
+	if err != nil || state < 0 || int(state) >= len(domainStates) {
+		return "unknown"
+	}
+	return domainStates[state]
+}
+
+// Every Bridge the Cache Expects, VM Interfaces First
+func (h *NSQHandler) adminBridges(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	bridges := []admin.Bridge{}
+	for _, v := range h.data {
+		for _, iface := range utils.Interfaces(&v) {
+			bridge := admin.Bridge{Name: fmt.Sprintf("vbr%d", iface.Index), Domain: v.ID}
+			bridge.Exists, bridge.Up = utils.LinkState(h.ex, bridge.Name)
+			if bridge.Exists {
+				bridge.SpoofFilter = utils.SpoofFilterInstalled(h.ex, utils.InterfaceData(&v, &iface))
+			}
+			bridges = append(bridges, bridge)
+		}
+	}
+	sort.Slice(bridges, func(i, j int) bool { return bridges[i].Name < bridges[j].Name })
+	networks := []admin.Bridge{}
+	for _, network := range h.networks {
+		bridge := admin.Bridge{Name: utils.NetworkBridge(network.VNI), VNI: network.VNI}
+		bridge.Exists, bridge.Up = utils.LinkState(h.ex, bridge.Name)
+		networks = append(networks, bridge)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].VNI < networks[j].VNI })
+	admin.WriteJSON(w, append(bridges, networks...))
+}
+
+func (h *NSQHandler) adminStatus(w http.ResponseWriter, consumer *nsq.Consumer, topic string, channel string) {
+	stats := consumer.Stats()
+	h.worker.mutex.Lock()
+	status := admin.Status{
+		Started:  h.started,
+		Domains:  h.worker.domains,
+		Networks: h.worker.networks,
+		Volumes:  h.worker.volumes,
+		Queue: admin.Queue{
+			Topic:       topic,
+			Channel:     channel,
+			Connections: stats.Connections,
+			Received:    stats.MessagesReceived,
+			Finished:    stats.MessagesFinished,
+			Requeued:    stats.MessagesRequeued,
+			Starved:     consumer.IsStarved(),
+		},
+		Worker: admin.Worker{
+			Busy:    h.worker.busy,
+			Since:   h.worker.since,
+			Handled: h.worker.handled,
+		},
+	}
+	if !h.worker.since.IsZero() {
+		status.Worker.Action = h.worker.action.String()
+	}
+	h.worker.mutex.Unlock()
+	admin.WriteJSON(w, status)
+}
+
+func (h *NSQHandler) adminReconcile(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.Reconcile()
+	admin.WriteJSON(w, struct{}{})
+}
+
+// Reload the Caches from Disk, or libvirt if they are Unusable, and Reconcile
+func (h *NSQHandler) adminResync(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.LoadDomainCache(); err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(w, struct{}{})
+}
+
+// Run an Action for a Cached VM as if it had Arrived Over NSQ
+func (h *NSQHandler) adminReplay(w http.ResponseWriter, r *http.Request) {
+	var request admin.ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	action, err := message.ParseAction(request.Action)
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !replayableActions[action] {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("%s cannot be replayed from the cache", action))
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	cached, ok := h.data[request.ID]
+	if !ok {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown domain %s", request.ID))
+		return
+	}
+	msg := message.Message{ID: int64(h.sfn.Generate()), Action: action, VMData: cached}
+	h.seenIds[msg.ID] = true
+	h.l.Info("Replaying Action", zap.String("domain", request.ID), zap.Stringer("action", action))
+	admin.WriteJSON(w, h.dispatch(&msg))
+}
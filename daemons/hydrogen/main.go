@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	stdjson "encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/digitalocean/go-libvirt"
 	"github.com/fosshostorg/aarch64/daemons/hydrogen/utils"
 	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
 	"github.com/fosshostorg/aarch64/daemons/internal/message"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nsqio/go-nsq"
@@ -21,28 +26,112 @@ import (
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-func NewNSQHandler(l *zap.Logger, p *nsq.Producer, virt *libvirt.Libvirt, sfn *snowflake.Node, domainCachePath string) *NSQHandler {
+// Current Domain Cache Schema Version
+const domainCacheVersion = 3
+
+var domainCacheMigrations = map[int]commons.Migration{
+	// Unversioned Caches Hold the Bare Domain Map
+	0: func(data []byte) ([]byte, error) {
+		return data, nil
+	},
+	// Version 2 Keeps Volumes Next to the Domains
+	1: func(data []byte) ([]byte, error) {
+		wrapped := append([]byte(`{"domains":`), data...)
+		return append(wrapped, `,"volumes":{}}`...), nil
+	},
+	// Version 3 No Longer Caches Root Passwords
+	2: func(data []byte) ([]byte, error) {
+		var cache struct {
+			Domains map[string]map[string]stdjson.RawMessage `json:"domains"`
+			Volumes stdjson.RawMessage                       `json:"volumes"`
+		}
+		if err := stdjson.Unmarshal(data, &cache); err != nil {
+			return nil, err
+		}
+		for _, domain := range cache.Domains {
+			delete(domain, "password")
+		}
+		return stdjson.Marshal(cache)
+	},
+}
+
+// Domain Cache Contents
+type domainCache struct {
+	Domains map[string]message.VMData `json:"domains"`
+	Volumes map[string]message.Volume `json:"volumes"`
+}
+
+func NewNSQHandler(l *zap.Logger, p *nsq.Producer, virt Virt, ex executor.Executor, sfn *snowflake.Node, profiles utils.Profiles, cfg commons.HydrogenConfig) *NSQHandler {
 	return &NSQHandler{
-		l:               l,
-		p:               p,
-		virt:            virt,
-		sfn:             sfn,
-		domainCachePath: domainCachePath,
-		data:            make(map[string]message.VMData),
-		seenIds:         make(map[int64]bool),
-		mutex:           sync.Mutex{},
+		l:        l,
+		p:        p,
+		virt:     virt,
+		ex:       ex,
+		sfn:      sfn,
+		profiles: profiles,
+		config:   cfg,
+		ra:       utils.NewAdvertiser(l, time.Duration(cfg.RAInterval)*time.Second),
+		cache:    commons.NewStore(cfg.DomainCachePath, domainCacheVersion, domainCacheMigrations),
+		netCache: commons.NewStore(cfg.NetworkCachePath, 1, nil),
+		data:     make(map[string]message.VMData),
+		networks: make(map[int]message.Network),
+		volumes:  make(map[string]message.Volume),
+		seenIds:  make(map[int64]bool),
+		mutex:    sync.Mutex{},
+		started:  time.Now(),
 	}
 }
 
+// The libvirt Calls Hydrogen Makes, Satisfied by *libvirt.Libvirt and
+// Replaced in Tests
+type Virt interface {
+	ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error)
+	DomainAttachDeviceFlags(Dom libvirt.Domain, XML string, Flags uint32) error
+	DomainBlockResize(Dom libvirt.Domain, Disk string, Size uint64, Flags libvirt.DomainBlockResizeFlags) error
+	DomainCreate(Dom libvirt.Domain) error
+	DomainDestroy(Dom libvirt.Domain) error
+	DomainDetachDeviceFlags(Dom libvirt.Domain, XML string, Flags uint32) error
+	DomainFsfreeze(Dom libvirt.Domain, Mountpoints []string, Flags uint32) (int32, error)
+	DomainFsthaw(Dom libvirt.Domain, Mountpoints []string, Flags uint32) (int32, error)
+	DomainGetGuestInfo(Dom libvirt.Domain, Types uint32, Flags uint32) ([]libvirt.TypedParam, error)
+	DomainGetInfo(Dom libvirt.Domain) (uint8, uint64, uint64, uint16, uint64, error)
+	DomainGetMetadata(Dom libvirt.Domain, Type int32, Uri libvirt.OptString, Flags libvirt.DomainModificationImpact) (string, error)
+	DomainGetState(Dom libvirt.Domain, Flags uint32) (int32, int32, error)
+	DomainGetXMLDesc(Dom libvirt.Domain, Flags libvirt.DomainXMLFlags) (string, error)
+	DomainInterfaceAddresses(Dom libvirt.Domain, Source uint32, Flags uint32) ([]libvirt.DomainInterface, error)
+	DomainIsActive(Dom libvirt.Domain) (int32, error)
+	DomainLookupByName(Name string) (libvirt.Domain, error)
+	DomainReboot(Dom libvirt.Domain, Flags libvirt.DomainRebootFlagValues) error
+	DomainReset(Dom libvirt.Domain, Flags uint32) error
+	DomainSetBlockIOTune(Dom libvirt.Domain, Disk string, Params []libvirt.TypedParam, Flags uint32) error
+	DomainSetMetadata(Dom libvirt.Domain, Type int32, Metadata libvirt.OptString, Key libvirt.OptString, Uri libvirt.OptString, Flags libvirt.DomainModificationImpact) error
+	DomainSetUserPassword(Dom libvirt.Domain, User libvirt.OptString, Password libvirt.OptString, Flags libvirt.DomainSetUserPasswordFlags) error
+	DomainShutdownFlags(Dom libvirt.Domain, Flags libvirt.DomainShutdownFlagValues) error
+	LifecycleEvents(ctx context.Context) (<-chan libvirt.DomainEventLifecycleMsg, error)
+	NodeGetInfo() ([32]int8, uint64, int32, int32, int32, int32, int32, int32, error)
+}
+
 type NSQHandler struct {
-	l               *zap.Logger
-	p               *nsq.Producer
-	virt            *libvirt.Libvirt
-	sfn             *snowflake.Node
-	domainCachePath string
-	data            map[string]message.VMData
-	seenIds         map[int64]bool
-	mutex           sync.Mutex
+	l        *zap.Logger
+	p        *nsq.Producer
+	virt     Virt
+	ex       executor.Executor
+	sfn      *snowflake.Node
+	profiles utils.Profiles
+	config   commons.HydrogenConfig
+	ra       *utils.Advertiser
+	cache    *commons.Store
+	netCache *commons.Store
+	data     map[string]message.VMData
+	networks map[int]message.Network
+	volumes  map[string]message.Volume
+	seenIds  map[int64]bool
+	// Held While Handling a Message or an Admin Request
+	mutex sync.Mutex
+	// Held While Installing a Base Image
+	imageMutex sync.Mutex
+	started    time.Time
+	worker     workerStatus
 }
 
 func (h *NSQHandler) HandleMessage(m *nsq.Message) error {
@@ -59,16 +148,25 @@ func (h *NSQHandler) HandleMessage(m *nsq.Message) error {
 		return nil
 	}
 
-	// h.mutex.Lock()
-	// defer h.mutex.Unlock()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	// Ensure Duplicate Messaages are Deleted
 	if h.seenIds[msg.ID] {
 		h.l.Error("duplicate message", zap.Int64("message_id", msg.ID))
 		return nil
 	}
 	h.seenIds[msg.ID] = true
+	h.dispatch(&msg)
+	return nil
+}
 
-	// Handle Message Actions
+// Handle a Message's Action, Returning the Result Published for it, if Any
+func (h *NSQHandler) dispatch(msg *message.Message) *message.Result {
+	h.worker.begin(msg.Action)
+	defer func() {
+		h.worker.setCounts(len(h.data), len(h.networks), len(h.volumes))
+		h.worker.end()
+	}()
 	switch msg.Action {
 	// TODO Add and Remove Domains
 	case message.ChangeState:
@@ -76,63 +174,324 @@ func (h *NSQHandler) HandleMessage(m *nsq.Message) error {
 		h.changeDomainState(msgData)
 	case message.AddDomain:
 		vmData := &msg.VMData
-		h.addDomain(vmData)
+		return h.publishResult(msg, vmData.ID, h.addDomain(vmData))
 	case message.DeleteDomain:
 		vmData := &msg.VMData
 		h.deleteDomain(vmData)
+	case message.SetFirewall:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.setFirewall(vmData))
+	case message.SetBandwidth:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.setBandwidth(vmData))
+	case message.AttachInterface:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.attachInterface(vmData))
+	case message.DetachInterface:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.detachInterface(vmData))
+	case message.CreateNetwork:
+		network := &msg.Network
+		return h.publishResult(msg, fmt.Sprintf("%d", network.VNI), h.createNetwork(network))
+	case message.DeleteNetwork:
+		network := &msg.Network
+		return h.publishResult(msg, fmt.Sprintf("%d", network.VNI), h.deleteNetwork(network))
+	case message.JoinNetwork:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.joinNetwork(vmData))
+	case message.LeaveNetwork:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.leaveNetwork(vmData))
+	case message.CreateVolume:
+		volume := &msg.Volume
+		return h.publishResult(msg, volume.ID, h.createVolume(volume))
+	case message.DeleteVolume:
+		volume := &msg.Volume
+		return h.publishResult(msg, volume.ID, h.deleteVolume(volume))
+	case message.AttachVolume:
+		volume := &msg.Volume
+		return h.publishResult(msg, volume.ID, h.attachVolume(volume))
+	case message.DetachVolume:
+		volume := &msg.Volume
+		return h.publishResult(msg, volume.ID, h.detachVolume(volume))
+	case message.ResizeVolume:
+		volume := &msg.Volume
+		return h.publishResult(msg, volume.ID, h.resizeVolume(volume))
+	case message.SetIOTune:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.setIOTune(vmData))
+	case message.EnterRescue:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.enterRescue(vmData, &msg.Rescue))
+	case message.ExitRescue:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.exitRescue(vmData))
+	case message.SetPassword:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.setPassword(vmData, &msg.Credentials))
+	case message.QueryGuest:
+		vmData := &msg.VMData
+		guest, err := h.queryGuest(vmData)
+		msg.Guest = guest
+		return h.publishResult(msg, vmData.ID, err)
+	case message.FreezeFilesystems:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.freezeFilesystems(vmData))
+	case message.ThawFilesystems:
+		vmData := &msg.VMData
+		return h.publishResult(msg, vmData.ID, h.thawFilesystems(vmData))
+	case message.SyncImage:
+		// Downloads Run for up to image_download_timeout, so they Happen in
+		// the Background and Report their Result Once Done
+		go func() {
+			h.publishResult(msg, msg.ImageData.Os, h.syncImage(&msg.ImageData))
+		}()
 	}
 
 	return nil
 }
 
 func (h *NSQHandler) SaveDomainCache() error {
-	file, err := os.Create(h.domainCachePath)
-	defer file.Close()
-	if err != nil {
-		h.l.Error("failed to create hydrogen.json", zap.Error(err))
+	if err := h.cache.Save(domainCache{Domains: h.data, Volumes: h.volumes}); err != nil {
+		h.l.Error("failed to save hydrogen.json", zap.String("path", h.cache.Path), zap.Error(err))
 		return nil
 	}
-	encoder := json.NewEncoder(file)
-	if err = encoder.Encode(h.data); err != nil {
-		h.l.Error("failed to save hydrogen.json", zap.Error(err))
+	return nil
+}
+
+func (h *NSQHandler) SaveNetworkCache() error {
+	if err := h.netCache.Save(h.networks); err != nil {
+		h.l.Error("failed to save network cache", zap.String("path", h.netCache.Path), zap.Error(err))
 		return nil
 	}
 	return nil
 }
 
+// Load the Domain and Network Caches and Reconcile the Host with them. A
+// Missing or Corrupt Domain Cache is Rebuilt from the Metadata of the
+// Domains libvirt Knows, Rather than Continuing with an Empty One
 func (h *NSQHandler) LoadDomainCache() error {
-	file, err := os.Open(h.domainCachePath)
-	if err != nil {
-		h.l.Info("unable to open hydrogen.json")
-		return nil
+	if _, err := h.netCache.Load(&h.networks); err != nil {
+		h.l.Error("failed to load network cache", zap.String("path", h.netCache.Path), zap.Error(err))
+		return err
+	}
+	if h.networks == nil {
+		h.networks = make(map[int]message.Network)
+	}
+	var cache domainCache
+	found, err := h.cache.Load(&cache)
+	if err != nil || !found {
+		if err != nil {
+			h.l.Error("failed to load hydrogen.json, rebuilding it from libvirt", zap.String("path", h.cache.Path), zap.Error(err))
+		} else {
+			h.l.Info("no hydrogen.json found, rebuilding it from libvirt", zap.String("path", h.cache.Path))
+		}
+		recovered, recoverErr := h.recoverDomains()
+		if recoverErr != nil {
+			if err == nil {
+				err = recoverErr
+			}
+			return err
+		}
+		cache = *recovered
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	if err = decoder.Decode(&h.data); err != nil {
-		h.l.Error("failed to load hydrogen.json")
+	if h.data = cache.Domains; h.data == nil {
 		h.data = make(map[string]message.VMData)
-		return nil
 	}
+	if h.volumes = cache.Volumes; h.volumes == nil {
+		h.volumes = make(map[string]message.Volume)
+	}
+	h.l.Info("Successfully Loaded hydrogen.json", zap.Int("domains", len(h.data)), zap.Int("volumes", len(h.volumes)))
+	if !found {
+		h.SaveDomainCache()
+	}
+	h.worker.setCounts(len(h.data), len(h.networks), len(h.volumes))
+	h.Reconcile()
+	return nil
+}
+
+// Read Back the Domains Hydrogen Created from their libvirt Metadata, and
+// the Volumes Attached to them from their Disks. Domains Without Metadata,
+// e.g. Rescue Domains, are Skipped. Detached Volumes Belong to No Domain,
+// so their Project is Lost and they are Left Out, Loudly
+func (h *NSQHandler) recoverDomains() (*domainCache, error) {
+	domains, _, err := h.virt.ConnectListAllDomains(1, 0)
+	if err != nil {
+		h.l.Error("unable to list domains", zap.Error(err))
+		return nil, err
+	}
+	recovered := &domainCache{
+		Domains: make(map[string]message.VMData),
+		Volumes: make(map[string]message.Volume),
+	}
+	for _, domain := range domains {
+		content, err := h.virt.DomainGetMetadata(domain, int32(libvirt.DomainMetadataElement), libvirt.OptString{utils.MetadataURI}, libvirt.DomainAffectConfig)
+		if err != nil {
+			continue
+		}
+		data, err := utils.ParseMetadata(content)
+		if err != nil {
+			h.l.Error("invalid domain metadata", zap.String("name", domain.Name), zap.Error(err))
+			continue
+		}
+		recovered.Domains[data.ID] = *data
+		if err := h.recoverVolumes(domain, data, recovered.Volumes); err != nil {
+			return nil, err
+		}
+	}
+	images, err := utils.VolumeImages()
+	if err != nil {
+		h.l.Error("unable to list volume images", zap.String("path", h.config.VMPath), zap.Error(err))
+		return nil, err
+	}
+	for _, id := range images {
+		if _, ok := recovered.Volumes[id]; !ok {
+			h.l.Error(
+				"detached volume not recovered, its project is unknown and it must be restored by hand",
+				zap.String("volume", id),
+				zap.String("path", utils.VolumePath(id)),
+			)
+		}
+	}
+	h.l.Info(
+		"Recovered Domains from libvirt",
+		zap.Int("domains", len(recovered.Domains)),
+		zap.Int("defined", len(domains)),
+		zap.Int("volumes", len(recovered.Volumes)),
+		zap.Int("volume_images", len(images)),
+	)
+	return recovered, nil
+}
+
+// Recover the Volumes in a Domain's Persistent Definition. They Belong to
+// the Domain's Project, as Volumes are Only Attached Within their Project
+func (h *NSQHandler) recoverVolumes(domain libvirt.Domain, data *message.VMData, volumes map[string]message.Volume) error {
+	definition, err := h.virt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		h.l.Error("unable to read domain definition", zap.String("name", domain.Name), zap.Error(err))
+		return err
+	}
+	attached, err := utils.ParseVolumeDisks(definition)
+	if err != nil {
+		h.l.Error("invalid domain definition", zap.String("name", domain.Name), zap.Error(err))
+		return err
+	}
+	for _, vol := range attached {
+		if vol.Size, err = utils.VolumeImageSize(h.l, h.ex, vol.ID); err != nil {
+			return err
+		}
+		vol.Project = data.Project
+		vol.Domain = data.ID
+		volumes[vol.ID] = vol
+	}
+	return nil
+}
+
+// Record the Domain's Ownership and Networking in its libvirt Definition,
+// so the Domain Cache can be Rebuilt Without it
+func (h *NSQHandler) writeMetadata(data *message.VMData) error {
+	content, err := utils.RenderMetadata(data)
+	if err != nil {
+		h.l.Error("unable to render domain metadata", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	domain, err := h.virt.DomainLookupByName(data.ID)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", data.ID), zap.Error(err))
+		return err
+	}
+	flags := libvirt.DomainAffectConfig
+	if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainAffectLive
+	}
+	if err := h.virt.DomainSetMetadata(
+		domain,
+		int32(libvirt.DomainMetadataElement),
+		libvirt.OptString{content},
+		libvirt.OptString{utils.MetadataKey},
+		libvirt.OptString{utils.MetadataURI},
+		flags,
+	); err != nil {
+		h.l.Error("unable to set domain metadata", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Bring the Host in Line with the Caches: Recreate Private Networks and
+// Missing Bridges, Re-Verify their Source Filters, and Restore Firewalls,
+// Bandwidth Limits, Domains, Volumes and IPv4 Mappings. Safe to Run Repeatedly
+func (h *NSQHandler) Reconcile() {
 	var (
-		total       int = 0
-		bridgeCount int = 0
-		domainCount int = 0
+		bridgeCount int  = 0
+		domainCount int  = 0
+		changed     bool = false
 	)
-	for _, v := range h.data {
-		total += 1
-		if err := utils.CreateAndStartBridge(h.l, &v); err == nil {
-			bridgeCount += 1
+	// Domains Attached to Private Networks Need their Bridges to Start
+	for _, network := range h.networks {
+		utils.CreateNetwork(h.l, h.ex, &network, h.config.VXLANLocal, h.config.VXLANPort)
+	}
+	for id, v := range h.data {
+		// Domains Cached Before MACs were Assigned Keep the One libvirt Gave them
+		if v.MAC == "" {
+			if mac, err := utils.DomainMAC(h.ex, &v); err == nil {
+				v.MAC = mac
+			} else {
+				v.MAC = utils.MACAddress(v.Index)
+			}
+			h.data[id] = v
+			changed = true
+		}
+		for _, iface := range utils.Interfaces(&v) {
+			if _, err := h.startBridge(utils.InterfaceData(&v, &iface)); err == nil {
+				bridgeCount += 1
+			}
+		}
+		if v.Firewall.Policy != "" {
+			utils.ApplyFirewall(h.l, h.ex, &v)
+		}
+		if v.Bandwidth != (message.Bandwidth{}) {
+			utils.ApplyBandwidth(h.l, h.ex, &v)
 		}
-		if err := utils.CreateDomain(h.l, &v); err == nil {
+		profile, err := h.profiles.Get(v.Os)
+		if err != nil {
+			h.l.Error("unable to recreate domain", zap.String("domain", v.ID), zap.Error(err))
+			continue
+		}
+		if err := utils.CreateDomain(h.l, h.ex, profile, &v); err == nil {
 			domainCount += 1
 		}
+		if v.Rescued {
+			utils.ResumeRescue(h.l, h.ex, &v)
+		}
+		// Domains Created Before Metadata was Written Gain it Here
+		h.writeMetadata(&v)
+		// Likewise for the Guest Agent Channel
+		h.ensureGuestAgent(&v)
+		// A Recreated Domain Starts Without its Volumes
+		for _, vol := range h.volumes {
+			if vol.Domain == v.ID {
+				h.ensureVolumeAttached(&vol)
+			}
+		}
+	}
+	// Routes do Not Survive a Reboot, and tayga.conf may have been Rewritten
+	if mappings := utils.IPv4Mappings(h.data); len(mappings) > 0 {
+		utils.WriteTaygaMappings(h.l, h.ex, mappings)
+		for _, v := range h.data {
+			if v.IPv4Address != "" {
+				utils.AddIPv4Route(h.l, h.ex, &v)
+			}
+		}
+	}
+	if changed {
+		h.SaveDomainCache()
 	}
 	h.l.Info(
-		"Successfully Loaded hydrogen.json",
-		zap.Int("bridges_created", bridgeCount),
-		zap.Int("domains_created", domainCount),
+		"Successfully Reconciled Domains",
+		zap.Int("bridges_ready", bridgeCount),
+		zap.Int("domains_ready", domainCount),
 	)
-	return nil
 }
 
 func (h *NSQHandler) MonitorDomainStatus(ctx context.Context) error {
@@ -169,29 +528,1142 @@ func (h *NSQHandler) MonitorDomainStatus(ctx context.Context) error {
 }
 
 func (h *NSQHandler) addDomain(data *message.VMData) error {
-	if err := utils.CreateAndStartBridge(h.l, data); err != nil {
-		return nil
+	// Reject Unknown Operating Systems and Invalid User-Data Before Creating Anything
+	profile, err := h.profiles.Get(data.Os)
+	if err != nil {
+		h.l.Error("unable to select os profile", zap.String("domain", data.ID), zap.Error(err))
+		return err
 	}
-	if err := utils.CreateDomain(h.l, data); err != nil {
-		return nil
+	if err := profile.Validate(data); err != nil {
+		h.l.Error("domain does not satisfy os profile", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.ValidateUserData(data.UserData); err != nil {
+		h.l.Error("invalid user-data", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.ValidateFirewall(&data.Firewall); err != nil {
+		h.l.Error("invalid firewall", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.ValidateBandwidth(&data.Bandwidth); err != nil {
+		h.l.Error("invalid bandwidth limits", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.ValidateIOTune(&data.IOTune); err != nil {
+		h.l.Error("invalid disk i/o limits", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if data.MAC == "" {
+		data.MAC = utils.MACAddress(data.Index)
+	}
+	for i := range data.Interfaces {
+		if data.Interfaces[i].MAC == "" {
+			data.Interfaces[i].MAC = utils.MACAddress(data.Interfaces[i].Index)
+		}
+	}
+	if err := utils.ValidateInterfaces(data); err != nil {
+		h.l.Error("invalid interfaces", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := h.checkBridges(data); err != nil {
+		h.l.Error("invalid interfaces", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	for i := range data.Networks {
+		// Each Membership is Checked Against the Ones Before it
+		joined := *data
+		joined.Networks = data.Networks[:i]
+		if err := h.validateMember(&joined, &data.Networks[i]); err != nil {
+			h.l.Error("invalid network membership", zap.String("domain", data.ID), zap.Error(err))
+			return err
+		}
+	}
+	if data.IPv4 && data.IPv4Address == "" {
+		if err := h.assignIPv4(data); err != nil {
+			return err
+		}
+	}
+	// Remove the Bridges and IPv4 Mapping Again if the Domain Cannot be Created
+	steps := []utils.Step{h.bridgeStep("bridge", data)}
+	for i := range data.Interfaces {
+		ifaceData := utils.InterfaceData(data, &data.Interfaces[i])
+		steps = append(steps, h.bridgeStep(fmt.Sprintf("bridge vbr%d", ifaceData.Index), ifaceData))
+	}
+	if data.IPv4Address != "" {
+		steps = append(steps, utils.Step{
+			Name: "ipv4",
+			Do:   func() error { return h.addIPv4(data) },
+			Undo: func() error { return h.deleteIPv4(data) },
+		})
+	}
+	if data.Firewall.Policy != "" {
+		steps = append(steps, utils.Step{
+			Name: "firewall",
+			Do:   func() error { return utils.ApplyFirewall(h.l, h.ex, data) },
+			Undo: func() error { return utils.RemoveFirewall(h.l, h.ex, data) },
+		})
+	}
+	if data.Bandwidth != (message.Bandwidth{}) {
+		steps = append(steps, utils.Step{
+			Name: "bandwidth",
+			Do:   func() error { return utils.ApplyBandwidth(h.l, h.ex, data) },
+			Undo: func() error { utils.RemoveBandwidth(h.ex, data); return nil },
+		})
+	}
+	steps = append(steps, utils.Step{
+		Name: "domain",
+		Do:   func() error { return utils.CreateDomain(h.l, h.ex, profile, data) },
+	})
+	if err := utils.RunSteps(h.l, steps); err != nil {
+		h.l.Error("unable to create domain, rolled back", zap.String("domain", data.ID), zap.Error(err))
+		return err
 	}
 
-	// Update In-Memory Storage and Cache
-	h.data[data.ID] = *data
+	// Update In-Memory Storage and Cache. The Password was Only Needed for
+	// the Seed Image
+	cached := *data
+	cached.Password = ""
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
 	h.SaveDomainCache()
 	return nil
 }
 
+// Bring up the Domain's Bridge and Advertise its Prefix there. Guests
+// Configured Statically do Not Depend on Advertisements, so Failing to
+// Start them is Only Logged
+func (h *NSQHandler) startBridge(data *message.VMData) (created bool, err error) {
+	if created, err = utils.CreateAndStartBridge(h.l, h.ex, data); err != nil {
+		return created, err
+	}
+	if err := h.ra.Start(data); err != nil {
+		h.l.Error("unable to start router advertisements", zap.String("domain", data.ID), zap.Error(err))
+	}
+	return created, nil
+}
+
+// Check None of the Domain's Bridges Belongs to Another Domain. Sharing a
+// Bridge would Put the Domain on the Other's Segment, Give it the Other's
+// Default MAC and have its Spoof Filter Replace the Other's
+func (h *NSQHandler) checkBridges(data *message.VMData) error {
+	for id, other := range h.data {
+		if id == data.ID {
+			continue
+		}
+		for _, theirs := range utils.Interfaces(&other) {
+			for _, ours := range utils.Interfaces(data) {
+				if ours.Index == theirs.Index {
+					return fmt.Errorf("bridge vbr%d belongs to domain %s", ours.Index, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Provisioning Step Bringing up a Bridge. Rolling Back Only Removes the
+// Bridge if this Step Created it, so a Repeated Request Never Tears Down
+// the Bridge of a Running Domain
+func (h *NSQHandler) bridgeStep(name string, data *message.VMData) utils.Step {
+	var created bool
+	return utils.Step{
+		Name: name,
+		Do: func() (err error) {
+			created, err = h.startBridge(data)
+			return err
+		},
+		Undo: func() error {
+			if !created {
+				return nil
+			}
+			return h.stopBridge(data)
+		},
+	}
+}
+
+func (h *NSQHandler) stopBridge(data *message.VMData) error {
+	h.ra.Stop(data)
+	return utils.DeleteBridge(h.l, h.ex, data)
+}
+
+// Give the Domain an IPv4 Address. A Re-Sent add_domain Keeps the Address
+// it was Given Before, Found in the Cache or in tayga.conf, so the Old Map
+// is Not Left Behind Pointing at the Domain
+func (h *NSQHandler) assignIPv4(data *message.VMData) error {
+	if cached, ok := h.data[data.ID]; ok && cached.IPv4Address != "" {
+		data.IPv4Address = cached.IPv4Address
+		return nil
+	}
+	mappings, err := utils.ReadTaygaMappings(h.l)
+	if err != nil {
+		return err
+	}
+	address := strings.SplitN(data.Address, "/", 2)[0]
+	taken := []string{}
+	for ipv4, ipv6 := range mappings {
+		if ipv6 == address {
+			data.IPv4Address = ipv4
+			return nil
+		}
+		taken = append(taken, ipv4)
+	}
+	for _, v := range h.data {
+		taken = append(taken, v.IPv4Address)
+	}
+	if data.IPv4Address, err = utils.AllocateIPv4(h.config.IPv4Pool, taken); err != nil {
+		h.l.Error("unable to assign ipv4 address", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Map the Domain's IPv4 Address to its IPv6 Address in Tayga and Route it
+func (h *NSQHandler) addIPv4(data *message.VMData) error {
+	mappings := utils.IPv4Mappings(h.data)
+	mappings[data.IPv4Address] = strings.SplitN(data.Address, "/", 2)[0]
+	if err := utils.WriteTaygaMappings(h.l, h.ex, mappings); err != nil {
+		return err
+	}
+	return utils.AddIPv4Route(h.l, h.ex, data)
+}
+
+// Remove the Domain's IPv4 Route and Tayga Mapping
+func (h *NSQHandler) deleteIPv4(data *message.VMData) error {
+	mappings := utils.IPv4Mappings(h.data)
+	delete(mappings, data.IPv4Address)
+	routeErr := utils.DeleteIPv4Route(h.l, h.ex, data)
+	if err := utils.WriteTaygaMappings(h.l, h.ex, mappings); err != nil {
+		return err
+	}
+	return routeErr
+}
+
 func (h *NSQHandler) deleteDomain(data *message.VMData) error {
-	utils.DeleteDomain(h.l, data)
-	utils.DeleteBridge(h.l, data)
+	// The Request may Only Carry the ID, so Prefer the Cached Domain
+	if cached, ok := h.data[data.ID]; ok {
+		data = &cached
+	}
+	if data.Rescued {
+		utils.DeleteRescue(h.l, h.ex, data)
+	}
+	utils.DeleteDomain(h.l, h.ex, data)
+	for _, iface := range utils.Interfaces(data) {
+		h.stopBridge(utils.InterfaceData(data, &iface))
+	}
+	if data.Firewall.Policy != "" {
+		utils.RemoveFirewall(h.l, h.ex, data)
+	}
+	if data.IPv4Address != "" {
+		h.deleteIPv4(data)
+	}
+
+	// Volumes Outlive the Domain and can be Attached Elsewhere
+	for id, vol := range h.volumes {
+		if vol.Domain == data.ID {
+			vol.Domain, vol.Target = "", ""
+			h.volumes[id] = vol
+		}
+	}
 
 	delete(h.data, data.ID)
 	h.SaveDomainCache()
 	return nil
 }
 
+// Replace a Domain's Firewall, Keeping the Old One if the New One Fails
+func (h *NSQHandler) setFirewall(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok {
+		err := fmt.Errorf("unknown domain %s", data.ID)
+		h.l.Error("unable to set firewall", zap.Error(err))
+		return err
+	}
+	cached.Firewall = data.Firewall
+	if err := utils.ApplyFirewall(h.l, h.ex, &cached); err != nil {
+		return err
+	}
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	h.l.Info("Successfully Set Firewall", zap.String("domain", data.ID), zap.Int("rules", len(data.Firewall.Rules)))
+	return nil
+}
+
+// Replace a Domain's Bandwidth Limits While it Keeps Running
+func (h *NSQHandler) setBandwidth(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok {
+		err := fmt.Errorf("unknown domain %s", data.ID)
+		h.l.Error("unable to set bandwidth limits", zap.Error(err))
+		return err
+	}
+	cached.Bandwidth = data.Bandwidth
+	if err := utils.ApplyBandwidth(h.l, h.ex, &cached); err != nil {
+		return err
+	}
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	h.l.Info(
+		"Successfully Set Bandwidth Limits",
+		zap.String("domain", data.ID),
+		zap.Int("inbound", data.Bandwidth.Inbound),
+		zap.Int("outbound", data.Bandwidth.Outbound),
+		zap.Int("packet_rate", data.Bandwidth.PacketRate),
+	)
+	return nil
+}
+
+// Hot Plug an Additional Interface, Given as the Only Entry of Interfaces,
+// into a Domain. The Guest Picks up its Address Through Router
+// Advertisements, so Routed Prefixes go Via its Link-Local Address. The
+// Domain's Firewall and Bandwidth Limits Cover the New Bridge Too
+func (h *NSQHandler) attachInterface(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok || len(data.Interfaces) != 1 {
+		err := fmt.Errorf("unknown domain %s or not exactly one interface given", data.ID)
+		h.l.Error("unable to attach interface", zap.Error(err))
+		return err
+	}
+	iface := data.Interfaces[0]
+	if iface.MAC == "" {
+		iface.MAC = utils.MACAddress(iface.Index)
+	}
+	iface.Hotplugged = true
+	cached.Interfaces = append(cached.Interfaces, iface)
+	if err := utils.ValidateInterfaces(&cached); err != nil {
+		h.l.Error("invalid interface", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := h.checkBridges(&cached); err != nil {
+		h.l.Error("invalid interface", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	ifaceData := utils.InterfaceData(&cached, &iface)
+	steps := []utils.Step{h.bridgeStep("bridge", ifaceData)}
+	if cached.Firewall.Policy != "" {
+		steps = append(steps, utils.Step{
+			Name: "firewall",
+			Do:   func() error { return utils.ApplyFirewall(h.l, h.ex, ifaceData) },
+			Undo: func() error { return utils.RemoveFirewall(h.l, h.ex, ifaceData) },
+		})
+	}
+	if cached.Bandwidth != (message.Bandwidth{}) {
+		steps = append(steps, utils.Step{
+			Name: "bandwidth",
+			Do:   func() error { return utils.ApplyBandwidth(h.l, h.ex, ifaceData) },
+			Undo: func() error { utils.RemoveBandwidth(h.ex, ifaceData); return nil },
+		})
+	}
+	steps = append(steps, utils.Step{
+		Name: "attach",
+		Do: func() error {
+			return utils.AttachInterface(h.l, h.ex, &cached, fmt.Sprintf("vbr%d", iface.Index), iface.MAC)
+		},
+	})
+	if err := utils.RunSteps(h.l, steps); err != nil {
+		h.l.Error("unable to attach interface, rolled back", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	h.l.Info("Successfully Attached Interface", zap.String("domain", data.ID), zap.Int("bridge", iface.Index))
+	return nil
+}
+
+// Unplug an Additional Interface, Identified by its Bridge Index, from a
+// Domain and Remove its Bridge. The Primary Interface Stays
+func (h *NSQHandler) detachInterface(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok || len(data.Interfaces) != 1 {
+		err := fmt.Errorf("unknown domain %s or not exactly one interface given", data.ID)
+		h.l.Error("unable to detach interface", zap.Error(err))
+		return err
+	}
+	for i, iface := range cached.Interfaces {
+		if iface.Index != data.Interfaces[0].Index {
+			continue
+		}
+		if err := utils.DetachInterface(h.l, h.ex, &cached, iface.MAC); err != nil {
+			return err
+		}
+		ifaceData := utils.InterfaceData(&cached, &iface)
+		if cached.Firewall.Policy != "" {
+			utils.RemoveFirewall(h.l, h.ex, ifaceData)
+		}
+		h.stopBridge(ifaceData)
+		cached.Interfaces = append(cached.Interfaces[:i:i], cached.Interfaces[i+1:]...)
+		h.data[data.ID] = cached
+		h.writeMetadata(&cached)
+		h.SaveDomainCache()
+		h.l.Info("Successfully Detached Interface", zap.String("domain", data.ID), zap.Int("bridge", iface.Index))
+		return nil
+	}
+	err := fmt.Errorf("domain %s has no additional interface on vbr%d", data.ID, data.Interfaces[0].Index)
+	h.l.Error("unable to detach interface", zap.Error(err))
+	return err
+}
+
+// Create a Private Network's Bridge and Tunnel, or Update its Peers
+func (h *NSQHandler) createNetwork(network *message.Network) error {
+	if err := utils.ValidateNetwork(network); err != nil {
+		h.l.Error("invalid network", zap.Error(err))
+		return err
+	}
+	if existing, ok := h.networks[network.VNI]; ok && existing.Project != network.Project {
+		err := fmt.Errorf("network %d belongs to project %s", network.VNI, existing.Project)
+		h.l.Error("unable to create network", zap.Error(err))
+		return err
+	}
+	if err := utils.CreateNetwork(h.l, h.ex, network, h.config.VXLANLocal, h.config.VXLANPort); err != nil {
+		return err
+	}
+	h.networks[network.VNI] = *network
+	h.SaveNetworkCache()
+	h.l.Info("Successfully Created Network", zap.Int("vni", network.VNI), zap.Int("peers", len(network.Peers)))
+	return nil
+}
+
+// Remove a Private Network No Local Domain is Attached to Anymore
+func (h *NSQHandler) deleteNetwork(network *message.Network) error {
+	for _, v := range h.data {
+		for _, member := range v.Networks {
+			if member.VNI == network.VNI {
+				err := fmt.Errorf("domain %s is still attached to network %d", v.ID, network.VNI)
+				h.l.Error("unable to delete network", zap.Error(err))
+				return err
+			}
+		}
+	}
+	if err := utils.DeleteNetwork(h.l, h.ex, network); err != nil {
+		return err
+	}
+	delete(h.networks, network.VNI)
+	h.SaveNetworkCache()
+	h.l.Info("Successfully Deleted Network", zap.Int("vni", network.VNI))
+	return nil
+}
+
+// Check a Domain may Join a Network Created on this Host, Assigning the
+// Membership a MAC if it has None. data.Networks are the Networks the
+// Domain is Already Attached to
+func (h *NSQHandler) validateMember(data *message.VMData, member *message.NetworkMember) error {
+	network, ok := h.networks[member.VNI]
+	if !ok {
+		return fmt.Errorf("unknown network %d", member.VNI)
+	}
+	if network.Project != data.Project {
+		return fmt.Errorf("network %d belongs to another project", member.VNI)
+	}
+	for _, other := range data.Networks {
+		if other.VNI == member.VNI {
+			return fmt.Errorf("domain %s is already attached to network %d", data.ID, member.VNI)
+		}
+	}
+	if member.MAC == "" {
+		member.MAC = utils.PrivateMACAddress(data)
+	}
+	return utils.ValidateMember(&network, member)
+}
+
+// Plug an Interface on a Private Network, Given as the Only Entry of
+// Networks, into a Stopped Domain. Private Addresses are Only Rendered into
+// the Guest Network Config at Creation and Nothing on pbr<vni> Hands them
+// Out, so a Running Guest would Get a NIC it Cannot Use. Domains Joined
+// Later have to be Given the Address by their Owner
+func (h *NSQHandler) joinNetwork(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok || len(data.Networks) != 1 {
+		err := fmt.Errorf("unknown domain %s or not exactly one network given", data.ID)
+		h.l.Error("unable to join network", zap.Error(err))
+		return err
+	}
+	domain, err := h.virt.DomainLookupByName(data.ID)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", data.ID), zap.Error(err))
+		return err
+	}
+	if active, err := h.virt.DomainIsActive(domain); err != nil || active == 1 {
+		if err == nil {
+			err = fmt.Errorf("domain %s is running, stop it before joining network %d", data.ID, data.Networks[0].VNI)
+		}
+		h.l.Error("unable to join network", zap.Error(err))
+		return err
+	}
+	member := data.Networks[0]
+	if err := h.validateMember(&cached, &member); err != nil {
+		h.l.Error("unable to join network", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.AttachInterface(h.l, h.ex, &cached, utils.NetworkBridge(member.VNI), member.MAC); err != nil {
+		return err
+	}
+	cached.Networks = append(cached.Networks, member)
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	h.l.Info("Successfully Joined Network", zap.String("domain", data.ID), zap.Int("vni", member.VNI))
+	return nil
+}
+
+// Unplug a Domain's Interface on a Private Network
+func (h *NSQHandler) leaveNetwork(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok || len(data.Networks) != 1 {
+		err := fmt.Errorf("unknown domain %s or not exactly one network given", data.ID)
+		h.l.Error("unable to leave network", zap.Error(err))
+		return err
+	}
+	for i, member := range cached.Networks {
+		if member.VNI != data.Networks[0].VNI {
+			continue
+		}
+		if err := utils.DetachInterface(h.l, h.ex, &cached, member.MAC); err != nil {
+			return err
+		}
+		cached.Networks = append(cached.Networks[:i:i], cached.Networks[i+1:]...)
+		h.data[data.ID] = cached
+		h.writeMetadata(&cached)
+		h.SaveDomainCache()
+		h.l.Info("Successfully Left Network", zap.String("domain", data.ID), zap.Int("vni", member.VNI))
+		return nil
+	}
+	err := fmt.Errorf("domain %s is not attached to network %d", data.ID, data.Networks[0].VNI)
+	h.l.Error("unable to leave network", zap.Error(err))
+	return err
+}
+
+// Replace the Disk I/O Limits of a Domain's Root Disk and Attached Volumes,
+// Live if it is Running
+func (h *NSQHandler) setIOTune(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok {
+		err := fmt.Errorf("unknown domain %s", data.ID)
+		h.l.Error("unable to set disk i/o limits", zap.Error(err))
+		return err
+	}
+	if err := utils.ValidateIOTune(&data.IOTune); err != nil {
+		h.l.Error("invalid disk i/o limits", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	domain, err := h.virt.DomainLookupByName(data.ID)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", data.ID), zap.Error(err))
+		return err
+	}
+	flags := libvirt.DomainAffectConfig
+	if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainAffectLive
+	}
+	params := []libvirt.TypedParam{}
+	for _, setting := range utils.IOTuneSettings(&data.IOTune) {
+		params = append(params, libvirt.TypedParam{Field: setting.Name, Value: *libvirt.NewTypedParamValueUllong(setting.Value)})
+	}
+	disks := []string{"vda"}
+	for _, vol := range h.volumes {
+		if vol.Domain == data.ID {
+			disks = append(disks, vol.Target)
+		}
+	}
+	for _, disk := range disks {
+		if err := h.virt.DomainSetBlockIOTune(domain, disk, params, uint32(flags)); err != nil {
+			h.l.Error("unable to set disk i/o limits", zap.String("domain", data.ID), zap.String("disk", disk), zap.Error(err))
+			return err
+		}
+	}
+	cached.IOTune = data.IOTune
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	h.l.Info("Successfully Set Disk I/O Limits", zap.String("domain", data.ID), zap.Int("disks", len(disks)))
+	return nil
+}
+
+// Boot a Domain into the Rescue System with its Disk Attached as vdb
+func (h *NSQHandler) enterRescue(data *message.VMData, rescue *message.Rescue) error {
+	cached, ok := h.data[data.ID]
+	switch {
+	case !ok:
+		err := fmt.Errorf("unknown domain %s", data.ID)
+		h.l.Error("unable to enter rescue", zap.Error(err))
+		return err
+	case cached.Rescued:
+		err := fmt.Errorf("domain %s is already in rescue", data.ID)
+		h.l.Error("unable to enter rescue", zap.Error(err))
+		return err
+	}
+	profile, err := h.profiles.Get(h.config.RescueOS)
+	if err != nil {
+		h.l.Error("unable to select rescue os profile", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	if err := utils.EnterRescue(h.l, h.ex, profile, &cached, rescue); err != nil {
+		return err
+	}
+	cached.Rescued = true
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	return nil
+}
+
+// Remove the Rescue Domain and Boot the Domain from its Own Disk Again
+func (h *NSQHandler) exitRescue(data *message.VMData) error {
+	cached, ok := h.data[data.ID]
+	if !ok || !cached.Rescued {
+		err := fmt.Errorf("unknown domain %s or not in rescue", data.ID)
+		h.l.Error("unable to exit rescue", zap.Error(err))
+		return err
+	}
+	if err := utils.ExitRescue(h.l, h.ex, &cached); err != nil {
+		return err
+	}
+	cached.Rescued = false
+	h.data[data.ID] = cached
+	h.writeMetadata(&cached)
+	h.SaveDomainCache()
+	return nil
+}
+
+// Look up a Cached Domain in libvirt for a Guest Agent Action
+func (h *NSQHandler) agentDomain(id string) (libvirt.Domain, error) {
+	if _, ok := h.data[id]; !ok {
+		err := fmt.Errorf("unknown domain %s", id)
+		h.l.Error("unable to reach guest agent", zap.Error(err))
+		return libvirt.Domain{}, err
+	}
+	domain, err := h.virt.DomainLookupByName(id)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", id), zap.Error(err))
+		return libvirt.Domain{}, err
+	}
+	return domain, nil
+}
+
+// Reset a Guest User's Password Through the Guest Agent. The Password is
+// Passed Straight Through and Never Stored
+func (h *NSQHandler) setPassword(data *message.VMData, credentials *message.Credentials) error {
+	if credentials.Password == "" {
+		err := fmt.Errorf("no password given for %s", data.ID)
+		h.l.Error("unable to set password", zap.Error(err))
+		return err
+	}
+	user := credentials.User
+	if user == "" {
+		user = "root"
+	}
+	domain, err := h.agentDomain(data.ID)
+	if err != nil {
+		return err
+	}
+	if err := h.virt.DomainSetUserPassword(domain, libvirt.OptString{user}, libvirt.OptString{credentials.Password}, 0); err != nil {
+		h.l.Error("unable to set password", zap.String("domain", data.ID), zap.String("user", user), zap.Error(err))
+		return err
+	}
+	h.l.Info("Successfully Set Password", zap.String("domain", data.ID), zap.String("user", user))
+	return nil
+}
+
+// Ask the Guest Agent for the Guest's OS and Interface Addresses
+func (h *NSQHandler) queryGuest(data *message.VMData) (message.GuestInfo, error) {
+	domain, err := h.agentDomain(data.ID)
+	if err != nil {
+		return message.GuestInfo{}, err
+	}
+	params, err := h.virt.DomainGetGuestInfo(domain, uint32(libvirt.DomainGuestInfoOs|libvirt.DomainGuestInfoHostname), 0)
+	if err != nil {
+		h.l.Error("unable to query guest info", zap.String("domain", data.ID), zap.Error(err))
+		return message.GuestInfo{}, err
+	}
+	ifaces, err := h.virt.DomainInterfaceAddresses(domain, uint32(libvirt.DomainInterfaceAddressesSrcAgent), 0)
+	if err != nil {
+		h.l.Error("unable to query guest addresses", zap.String("domain", data.ID), zap.Error(err))
+		return message.GuestInfo{}, err
+	}
+	return guestInfo(params, ifaces), nil
+}
+
+// Collect what the Guest Agent Reported, Leaving Out Loopback Addresses
+func guestInfo(params []libvirt.TypedParam, ifaces []libvirt.DomainInterface) message.GuestInfo {
+	var info message.GuestInfo
+	for _, param := range params {
+		value, _ := param.Value.I.(string)
+		switch param.Field {
+		case "os.pretty-name":
+			info.OS = value
+		case "os.kernel-release":
+			info.Kernel = value
+		case "hostname":
+			info.Hostname = value
+		}
+	}
+	for _, iface := range ifaces {
+		guestIface := message.GuestInterface{Name: iface.Name, Addresses: []string{}}
+		if len(iface.Hwaddr) > 0 {
+			guestIface.MAC = iface.Hwaddr[0]
+		}
+		for _, addr := range iface.Addrs {
+			if ip := net.ParseIP(addr.Addr); ip == nil || ip.IsLoopback() {
+				continue
+			}
+			guestIface.Addresses = append(guestIface.Addresses, fmt.Sprintf("%s/%d", addr.Addr, addr.Prefix))
+		}
+		if len(guestIface.Addresses) > 0 {
+			info.Interfaces = append(info.Interfaces, guestIface)
+		}
+	}
+	return info
+}
+
+// Flush and Freeze the Guest's Filesystems, e.g. Before Snapshotting its
+// Disks. They Stay Frozen Until Thawed
+func (h *NSQHandler) freezeFilesystems(data *message.VMData) error {
+	domain, err := h.agentDomain(data.ID)
+	if err != nil {
+		return err
+	}
+	count, err := h.virt.DomainFsfreeze(domain, nil, 0)
+	if err != nil {
+		h.l.Error("unable to freeze filesystems", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	h.l.Info("Successfully Froze Filesystems", zap.String("domain", data.ID), zap.Int32("filesystems", count))
+	return nil
+}
+
+func (h *NSQHandler) thawFilesystems(data *message.VMData) error {
+	domain, err := h.agentDomain(data.ID)
+	if err != nil {
+		return err
+	}
+	count, err := h.virt.DomainFsthaw(domain, nil, 0)
+	if err != nil {
+		h.l.Error("unable to thaw filesystems", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	h.l.Info("Successfully Thawed Filesystems", zap.String("domain", data.ID), zap.Int32("filesystems", count))
+	return nil
+}
+
+// Shut a Domain Down with ACPI, Falling Back to the Guest Agent if the
+// Guest Ignores the Power Button. A Guest Ignoring Both is Left Running
+func (h *NSQHandler) shutdownDomain(domain libvirt.Domain) {
+	timeout := time.Duration(h.config.ShutdownTimeout) * time.Second
+	for _, method := range []libvirt.DomainShutdownFlagValues{libvirt.DomainShutdownAcpiPowerBtn, libvirt.DomainShutdownGuestAgent} {
+		if err := h.virt.DomainShutdownFlags(domain, method); err != nil {
+			h.l.Error("unable to shutdown domain", zap.String("name", domain.Name), zap.Uint32("method", uint32(method)), zap.Error(err))
+			continue
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			if active, err := h.virt.DomainIsActive(domain); err != nil || active == 0 {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	h.l.Error("domain ignored shutdown requests", zap.String("name", domain.Name))
+}
+
+func (h *NSQHandler) createVolume(vol *message.Volume) error {
+	if err := utils.ValidateVolume(vol); err != nil {
+		h.l.Error("invalid volume", zap.Error(err))
+		return err
+	}
+	if _, ok := h.volumes[vol.ID]; ok {
+		h.l.Error("unable to create volume", zap.String("volume", vol.ID), zap.Error(utils.ErrVolumeExists))
+		return utils.ErrVolumeExists
+	}
+	if err := utils.CreateVolumeImage(h.l, h.ex, vol); err != nil {
+		return err
+	}
+	h.volumes[vol.ID] = message.Volume{ID: vol.ID, Project: vol.Project, Size: vol.Size}
+	h.SaveDomainCache()
+	h.l.Info("Successfully Created Volume", zap.String("volume", vol.ID), zap.Int("size", vol.Size))
+	return nil
+}
+
+// Delete a Detached Volume and its Data
+func (h *NSQHandler) deleteVolume(vol *message.Volume) error {
+	cached, err := h.cachedVolume(vol.ID)
+	if err != nil {
+		return err
+	}
+	if cached.Domain != "" {
+		err := fmt.Errorf("volume %s is attached to %s", vol.ID, cached.Domain)
+		h.l.Error("unable to delete volume", zap.Error(err))
+		return err
+	}
+	if err := utils.DeleteVolumeImage(h.l, &cached); err != nil {
+		return err
+	}
+	delete(h.volumes, vol.ID)
+	h.SaveDomainCache()
+	h.l.Info("Successfully Deleted Volume", zap.String("volume", vol.ID))
+	return nil
+}
+
+// Attach a Volume to vol.Domain, Live if the Domain is Running
+func (h *NSQHandler) attachVolume(vol *message.Volume) error {
+	cached, err := h.cachedVolume(vol.ID)
+	if err != nil {
+		return err
+	}
+	domain, ok := h.data[vol.Domain]
+	switch {
+	case cached.Domain != "":
+		err = fmt.Errorf("volume %s is already attached to %s", vol.ID, cached.Domain)
+	case !ok:
+		err = fmt.Errorf("unknown domain %s", vol.Domain)
+	case domain.Project != cached.Project:
+		err = fmt.Errorf("volume %s belongs to another project", vol.ID)
+	}
+	if err != nil {
+		h.l.Error("unable to attach volume", zap.Error(err))
+		return err
+	}
+	if cached.Target, err = utils.FreeTarget(h.volumes, vol.Domain); err != nil {
+		h.l.Error("unable to attach volume", zap.Error(err))
+		return err
+	}
+	cached.Domain = vol.Domain
+	if err := h.modifyVolumeDevice(&cached, h.virt.DomainAttachDeviceFlags); err != nil {
+		return err
+	}
+	h.volumes[vol.ID] = cached
+	h.SaveDomainCache()
+	h.l.Info("Successfully Attached Volume", zap.String("volume", vol.ID), zap.String("domain", vol.Domain), zap.String("target", cached.Target))
+	return nil
+}
+
+// How Often the Live Definition is Checked While a Guest Releases a Volume
+var detachPollInterval = time.Second
+
+// Detach a Volume from its Domain. Removing a Disk from a Running Domain
+// Only Asks the Guest to Let go of it, so the Volume is Only Marked Detached
+// Once the Disk has Left the Live Definition. A Guest Holding on Past the
+// Timeout Fails the Request with ErrDetachTimeout, and Sending it Again
+// Carries on from Whatever was Already Removed
+func (h *NSQHandler) detachVolume(vol *message.Volume) error {
+	cached, err := h.cachedVolume(vol.ID)
+	if err != nil {
+		return err
+	}
+	if cached.Domain == "" {
+		return nil
+	}
+	domain, err := h.virt.DomainLookupByName(cached.Domain)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", cached.Domain), zap.Error(err))
+		return err
+	}
+	tune := h.data[cached.Domain].IOTune
+	device := utils.VolumeXML(&cached, &tune)
+	if xml, err := h.virt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive); err != nil {
+		h.l.Error("unable to read domain definition", zap.String("name", cached.Domain), zap.Error(err))
+		return err
+	} else if utils.VolumeInXML(xml, cached.ID) {
+		if err := h.virt.DomainDetachDeviceFlags(domain, device, uint32(libvirt.DomainDeviceModifyConfig)); err != nil {
+			h.l.Error("unable to detach volume", zap.String("volume", vol.ID), zap.String("domain", cached.Domain), zap.Error(err))
+			return err
+		}
+	}
+	if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+		if err := h.detachLiveVolume(domain, &cached, device); err != nil {
+			return err
+		}
+	}
+	h.l.Info("Successfully Detached Volume", zap.String("volume", vol.ID), zap.String("domain", cached.Domain))
+	cached.Domain, cached.Target = "", ""
+	h.volumes[vol.ID] = cached
+	h.SaveDomainCache()
+	return nil
+}
+
+// Ask the Running Guest to Release the Volume and Poll the Live Definition
+// Until the Disk is Gone
+func (h *NSQHandler) detachLiveVolume(domain libvirt.Domain, vol *message.Volume, device string) error {
+	attached := func() (bool, error) {
+		xml, err := h.virt.DomainGetXMLDesc(domain, 0)
+		return err == nil && utils.VolumeInXML(xml, vol.ID), err
+	}
+	if ok, err := attached(); err != nil {
+		h.l.Error("unable to read domain definition", zap.String("name", vol.Domain), zap.Error(err))
+		return err
+	} else if !ok {
+		return nil
+	}
+	// A Removal Still Pending from an Earlier Attempt Makes this Fail, the
+	// Wait Below Tells Whether the Disk Went Away Regardless
+	if err := h.virt.DomainDetachDeviceFlags(domain, device, uint32(libvirt.DomainDeviceModifyLive)); err != nil {
+		h.l.Error("unable to request volume removal", zap.String("volume", vol.ID), zap.String("domain", vol.Domain), zap.Error(err))
+	}
+	deadline := time.Now().Add(time.Duration(h.config.VolumeDetachTimeout) * time.Second)
+	for {
+		ok, err := attached()
+		if err != nil {
+			h.l.Error("unable to read domain definition", zap.String("name", vol.Domain), zap.Error(err))
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			h.l.Error("guest did not release volume", zap.String("volume", vol.ID), zap.String("domain", vol.Domain), zap.Error(utils.ErrDetachTimeout))
+			return utils.ErrDetachTimeout
+		}
+		time.Sleep(detachPollInterval)
+	}
+}
+
+// Grow a Volume, Through libvirt While it is Attached to a Running Domain
+func (h *NSQHandler) resizeVolume(vol *message.Volume) error {
+	cached, err := h.cachedVolume(vol.ID)
+	if err != nil {
+		return err
+	}
+	if vol.Size <= cached.Size {
+		err := fmt.Errorf("volume %s can only grow beyond %dG", vol.ID, cached.Size)
+		h.l.Error("unable to resize volume", zap.Error(err))
+		return err
+	}
+	cached.Size = vol.Size
+	live := false
+	if cached.Domain != "" {
+		domain, err := h.virt.DomainLookupByName(cached.Domain)
+		if err != nil {
+			h.l.Error("unable to locate domain", zap.String("name", cached.Domain), zap.Error(err))
+			return err
+		}
+		if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+			live = true
+			if err := h.virt.DomainBlockResize(domain, cached.Target, uint64(cached.Size)<<30, libvirt.DomainBlockResizeBytes); err != nil {
+				h.l.Error("unable to resize volume", zap.String("volume", vol.ID), zap.Error(err))
+				return err
+			}
+		}
+	}
+	if !live {
+		if err := utils.ResizeVolumeImage(h.l, h.ex, &cached); err != nil {
+			return err
+		}
+	}
+	h.volumes[vol.ID] = cached
+	h.SaveDomainCache()
+	h.l.Info("Successfully Resized Volume", zap.String("volume", vol.ID), zap.Int("size", cached.Size))
+	return nil
+}
+
+func (h *NSQHandler) cachedVolume(id string) (message.Volume, error) {
+	vol, ok := h.volumes[id]
+	if !ok {
+		err := fmt.Errorf("unknown volume %s", id)
+		h.l.Error("unable to locate volume", zap.Error(err))
+		return vol, err
+	}
+	return vol, nil
+}
+
+// Attach or Detach a Volume's Device in the Domain Definition, and on the
+// Running Domain if it is Active
+func (h *NSQHandler) modifyVolumeDevice(vol *message.Volume, modify func(libvirt.Domain, string, uint32) error) error {
+	domain, err := h.virt.DomainLookupByName(vol.Domain)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", vol.Domain), zap.Error(err))
+		return err
+	}
+	flags := libvirt.DomainDeviceModifyConfig
+	if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	tune := h.data[vol.Domain].IOTune
+	if err := modify(domain, utils.VolumeXML(vol, &tune), uint32(flags)); err != nil {
+		h.l.Error(
+			"unable to modify volume device",
+			zap.String("volume", vol.ID),
+			zap.String("domain", vol.Domain),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Re-Attach a Volume the Domain Definition Lost, e.g. Because the Domain
+// was Recreated
+func (h *NSQHandler) ensureVolumeAttached(vol *message.Volume) {
+	domain, err := h.virt.DomainLookupByName(vol.Domain)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", vol.Domain), zap.Error(err))
+		return
+	}
+	xml, err := h.virt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		h.l.Error("unable to read domain definition", zap.String("name", vol.Domain), zap.Error(err))
+		return
+	}
+	if !utils.VolumeInXML(xml, vol.ID) {
+		h.l.Info("Re-Attaching Volume", zap.String("volume", vol.ID), zap.String("domain", vol.Domain))
+		h.modifyVolumeDevice(vol, h.virt.DomainAttachDeviceFlags)
+	}
+}
+
+// Add the Guest Agent Channel to a Domain Defined Without it, Live Too if
+// the Domain is Running so the Agent is Reachable Without a Restart
+func (h *NSQHandler) ensureGuestAgent(data *message.VMData) {
+	domain, err := h.virt.DomainLookupByName(data.ID)
+	if err != nil {
+		h.l.Error("unable to locate domain", zap.String("name", data.ID), zap.Error(err))
+		return
+	}
+	xml, err := h.virt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		h.l.Error("unable to read domain definition", zap.String("name", data.ID), zap.Error(err))
+		return
+	}
+	if strings.Contains(xml, utils.GuestAgentChannel) {
+		return
+	}
+	flags := libvirt.DomainDeviceModifyConfig
+	if active, err := h.virt.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	if err := h.virt.DomainAttachDeviceFlags(domain, utils.GuestAgentXML, uint32(flags)); err != nil {
+		h.l.Error("unable to add guest agent channel", zap.String("domain", data.ID), zap.Error(err))
+		return
+	}
+	h.l.Info("Added Guest Agent Channel", zap.String("domain", data.ID))
+}
+
+// Install a Base Image. Only Syncs Wait on Each Other, as Installing Touches
+// Nothing but the Image Directory
+func (h *NSQHandler) syncImage(data *message.ImageData) error {
+	h.imageMutex.Lock()
+	defer h.imageMutex.Unlock()
+	return utils.InstallImage(h.l, h.ex, data)
+}
+
+// Report the Outcome of a Request
+func (h *NSQHandler) publishResult(msg *message.Message, name string, err error) *message.Result {
+	result := newResult(msg, name, err)
+	commons.ProducerSendStruct(result, "aarch64-results", h.p)
+	return &result
+}
+
+// Outcome of a Request, Including the Failed Step if Any
+func newResult(msg *message.Message, name string, err error) message.Result {
+	result := message.Result{
+		ID:      msg.ID,
+		Action:  msg.Action,
+		Host:    commons.GetHostname(),
+		Name:    name,
+		Success: err == nil,
+		// Failures that Sending the Same Message Again Recovers from
+		Retryable: errors.Is(err, utils.ErrDetachTimeout),
+	}
+	if err == nil && msg.Action == message.AddDomain {
+		result.IPv4Address = msg.VMData.IPv4Address
+	}
+	if err == nil && msg.Action == message.QueryGuest {
+		result.Guest = &msg.Guest
+	}
+	if err != nil {
+		result.Error = err.Error()
+		var stepErr *utils.StepError
+		if errors.As(err, &stepErr) {
+			result.Step = stepErr.Step
+			result.Error = stepErr.Err.Error()
+		}
+	}
+	return result
+}
+
+// Publish a Capacity Report Every Interval Until the Context is Done
+func (h *NSQHandler) ReportCapacity(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(h.config.CapacityInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		h.PublishCapacity()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Report Node Resources from Libvirt, What Domains Already Use, Free VM
+// Storage and Available Base Images so the API can Place Domains
+func (h *NSQHandler) PublishCapacity() error {
+	cfg := h.config
+	hostname := commons.GetHostname()
+	pop, index, err := commons.SplitHostname(hostname)
+	if err != nil {
+		h.l.Error("unable to determine pop and host index", zap.Error(err))
+		return nil
+	}
+	_, memory, cpus, _, _, _, _, _, err := h.virt.NodeGetInfo()
+	if err != nil {
+		h.l.Error("unable to get node info", zap.Error(err))
+		return nil
+	}
+	domains, _, err := h.virt.ConnectListAllDomains(1, 0)
+	if err != nil {
+		h.l.Error("unable to list domains", zap.Error(err))
+		return nil
+	}
+	var allocatedVcpus, allocatedMemory int64
+	for _, domain := range domains {
+		_, maxMemory, _, vcpus, _, err := h.virt.DomainGetInfo(domain)
+		if err != nil {
+			h.l.Error("unable to get domain info", zap.String("domain", domain.Name), zap.Error(err))
+			continue
+		}
+		allocatedVcpus += int64(vcpus)
+		allocatedMemory += int64(maxMemory / 1024)
+	}
+	diskFree, diskTotal, err := utils.DiskUsage(cfg.VMPath)
+	if err != nil {
+		h.l.Error("unable to get vm storage usage", zap.String("path", cfg.VMPath), zap.Error(err))
+		return nil
+	}
+	images, err := utils.ImageInventory()
+	if err != nil {
+		h.l.Error("unable to list base images", zap.Error(err))
+	}
+	msg := message.Message{
+		ID:     int64(h.sfn.Generate()),
+		Action: message.CapacityReport,
+		Capacity: message.Capacity{
+			Host:             hostname,
+			Pop:              pop,
+			Index:            index,
+			Disabled:         cfg.Disabled,
+			Domains:          len(domains),
+			Vcpus:            utils.NewResource(int64(cpus), cfg.CPUOvercommit, allocatedVcpus),
+			Memory:           utils.NewResource(int64(memory/1024), cfg.MemoryOvercommit, allocatedMemory),
+			CPUOvercommit:    cfg.CPUOvercommit,
+			MemoryOvercommit: cfg.MemoryOvercommit,
+			DiskFree:         diskFree,
+			DiskTotal:        diskTotal,
+			Images:           images,
+			Updated:          time.Now().Unix(),
+		},
+	}
+	commons.ProducerSendStruct(msg, "aarch64-capacity", h.p)
+	return nil
+}
+
 func (h *NSQHandler) changeDomainState(data *message.MessageData) error {
+	// A Rescued Domain's Disk is Attached to its Rescue Domain, so Booting
+	// or Resetting the Domain Itself would Use the Disk Twice
+	if cached, ok := h.data[data.Name]; ok && cached.Rescued {
+		err := fmt.Errorf("domain %s is in rescue, exit rescue first", data.Name)
+		h.l.Error("unable to change domain state", zap.Int64("event", int64(data.Event)), zap.Error(err))
+		return err
+	}
 	// Locate Domain for Operations
 	var domain libvirt.Domain
 	if data.Name != "" {
@@ -209,7 +1681,7 @@ func (h *NSQHandler) changeDomainState(data *message.MessageData) error {
 	// Handle Domain State Changes
 	switch data.Event {
 	case message.StateShutdown:
-		h.virt.DomainShutdown(domain)
+		go h.shutdownDomain(domain)
 	case message.StateReboot:
 		h.virt.DomainReboot(domain, libvirt.DomainRebootDefault)
 	case message.StateReset:
@@ -229,17 +1701,44 @@ func main() {
 
 	// Flag Variables
 	var (
+		configPath      string
 		nsqConnectURI   string
 		domainCachePath string
+		osProfilePath   string
 	)
 
-	// Parse Flags
-	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", commons.NSQCoreUrl, "The URI for NSQ producers & consumers to connect to")
-	flag.StringVar(&domainCachePath, "domain-cache-path", commons.DomainCachePath, "The path to the domain cache file")
+	// Parse Flags, Set Flags Override the Config File
+	flag.StringVar(&configPath, "config", commons.ConfigPath, "The path to the daemon configuration file")
+	flag.StringVar(&nsqConnectURI, "nsq-connect-uri", "", "The URI for NSQ producers & consumers to connect to")
+	flag.StringVar(&domainCachePath, "domain-cache-path", "", "The path to the domain cache file")
+	flag.StringVar(&osProfilePath, "os-profile-path", "", "The directory holding os provisioning profiles")
 	flag.Parse()
 
+	// Load Configuration
+	cfg, err := commons.LoadConfig(configPath)
+	if err != nil {
+		l.Fatal("unable to load configuration", zap.Error(err))
+	}
+	if nsqConnectURI != "" {
+		cfg.NSQ.URI = nsqConnectURI
+	}
+	if domainCachePath != "" {
+		cfg.Hydrogen.DomainCachePath = domainCachePath
+	}
+	if osProfilePath != "" {
+		cfg.Hydrogen.OSProfilePath = osProfilePath
+	}
+	if err = cfg.Validate(); err == nil {
+		err = cfg.Hydrogen.Validate()
+	}
+	if err != nil {
+		l.Fatal("invalid configuration", zap.Error(err))
+	}
+	l.Info("Effective Configuration\n" + cfg.String())
+	utils.Configure(cfg.Hydrogen)
+
 	// Connect to LibVirt
-	lvc, err := net.DialTimeout("unix", "/var/run/libvirt/libvirt-sock", 2*time.Second)
+	lvc, err := net.DialTimeout("unix", cfg.Hydrogen.LibvirtSocket, 2*time.Second)
 	if err != nil {
 		l.Fatal("unable to connect to libvirt socket", zap.Error(err))
 	}
@@ -249,21 +1748,29 @@ func main() {
 	}
 	l.Info("Successfully Connected to LibVirt")
 
+	// Load OS Provisioning Profiles
+	profiles, err := utils.LoadProfiles(l, cfg.Hydrogen.OSProfilePath)
+	if err != nil {
+		l.Fatal("unable to load os profiles", zap.Error(err))
+	}
+
 	// Create Snowflake Node
-	sfNode := commons.GetSnow()
+	sfNode := commons.GetSnow(cfg.MachineIDPath)
 
 	// Connect to NSQ
 	hostname := commons.GetHostname()
 	if hostname == "" {
 		l.Fatal("failed to read hostname")
 	}
-	nsqProducer, err := nsq.NewProducer(nsqConnectURI, nsq.NewConfig())
+	nsqProducer, err := nsq.NewProducer(cfg.NSQ.URI, nsq.NewConfig())
 	if err != nil {
 		l.Fatal("unable to connect to NSQ", zap.Error(err))
 	}
-	nh := NewNSQHandler(l, nsqProducer, lv, sfNode, domainCachePath)
-	nh.LoadDomainCache()
-	nsqConsumer := commons.CreateNSQConsumer(nsqConnectURI, "aarch64-libvirt-"+hostname, "main", nh)
+	nh := NewNSQHandler(l, nsqProducer, lv, executor.New(), sfNode, profiles, cfg.Hydrogen)
+	if err := nh.LoadDomainCache(); err != nil {
+		l.Fatal("refusing to start without a valid domain cache", zap.Error(err))
+	}
+	nsqConsumer := commons.CreateNSQConsumer(cfg.NSQ.URI, "aarch64-libvirt-"+hostname, "main", nh)
 	l.Info(
 		"Successfully Connected to NSQ",
 		zap.String("topic", "aarch64-libvirt-"+hostname),
@@ -271,9 +1778,14 @@ func main() {
 	)
 	defer nsqConsumer.Stop()
 
+	// Serve hydrogenctl
+	go nh.ServeAdmin(cfg.Hydrogen.ControlSocket, nsqConsumer, "aarch64-libvirt-"+hostname, "main")
+	defer os.Remove(cfg.Hydrogen.ControlSocket)
+
 	// Start Domain Monitor
 	ctx := context.Background()
 	go nh.MonitorDomainStatus(ctx)
+	go nh.ReportCapacity(ctx)
 	defer ctx.Done()
 
 	l.Info("Hydrogen has Started!!!")
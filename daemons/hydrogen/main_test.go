@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/fosshostorg/aarch64/daemons/hydrogen/utils"
+	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func TestDomainCacheMigrations(t *testing.T) {
+	tests := map[string]string{
+		"unversioned": `{"vm1": {"_id": "vm1", "os": "debian"}}`,
+		"version 1":   `{"version": 1, "data": {"vm1": {"_id": "vm1", "os": "debian"}}}`,
+		"version 2":   `{"version": 2, "data": {"domains": {"vm1": {"_id": "vm1", "os": "debian", "password": 1234}}, "volumes": {}}}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hydrogen.json")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var cache domainCache
+			found, err := commons.NewStore(path, domainCacheVersion, domainCacheMigrations).Load(&cache)
+			if err != nil || !found {
+				t.Fatalf("Load = %v, %v", found, err)
+			}
+			if vm := cache.Domains["vm1"]; vm.Os != "debian" || vm.Password != "" || cache.Volumes == nil || len(cache.Volumes) != 0 {
+				t.Errorf("migrated cache = %+v", cache)
+			}
+		})
+	}
+}
+
+func TestGuestInfo(t *testing.T) {
+	params := []libvirt.TypedParam{
+		{Field: "hostname", Value: *libvirt.NewTypedParamValueString("debian-box")},
+		{Field: "os.id", Value: *libvirt.NewTypedParamValueString("debian")},
+		{Field: "os.pretty-name", Value: *libvirt.NewTypedParamValueString("Debian GNU/Linux 11 (bullseye)")},
+		{Field: "os.kernel-release", Value: *libvirt.NewTypedParamValueString("5.10.0-8-arm64")},
+	}
+	ifaces := []libvirt.DomainInterface{
+		{Name: "lo", Hwaddr: libvirt.OptString{"00:00:00:00:00:00"}, Addrs: []libvirt.DomainIPAddr{
+			{Type: 0, Addr: "127.0.0.1", Prefix: 8},
+			{Type: 1, Addr: "::1", Prefix: 128},
+		}},
+		{Name: "eth0", Hwaddr: libvirt.OptString{"52:54:00:00:00:04"}, Addrs: []libvirt.DomainIPAddr{
+			{Type: 1, Addr: "2001:db8:0:4::2", Prefix: 64},
+			{Type: 1, Addr: "fe80::5054:ff:fe00:4", Prefix: 64},
+		}},
+	}
+	want := message.GuestInfo{
+		OS:       "Debian GNU/Linux 11 (bullseye)",
+		Kernel:   "5.10.0-8-arm64",
+		Hostname: "debian-box",
+		Interfaces: []message.GuestInterface{{
+			Name:      "eth0",
+			MAC:       "52:54:00:00:00:04",
+			Addresses: []string{"2001:db8:0:4::2/64", "fe80::5054:ff:fe00:4/64"},
+		}},
+	}
+	if got := guestInfo(params, ifaces); !reflect.DeepEqual(got, want) {
+		t.Errorf("guestInfo = %+v, want %+v", got, want)
+	}
+}
+
+func testHandler(t *testing.T, ex executor.Executor) *NSQHandler {
+	t.Helper()
+	cfg := commons.DefaultConfig().Hydrogen
+	dir := t.TempDir()
+	cfg.TempPath = dir
+	cfg.VMPath = dir
+	cfg.DomainCachePath = filepath.Join(dir, "hydrogen.json")
+	cfg.NetworkCachePath = filepath.Join(dir, "hydrogen-networks.json")
+	cfg.RAInterval = 0
+	utils.Configure(cfg)
+	t.Cleanup(func() { utils.Configure(commons.DefaultConfig().Hydrogen) })
+	return NewNSQHandler(zap.NewNop(), nil, &fakeVirt{
+		metadata:   map[string]string{},
+		stopped:    map[string]bool{},
+		live:       map[string]string{},
+		persistent: map[string]string{},
+		unplugging: map[string]int{},
+	}, ex, nil, nil, cfg)
+}
+
+// libvirt Stand-In Recording Domain Metadata. Calls a Test does Not Expect
+// Panic on the Nil Embedded Virt
+type fakeVirt struct {
+	Virt
+	metadata map[string]string
+	stopped  map[string]bool
+	// Live and Persistent Domain XML, by Name
+	live       map[string]string
+	persistent map[string]string
+	// Live Reads a Guest Takes to Release a Detached Disk, Negative for Never
+	releaseAfter int
+	unplugging   map[string]int
+}
+
+// Every Domain with a Definition or Metadata, by Name
+func (f *fakeVirt) ConnectListAllDomains(_ int32, _ libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error) {
+	names := map[string]bool{}
+	for name := range f.metadata {
+		names[name] = true
+	}
+	for name := range f.persistent {
+		names[name] = true
+	}
+	var domains []libvirt.Domain
+	for name := range names {
+		domains = append(domains, libvirt.Domain{Name: name})
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return domains, uint32(len(domains)), nil
+}
+
+func (f *fakeVirt) DomainGetMetadata(dom libvirt.Domain, _ int32, _ libvirt.OptString, _ libvirt.DomainModificationImpact) (string, error) {
+	metadata, ok := f.metadata[dom.Name]
+	if !ok {
+		return "", errors.New("metadata not found: Requested metadata element is not present")
+	}
+	return metadata, nil
+}
+
+func (f *fakeVirt) DomainLookupByName(name string) (libvirt.Domain, error) {
+	return libvirt.Domain{Name: name}, nil
+}
+
+func (f *fakeVirt) DomainIsActive(dom libvirt.Domain) (int32, error) {
+	if f.stopped[dom.Name] {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func (f *fakeVirt) DomainGetXMLDesc(dom libvirt.Domain, flags libvirt.DomainXMLFlags) (string, error) {
+	if flags&libvirt.DomainXMLInactive != 0 {
+		return f.persistent[dom.Name], nil
+	}
+	if reads, ok := f.unplugging[dom.Name]; ok && f.releaseAfter >= 0 {
+		if reads >= f.releaseAfter {
+			f.live[dom.Name] = ""
+		}
+		f.unplugging[dom.Name] = reads + 1
+	}
+	return f.live[dom.Name], nil
+}
+
+func (f *fakeVirt) DomainCreate(dom libvirt.Domain) error {
+	delete(f.stopped, dom.Name)
+	return nil
+}
+
+// Devices are Appended to the Definitions the Flags Name
+func (f *fakeVirt) DomainAttachDeviceFlags(dom libvirt.Domain, xml string, flags uint32) error {
+	if flags&uint32(libvirt.DomainDeviceModifyConfig) != 0 {
+		f.persistent[dom.Name] += xml
+	}
+	if flags&uint32(libvirt.DomainDeviceModifyLive) != 0 {
+		f.live[dom.Name] += xml
+	}
+	return nil
+}
+
+// Config Removals Take Effect Straight Away, Live Ones Once the Guest Lets go
+func (f *fakeVirt) DomainDetachDeviceFlags(dom libvirt.Domain, _ string, flags uint32) error {
+	if flags&uint32(libvirt.DomainDeviceModifyConfig) != 0 {
+		f.persistent[dom.Name] = ""
+	}
+	if flags&uint32(libvirt.DomainDeviceModifyLive) != 0 {
+		if _, ok := f.unplugging[dom.Name]; ok {
+			return errors.New("operation failed: device removal already in progress")
+		}
+		f.unplugging[dom.Name] = 0
+	}
+	return nil
+}
+
+func (f *fakeVirt) DomainSetMetadata(dom libvirt.Domain, _ int32, metadata libvirt.OptString, _ libvirt.OptString, _ libvirt.OptString, _ libvirt.DomainModificationImpact) error {
+	f.metadata[dom.Name] = metadata[0]
+	return nil
+}
+
+func TestBridgeStepOnlyRemovesCreatedBridges(t *testing.T) {
+	data := &message.VMData{ID: "vm1", Index: 4, Prefix: "2001:db8:0:4::/64", Gateway: "2001:db8:0:4::1", Address: "2001:db8:0:4::2/64", MAC: "52:54:00:00:00:04"}
+	failed := utils.Step{Name: "domain", Do: func() error { return errors.New("exit status 1") }}
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{"existing bridge is kept", true},
+		{"new bridge is removed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := executor.NewFake()
+			h := testHandler(t, fake)
+			spoofPath := filepath.Join(h.config.TempPath, "vm1-spoof.nft")
+			if tt.exists {
+				fake.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST,UP> mtu 1500", nil)
+			} else {
+				fake.Expect("ip link show dev vbr4", `Device "vbr4" does not exist.`, errors.New("exit status 1"))
+				fake.Expect("ip link add vbr4 type bridge", "", nil)
+				fake.Expect("ip addr add dev vbr4 2001:db8:0:4::1/64", "", nil)
+			}
+			fake.Expect("ip link set dev vbr4 up", "", nil)
+			fake.Expect("nft list chain bridge hydrogen spoof4", "", errors.New("exit status 1"))
+			fake.Expect("nft -f "+spoofPath, "", nil)
+			if !tt.exists {
+				fake.Expect("nft -f "+spoofPath, "", nil)
+				fake.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST,UP> mtu 1500", nil)
+				fake.Expect("ip link del vbr4", "", nil)
+			}
+
+			if err := utils.RunSteps(zap.NewNop(), []utils.Step{h.bridgeStep("bridge", data), failed}); err == nil {
+				t.Fatal("RunSteps succeeded with a failing step")
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// A Re-Sent add_domain Reuses the Address Mapped in tayga.conf Even when the
+// Cache Lost it, and New Domains Skip Mapped Addresses
+func TestAssignIPv4ReusesTaygaMapping(t *testing.T) {
+	h := testHandler(t, executor.NewFake())
+	h.config.IPv4Pool = []string{"192.0.2.10/31"}
+	conf := "tun-device nat64\n# BEGIN hydrogen managed maps\nmap 192.0.2.10 2001:db8:0:4::2\n# END hydrogen managed maps\n"
+	taygaPath := filepath.Join(h.config.TempPath, "tayga.conf")
+	if err := os.WriteFile(taygaPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := h.config
+	cfg.TaygaConfigPath = taygaPath
+	utils.Configure(cfg)
+
+	resent := &message.VMData{ID: "vm1", IPv4: true, Address: "2001:db8:0:4::2/64"}
+	if err := h.assignIPv4(resent); err != nil || resent.IPv4Address != "192.0.2.10" {
+		t.Errorf("re-sent domain got %q, %v, want 192.0.2.10", resent.IPv4Address, err)
+	}
+	fresh := &message.VMData{ID: "vm2", IPv4: true, Address: "2001:db8:0:5::2/64"}
+	if err := h.assignIPv4(fresh); err != nil || fresh.IPv4Address != "192.0.2.11" {
+		t.Errorf("new domain got %q, %v, want 192.0.2.11", fresh.IPv4Address, err)
+	}
+}
+
+// A Hot Plugged Interface is Marked as Such and Covered by the Firewall
+func TestAttachInterfaceAppliesFirewall(t *testing.T) {
+	fake := executor.NewFake()
+	h := testHandler(t, fake)
+	h.data["vm1"] = message.VMData{
+		ID: "vm1", Index: 4, Prefix: "2001:db8:0:4::/64", Gateway: "2001:db8:0:4::1", Address: "2001:db8:0:4::2/64", MAC: "52:54:00:00:00:04",
+		Firewall: message.Firewall{Policy: "drop"},
+	}
+	iface := message.Interface{Index: 9, Prefix: "2001:db8:0:9::/64", Gateway: "2001:db8:0:9::1", Address: "2001:db8:0:9::2/64"}
+	fake.Expect("ip link show dev vbr9", `Device "vbr9" does not exist.`, errors.New("exit status 1"))
+	fake.Expect("ip link add vbr9 type bridge", "", nil)
+	fake.Expect("ip addr add dev vbr9 2001:db8:0:9::1/64", "", nil)
+	fake.Expect("ip link set dev vbr9 up", "", nil)
+	fake.Expect("nft list chain bridge hydrogen spoof9", "", errors.New("exit status 1"))
+	fake.Expect("nft -f "+filepath.Join(h.config.TempPath, "vm1-spoof.nft"), "", nil)
+	fake.Expect("nft -f "+filepath.Join(h.config.TempPath, "vm1-firewall.nft"), "", nil)
+	fake.Expect("virsh attach-interface vm1 bridge vbr9 --model virtio --mac 52:54:00:00:00:09 --persistent", "Interface attached successfully", nil)
+
+	if err := h.attachInterface(&message.VMData{ID: "vm1", Interfaces: []message.Interface{iface}}); err != nil {
+		t.Fatalf("attachInterface: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if interfaces := h.data["vm1"].Interfaces; len(interfaces) != 1 || !interfaces[0].Hotplugged {
+		t.Errorf("cached interfaces = %+v, want the hot plugged interface", interfaces)
+	}
+	if metadata := h.virt.(*fakeVirt).metadata["vm1"]; !strings.Contains(metadata, `hotplugged="true"`) {
+		t.Errorf("metadata does not record the hot plugged interface:\n%s", metadata)
+	}
+}
+
+// Running Domains Cannot Join a Network, Stopped Ones Get the NIC Added to
+// their Definition
+func TestAttachInterfaceRollsBackBandwidth(t *testing.T) {
+	fake := executor.NewFake()
+	h := testHandler(t, fake)
+	h.data["vm1"] = message.VMData{
+		ID: "vm1", Index: 4, MAC: "52:54:00:00:00:04",
+		Bandwidth: message.Bandwidth{Inbound: 100},
+	}
+	iface := message.Interface{Index: 9, Prefix: "2001:db8:0:9::/64", Gateway: "2001:db8:0:9::1", Address: "2001:db8:0:9::2/64"}
+	// The Bridge Already Exists, so Rolling Back Keeps it
+	fake.Expect("ip link show dev vbr9", "7: vbr9: <BROADCAST,MULTICAST,UP> mtu 1500", nil)
+	fake.Expect("ip link set dev vbr9 up", "", nil)
+	fake.Expect("nft list chain bridge hydrogen spoof9", "", errors.New("exit status 1"))
+	fake.Expect("nft -f "+filepath.Join(h.config.TempPath, "vm1-spoof.nft"), "", nil)
+	fake.Expect("tc qdisc del dev vbr9 clsact", "", errors.New("exit status 2"))
+	fake.Expect("tc qdisc add dev vbr9 clsact", "", nil)
+	fake.Expect("tc filter add dev vbr9 egress matchall action police rate 100mbit burst 125000 conform-exceed drop/pipe", "", nil)
+	fake.Expect("virsh attach-interface vm1 bridge vbr9 --model virtio --mac 52:54:00:00:00:09 --persistent", "error: failed to attach", errors.New("exit status 1"))
+	fake.Expect("tc qdisc del dev vbr9 clsact", "", nil)
+
+	if err := h.attachInterface(&message.VMData{ID: "vm1", Interfaces: []message.Interface{iface}}); err == nil {
+		t.Fatal("attachInterface succeeded with a failing attach")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttachInterfaceRejectsForeignBridge(t *testing.T) {
+	fake := executor.NewFake()
+	h := testHandler(t, fake)
+	h.data["vm1"] = message.VMData{ID: "vm1", Index: 4, MAC: "52:54:00:00:00:04"}
+	h.data["vm2"] = message.VMData{
+		ID: "vm2", Index: 5, MAC: "52:54:00:00:00:05",
+		Interfaces: []message.Interface{{Index: 9, MAC: "52:54:00:00:00:09"}},
+	}
+	for _, index := range []int{5, 9} {
+		iface := message.Interface{Index: index, Prefix: "2001:db8:0:9::/64", Gateway: "2001:db8:0:9::1", Address: "2001:db8:0:9::2/64"}
+		err := h.attachInterface(&message.VMData{ID: "vm1", Interfaces: []message.Interface{iface}})
+		if err == nil || !strings.Contains(err.Error(), "vm2") {
+			t.Errorf("attachInterface on vbr%d of vm2 error = %v, want it refused", index, err)
+		}
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if len(h.data["vm1"].Interfaces) != 0 {
+		t.Error("interface on a foreign bridge was recorded")
+	}
+}
+
+func TestJoinNetworkRejectsRunningDomains(t *testing.T) {
+	fake := executor.NewFake()
+	h := testHandler(t, fake)
+	h.networks[1001] = message.Network{VNI: 1001, Project: "p1", Prefix: "fd00:1001::/64"}
+	h.data["vm1"] = message.VMData{ID: "vm1", Project: "p1", Index: 4}
+	join := &message.VMData{ID: "vm1", Networks: []message.NetworkMember{{VNI: 1001, Address: "fd00:1001::4/64"}}}
+
+	if err := h.joinNetwork(join); err == nil || !strings.Contains(err.Error(), "running") {
+		t.Errorf("joinNetwork of a running domain error = %v, want it refused", err)
+	}
+	if len(h.data["vm1"].Networks) != 0 {
+		t.Error("running domain was recorded as a member")
+	}
+
+	h.virt.(*fakeVirt).stopped["vm1"] = true
+	fake.Expect("virsh attach-interface vm1 bridge pbr1001 --model virtio --mac 52:55:00:00:00:04 --persistent", "Interface attached successfully", nil)
+	if err := h.joinNetwork(join); err != nil {
+		t.Fatalf("joinNetwork of a stopped domain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if networks := h.data["vm1"].Networks; len(networks) != 1 || networks[0].VNI != 1001 {
+		t.Errorf("cached networks = %+v", networks)
+	}
+}
+
+func TestChangeStateRejectsRescuedDomains(t *testing.T) {
+	h := testHandler(t, executor.NewFake())
+	h.data["vm1"] = message.VMData{ID: "vm1", Rescued: true}
+	h.virt.(*fakeVirt).stopped["vm1"] = true
+	startup := &message.MessageData{Name: "vm1", Event: message.StateStartup}
+
+	if err := h.changeDomainState(startup); err == nil || !strings.Contains(err.Error(), "rescue") {
+		t.Errorf("changeDomainState of a rescued domain error = %v, want it refused", err)
+	}
+	if !h.virt.(*fakeVirt).stopped["vm1"] {
+		t.Error("rescued domain was started")
+	}
+
+	h.data["vm1"] = message.VMData{ID: "vm1"}
+	if err := h.changeDomainState(startup); err != nil {
+		t.Fatalf("changeDomainState: %v", err)
+	}
+	if h.virt.(*fakeVirt).stopped["vm1"] {
+		t.Error("domain was not started")
+	}
+}
+
+func TestDetachVolumeWaitsForGuest(t *testing.T) {
+	oldInterval := detachPollInterval
+	detachPollInterval = time.Millisecond
+	t.Cleanup(func() { detachPollInterval = oldInterval })
+	tests := []struct {
+		name         string
+		releaseAfter int
+		wantErr      error
+	}{
+		{"released", 2, nil},
+		{"held by the guest", -1, utils.ErrDetachTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHandler(t, executor.NewFake())
+			h.config.VolumeDetachTimeout = 1
+			virt := h.virt.(*fakeVirt)
+			virt.releaseAfter = tt.releaseAfter
+			vol := message.Volume{ID: "vol1", Domain: "vm1", Target: "vdb", Size: 10}
+			h.volumes["vol1"] = vol
+			disk := utils.VolumeXML(&vol, &message.IOTune{})
+			virt.live["vm1"], virt.persistent["vm1"] = disk, disk
+
+			err := h.detachVolume(&message.Volume{ID: "vol1"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("detachVolume error = %v, want %v", err, tt.wantErr)
+			}
+			if virt.persistent["vm1"] != "" {
+				t.Error("disk left in the persistent definition")
+			}
+			if detached := h.volumes["vol1"].Domain == ""; detached != (tt.wantErr == nil) {
+				t.Errorf("volume detached = %v while the live definition holds %q", detached, virt.live["vm1"])
+			}
+			if result := newResult(&message.Message{Action: message.DetachVolume}, "vol1", err); result.Retryable != (tt.wantErr != nil) {
+				t.Errorf("result retryable = %v", result.Retryable)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			// Once the Guest Lets go, Sending the Request Again Finishes it
+			virt.releaseAfter = 0
+			if err := h.detachVolume(&message.Volume{ID: "vol1"}); err != nil || h.volumes["vol1"].Domain != "" {
+				t.Errorf("retried detachVolume = %v, volume %+v", err, h.volumes["vol1"])
+			}
+		})
+	}
+}
+
+func TestRecoverDomains(t *testing.T) {
+	fake := executor.NewFake()
+	h := testHandler(t, fake)
+	virt := h.virt.(*fakeVirt)
+	data := message.VMData{
+		ID: "vm1", Project: "p1", Os: "debian", Hostname: "debian-box",
+		Index: 4, Prefix: "2001:db8:0:4::/64", MAC: "52:54:00:00:00:04",
+		Firewall: message.Firewall{Policy: "drop", Rules: []message.FirewallRule{
+			{Action: "accept", Protocol: "tcp", Ports: []string{"22"}},
+		}},
+	}
+	if err := h.writeMetadata(&data); err != nil {
+		t.Fatal(err)
+	}
+	attached := message.Volume{ID: "vol1", Target: "vdc"}
+	virt.persistent["vm1"] = "<domain><name>vm1</name><devices>" +
+		"<disk type='file' device='disk'><source file='" + filepath.Join(h.config.VMPath, "vm1.qcow2") + "'/><target dev='vda' bus='virtio'/></disk>" +
+		utils.VolumeXML(&attached, &message.IOTune{}) +
+		"</devices></domain>"
+	// Rescue Domains Carry No Metadata and are Skipped
+	virt.persistent["vm1-rescue"] = "<domain><name>vm1-rescue</name></domain>"
+	for _, id := range []string{"vol1", "vol2"} {
+		if err := os.WriteFile(utils.VolumePath(id), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.Expect("qemu-img info -U --output=json "+utils.VolumePath("vol1"), `{"virtual-size": 10737418240}`, nil)
+
+	recovered, err := h.recoverDomains()
+	if err != nil {
+		t.Fatalf("recoverDomains: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if len(recovered.Domains) != 1 || !reflect.DeepEqual(recovered.Domains["vm1"].Firewall, data.Firewall) {
+		t.Errorf("recovered domains = %+v", recovered.Domains)
+	}
+	want := map[string]message.Volume{"vol1": {ID: "vol1", Project: "p1", Size: 10, Domain: "vm1", Target: "vdc"}}
+	if !reflect.DeepEqual(recovered.Volumes, want) {
+		t.Errorf("recovered volumes = %+v, want %+v", recovered.Volumes, want)
+	}
+}
+
+func TestEnsureGuestAgent(t *testing.T) {
+	h := testHandler(t, executor.NewFake())
+	virt := h.virt.(*fakeVirt)
+	virt.stopped["stopped"] = true
+	virt.persistent["current"] = "<domain>" + utils.GuestAgentXML + "</domain>"
+	for _, id := range []string{"running", "stopped", "current"} {
+		h.ensureGuestAgent(&message.VMData{ID: id})
+	}
+
+	for id, want := range map[string]int{"running": 1, "stopped": 1, "current": 1} {
+		if got := strings.Count(virt.persistent[id], utils.GuestAgentChannel); got != want {
+			t.Errorf("%s definition has %d guest agent channels, want %d", id, got, want)
+		}
+	}
+	if !strings.Contains(virt.live["running"], utils.GuestAgentChannel) {
+		t.Error("running domain did not gain the channel live")
+	}
+	if virt.live["stopped"] != "" || virt.live["current"] != "" {
+		t.Error("channel hot plugged into a domain that did not need it live")
+	}
+}
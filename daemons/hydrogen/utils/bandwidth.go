@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Check Bandwidth Limits Without Applying them
+func ValidateBandwidth(bw *message.Bandwidth) error {
+	if bw.Inbound < 0 || bw.Outbound < 0 || bw.PacketRate < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	return nil
+}
+
+// tc Actions Policing a Direction to a Rate in Mbit/s and a Packet Rate.
+// Traffic Within the Rate is Passed on to the Packet Rate Policer
+func policeActions(mbit int, pps int) []string {
+	actions := []string{}
+	if mbit > 0 {
+		// Allow Bursts of 10ms Worth of Traffic, but at Least 64KiB
+		burst := mbit * 1000000 / 8 / 100
+		if burst < 65536 {
+			burst = 65536
+		}
+		actions = append(actions,
+			"action", "police", "rate", strconv.Itoa(mbit)+"mbit", "burst", strconv.Itoa(burst),
+			"conform-exceed", "drop/pipe",
+		)
+	}
+	if pps > 0 {
+		burst := pps / 10
+		if burst < 10 {
+			burst = 10
+		}
+		actions = append(actions,
+			"action", "police", "pkt_rate", strconv.Itoa(pps), "pkt_burst", strconv.Itoa(burst),
+			"conform-exceed", "drop/pipe",
+		)
+	}
+	return actions
+}
+
+// Police the VM's Traffic on the Bridge of Each of its Interfaces, Each
+// Getting the Full Limits. Everything Towards the VM is Routed out of a
+// Bridge and Everything From it Enters the Host Through the Bridge, so Egress
+// is the VM's Inbound and Ingress its Outbound Traffic. Existing Limits are
+// Replaced, and Zero Limits Remove them
+func ApplyBandwidth(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if err := ValidateBandwidth(&data.Bandwidth); err != nil {
+		l.Error("invalid bandwidth limits", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	// Removing the clsact Qdisc Drops its Filters, it may Not Exist Yet
+	RemoveBandwidth(ex, data)
+	bw := data.Bandwidth
+	if bw.Inbound == 0 && bw.Outbound == 0 && bw.PacketRate == 0 {
+		return nil
+	}
+	for _, iface := range Interfaces(data) {
+		bridgeNet := fmt.Sprintf("vbr%d", iface.Index)
+		commands := [][]string{{"qdisc", "add", "dev", bridgeNet, "clsact"}}
+		if actions := policeActions(bw.Outbound, bw.PacketRate); len(actions) > 0 {
+			commands = append(commands, append([]string{"filter", "add", "dev", bridgeNet, "ingress", "matchall"}, actions...))
+		}
+		if actions := policeActions(bw.Inbound, bw.PacketRate); len(actions) > 0 {
+			commands = append(commands, append([]string{"filter", "add", "dev", bridgeNet, "egress", "matchall"}, actions...))
+		}
+		for _, args := range commands {
+			if output, err := ex.CombinedOutput("tc", args...); err != nil {
+				l.Error(
+					"unable to apply bandwidth limits",
+					zap.String("command", executor.CommandLine("tc", args...)),
+					zap.ByteString("output", output),
+					zap.Error(err),
+				)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove the VM's Limits, Ignoring Bridges Without any
+func RemoveBandwidth(ex executor.Executor, data *message.VMData) {
+	for _, iface := range Interfaces(data) {
+		ex.CombinedOutput("tc", "qdisc", "del", "dev", fmt.Sprintf("vbr%d", iface.Index), "clsact")
+	}
+}
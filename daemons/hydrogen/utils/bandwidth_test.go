@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func TestApplyBandwidth(t *testing.T) {
+	tests := []struct {
+		name      string
+		bandwidth message.Bandwidth
+		expect    []string
+	}{
+		{"unlimited", message.Bandwidth{}, nil},
+		{
+			"inbound and outbound",
+			message.Bandwidth{Inbound: 1000, Outbound: 100},
+			[]string{
+				"tc qdisc add dev vbr4 clsact",
+				"tc filter add dev vbr4 ingress matchall action police rate 100mbit burst 125000 conform-exceed drop/pipe",
+				"tc filter add dev vbr4 egress matchall action police rate 1000mbit burst 1250000 conform-exceed drop/pipe",
+			},
+		},
+		{
+			"outbound with packet rate",
+			message.Bandwidth{Outbound: 1, PacketRate: 50},
+			[]string{
+				"tc qdisc add dev vbr4 clsact",
+				"tc filter add dev vbr4 ingress matchall action police rate 1mbit burst 65536 conform-exceed drop/pipe action police pkt_rate 50 pkt_burst 10 conform-exceed drop/pipe",
+				"tc filter add dev vbr4 egress matchall action police pkt_rate 50 pkt_burst 10 conform-exceed drop/pipe",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := debianVM()
+			data.Bandwidth = tt.bandwidth
+			fake := executor.NewFake().Expect("tc qdisc del dev vbr4 clsact", "Error: Cannot find specified qdisc on specified device.", errors.New("exit status 2"))
+			for _, command := range tt.expect {
+				fake.Expect(command, "", nil)
+			}
+			if err := ApplyBandwidth(zap.NewNop(), fake, data); err != nil {
+				t.Fatalf("ApplyBandwidth: %v", err)
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Each Interface's Bridge is Limited on its Own
+func TestApplyBandwidthInterfaces(t *testing.T) {
+	data := multihomedVM()
+	data.Bandwidth = message.Bandwidth{Inbound: 10}
+	fake := executor.NewFake()
+	for _, bridge := range []string{"vbr4", "vbr9"} {
+		fake.Expect("tc qdisc del dev "+bridge+" clsact", "", nil)
+	}
+	for _, bridge := range []string{"vbr4", "vbr9"} {
+		fake.Expect("tc qdisc add dev "+bridge+" clsact", "", nil)
+		fake.Expect("tc filter add dev "+bridge+" egress matchall action police rate 10mbit burst 65536 conform-exceed drop/pipe", "", nil)
+	}
+	if err := ApplyBandwidth(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("ApplyBandwidth: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyBandwidthFailure(t *testing.T) {
+	data := debianVM()
+	data.Bandwidth = message.Bandwidth{Inbound: 10}
+	fake := executor.NewFake().
+		Expect("tc qdisc del dev vbr4 clsact", "", nil).
+		Expect("tc qdisc add dev vbr4 clsact", "Error: Exclusivity flag on, cannot modify.", errors.New("exit status 2"))
+	if err := ApplyBandwidth(zap.NewNop(), fake, data); err == nil {
+		t.Error("ApplyBandwidth succeeded although tc failed")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	data.Bandwidth = message.Bandwidth{Outbound: -1}
+	if err := ApplyBandwidth(zap.NewNop(), executor.NewFake(), data); err == nil {
+		t.Error("ApplyBandwidth accepted a negative limit")
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"math"
+	"syscall"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+// Scale a Physical Resource by its Overcommit Ratio and Subtract what is
+// Already Allocated to Domains
+func NewResource(physical int64, overcommit float64, allocated int64) message.Resource {
+	total := int64(math.Floor(float64(physical) * overcommit))
+	free := total - allocated
+	if free < 0 {
+		free = 0
+	}
+	return message.Resource{
+		Physical:  physical,
+		Total:     total,
+		Allocated: allocated,
+		Free:      free,
+	}
+}
+
+// Bytes Available to Hydrogen and Total Bytes on the Filesystem at Path
+func DiskUsage(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func TestNewResource(t *testing.T) {
+	tests := []struct {
+		name       string
+		physical   int64
+		overcommit float64
+		allocated  int64
+		want       message.Resource
+	}{
+		{"no overcommit", 80, 1, 30, message.Resource{Physical: 80, Total: 80, Allocated: 30, Free: 50}},
+		{"overcommitted", 80, 1.5, 100, message.Resource{Physical: 80, Total: 120, Allocated: 100, Free: 20}},
+		{"over allocated", 8, 1, 12, message.Resource{Physical: 8, Total: 8, Allocated: 12, Free: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewResource(tt.physical, tt.overcommit, tt.allocated); got != tt.want {
+				t.Errorf("NewResource = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	free, total, err := DiskUsage(t.TempDir())
+	if err != nil || total == 0 || free > total {
+		t.Errorf("DiskUsage = %d, %d, %v", free, total, err)
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strings"
+)
+
+// Alphabet of crypt(3) Salts and Hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Rounds glibc Uses when a Hash does Not Specify them
+const sha512CryptRounds = 5000
+
+// Hash a Password with SHA-512 crypt ($6$) and a Random Salt, the Format
+// Both chpasswd and pw(8) Accept Instead of a Cleartext Password
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	for i, b := range salt {
+		salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return sha512Crypt(password, string(salt)), nil
+}
+
+// SHA-512 crypt as Specified by Ulrich Drepper, with the Default Rounds
+func sha512Crypt(password string, salt string) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alternate := sha512.New()
+	alternate.Write(p)
+	alternate.Write(s)
+	alternate.Write(p)
+	altSum := alternate.Sum(nil)
+
+	digest := sha512.New()
+	digest.Write(p)
+	digest.Write(s)
+	i := len(p)
+	for ; i > sha512.Size; i -= sha512.Size {
+		digest.Write(altSum)
+	}
+	digest.Write(altSum[:i])
+	for i = len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write(altSum)
+		} else {
+			digest.Write(p)
+		}
+	}
+	sum := digest.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatTo(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for n := 0; n < 16+int(sum[0]); n++ {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	for round := 0; round < sha512CryptRounds; round++ {
+		h := sha512.New()
+		if round&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(sum)
+		}
+		if round%3 != 0 {
+			h.Write(sSeq)
+		}
+		if round%7 != 0 {
+			h.Write(pSeq)
+		}
+		if round&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pSeq)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + salt + "$")
+	for n := 0; n < 21; n++ {
+		// Bytes are Encoded in Groups of Three, in the Order the Spec Permutes them
+		encode24(&out, sum[n], sum[n+21], sum[n+42], 4, n%3)
+	}
+	encode24(&out, 0, 0, sum[63], 2, 0)
+	return out.String()
+}
+
+// Group n of the Spec Takes Bytes (n, n+21, n+42), Rotated so
+// the Group's Most Significant Byte Cycles Through the Three
+func encode24(out *strings.Builder, a byte, b byte, c byte, chars int, rotation int) {
+	var b2, b1, b0 byte
+	switch rotation {
+	case 0:
+		b2, b1, b0 = a, b, c
+	case 1:
+		b2, b1, b0 = b, c, a
+	default:
+		b2, b1, b0 = c, a, b
+	}
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; chars > 0; chars-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// Repeat a Digest Until it Covers n Bytes
+func repeatTo(sum []byte, n int) []byte {
+	seq := make([]byte, 0, n+len(sum))
+	for len(seq) < n {
+		seq = append(seq, sum...)
+	}
+	return seq[:n]
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Test Vectors from the SHA-crypt Specification, and openssl passwd -6
+	// for a Password Longer than a Digest
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "toolongsaltstring", "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "abc",
+			"$6$abc$YmSvw6sXetTOkgL3CuRvi5qO9xsh2Vp47meV6hpF33dvSLJghHiW9pyPSRkTKVhqzXyOBqQdHt9jHLh0Q1iSE0"},
+	}
+	for _, tt := range tests {
+		if got := sha512Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("0a1b2c3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[1] != "6" || len(parts[2]) != 16 {
+		t.Fatalf("hashPassword = %s, want a $6$ hash with a 16 character salt", hash)
+	}
+	if sha512Crypt("0a1b2c3d", parts[2]) != hash {
+		t.Error("hash does not verify against its own salt")
+	}
+	if other, _ := hashPassword("0a1b2c3d"); other == hash {
+		t.Error("hashPassword reused a salt")
+	}
+}
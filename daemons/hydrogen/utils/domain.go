@@ -1,13 +1,15 @@
 package utils
 
 import (
+	"bytes"
 	_ "embed"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
-	"text/template"
 
+	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
 	"github.com/fosshostorg/aarch64/daemons/internal/message"
 	"go.uber.org/zap"
 )
@@ -18,158 +20,299 @@ var cloud_cfg_file string
 //go:embed templates/netplan.yml
 var netplan_cfg_file string
 
-func CreateDomain(l *zap.Logger, data *message.VMData) error {
-	// Check if Domain Already Exists. If not, Set it Up
-	cmd := exec.Command("virsh", "list", "--all")
-	output, err := cmd.Output()
+// Hydrogen Settings Used when Provisioning Domains
+var config = commons.DefaultConfig().Hydrogen
+
+// Set the Paths and Resolvers Used when Provisioning Domains
+func Configure(cfg commons.HydrogenConfig) {
+	config = cfg
+}
+
+// Channel the qemu Guest Agent Listens on, and the Device XML Adding it to
+// a Domain Defined Without it
+const (
+	GuestAgentChannel = "org.qemu.guest_agent.0"
+	GuestAgentXML     = "<channel type='unix'><target type='virtio' name='" + GuestAgentChannel + "'/></channel>"
+)
+
+func diskPath(id string) string {
+	return filepath.Join(config.VMPath, id+"-disk.qcow2")
+}
+
+func seedPath(id string) string {
+	return filepath.Join(config.VMPath, id+"-cloudinit.iso")
+}
+
+func tempPath(id string, name string) string {
+	return filepath.Join(config.TempPath, id+"-"+name)
+}
+
+func CreateDomain(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData) error {
+	// Check if Domain Already Exists. If not, Set it Up. Names are Matched
+	// Whole, a Rescue Domain <id>-rescue is Not the Domain Itself
+	output, err := ex.Output("virsh", "list", "--all", "--name")
 	if err != nil {
 		l.Error(
 			"unable to access existing domains",
-			zap.String("command", "virst list --all"),
+			zap.String("command", "virsh list --all --name"),
 			zap.Error(err),
 		)
 		return err
 	}
-	if !strings.Contains(string(output), data.ID) {
-		// Cloud Config Template Parsing
-		tmpl, err := template.New("cloud-config.yml").Parse(cloud_cfg_file)
-		if err != nil {
-			l.Error("failed to parse cloud-config.yml", zap.Error(err))
-			return err
-		}
-		cloudConfigFile, err := os.Create(fmt.Sprintf("/tmp/%s-cloud-config.yml", data.ID))
-		if err != nil {
-			l.Error(
-				"failed to create cloud config",
-				zap.String("file", data.ID+"-cloud-config.yml"),
-				zap.Error(err),
-			)
-			return err
-		}
-		defer cloudConfigFile.Close()
-		if err = tmpl.Execute(cloudConfigFile, data); err != nil {
-			l.Error(
-				"failed to execute cloud config template",
-				zap.String("file", data.ID+"-cloud-config.yml"),
-				zap.Error(err),
-			)
-			return err
+	for _, name := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(name) == data.ID {
+			return nil
 		}
-		// Netplan Config Template Parsing
-		tmpl, err = template.New("netplan.yml").Parse(netplan_cfg_file)
-		if err != nil {
-			l.Error("failed to parse netplan.yml", zap.Error(err))
-			return err
-		}
-		netplanConfigFile, err := os.Create(fmt.Sprintf("/tmp/%s-network-config.yml", data.ID))
-		if err != nil {
-			l.Error(
-				"failed to create netplan config",
-				zap.String("file", data.ID+"-network-config.yml"),
-				zap.Error(err),
-			)
-			return err
-		}
-		defer netplanConfigFile.Close()
-		if err = tmpl.Execute(netplanConfigFile, data); err != nil {
-			l.Error(
-				"failed to execute netplan config",
-				zap.String("file", data.ID+"-network-config.yml"),
-				zap.Error(err),
-			)
-			return err
-		}
-		// Create Cloud Init Image
-		if output, err = exec.Command(
-			"cloud-localds",
-			"-v",
-			fmt.Sprintf("--network-config=/tmp/%s-network-config.yml", data.ID),
-			fmt.Sprintf("/opt/aarch64/vms/%s-cloudinit.iso", data.ID),
-			fmt.Sprintf("/tmp/%s-cloud-config.yml", data.ID),
-		).Output(); err != nil {
-			l.Error(
-				"unable to create cloud-init image",
-				zap.String(
-					"command",
-					fmt.Sprintf("cloud-localds -v --network-config=/tmp/%s-network-config.yml /opt/aarch64/vms/%s-cloudinit.iso /tmp/%s-cloud-config.yml", data.ID, data.ID, data.ID),
-				),
-				zap.ByteString("output", output),
-				zap.Error(err),
-			)
-			return err
-		}
-		// Create VM Disk
-		if output, err = exec.Command(
-			"qemu-img", "create",
-			"-f", "qcow2",
-			"-F", "qcow2",
-			"-o", fmt.Sprintf("backing_file=/opt/aarch64/images/%s.qcow2", data.Os),
-			fmt.Sprintf("/opt/aarch64/vms/%s-disk.qcow2", data.ID),
-		).Output(); err != nil {
-			l.Error(
-				"unable to create vm disk",
-				zap.String(
-					"command",
-					fmt.Sprintf("qemu-img create -f qcow2 -F qcow2 -o backing_file=/opt/aarch64/images/%s.qcow2 /opt/aarch64/vms/%s-disk.qcow2", data.Os, data.ID),
-				),
-				zap.ByteString("output", output),
-				zap.Error(err),
-			)
-			return err
-		}
-		// Resize VM Disk
-		if output, err = exec.Command(
-			"qemu-img", "resize",
-			fmt.Sprintf("/opt/aarch64/vms/%s-disk.qcow2", data.ID),
-			fmt.Sprintf("+%dG", data.Ssd-2),
-		).Output(); err != nil {
-			l.Error(
-				"unable to resize vm disk",
-				zap.String(
-					"command",
-					fmt.Sprintf("qemu-img resize /opt/aarch64/vms/%s-disk.qcow2 +%dG", data.ID, data.Ssd-2),
-				),
-				zap.ByteString("output", output),
-				zap.Error(err),
-			)
-			return err
-		}
-		// Virt Install
-		if output, err = exec.Command(
-			"virt-install",
-			"--boot", "uefi",
-			"--arch", "aarch64",
-			"--name", data.ID,
-			"--description", fmt.Sprintf("%d", data.Password),
-			"--memory", fmt.Sprintf("%d", data.Memory*1024),
-			"--vcpus", fmt.Sprintf("%d", data.Vcpus),
-			"--network", fmt.Sprintf("bridge=vbr%d,model=virtio", data.Index),
-			"--import",
-			"--disk", fmt.Sprintf("path=/opt/aarch64/vms/%s-disk.qcow2,bus=virtio", data.ID),
-			"--disk", fmt.Sprintf("path=/opt/aarch64/vms/%s-cloudinit.iso,device=cdrom", data.ID),
-			"--nographics", "--noautoconsole", "--autostart",
-		).Output(); err != nil {
-			l.Error(
-				"unable to run virt-install",
-				zap.ByteString("output", output),
-				zap.Error(err),
-			)
+	}
+	if err = profile.Validate(data); err != nil {
+		l.Error("domain does not satisfy os profile", zap.String("os", profile.Name), zap.Error(err))
+		return err
+	}
+	baseImage, err := BaseImagePath(profile.Image)
+	if err != nil {
+		l.Error("unable to locate base image", zap.String("image", profile.Image), zap.Error(err))
+		return err
+	}
+	// Each Step is Undone if a Later One Fails, so a Failed Create Leaves
+	// Nothing Behind on the Host
+	if err = RunSteps(l, []Step{
+		{
+			Name: "seed",
+			Do:   func() error { return createSeed(l, ex, profile, data) },
+			Undo: func() error { return removeFiles(seedPath(data.ID)) },
+		},
+		{
+			Name: "disk",
+			Do:   func() error { return createDisk(l, ex, baseImage, data) },
+			Undo: func() error { return removeFiles(diskPath(data.ID)) },
+		},
+		{
+			Name: "resize",
+			Do:   func() error { return resizeDisk(l, ex, data) },
+		},
+		{
+			Name: "virt-install",
+			Do:   func() error { return installDomain(l, ex, profile, data) },
+			Undo: func() error { return undefineDomain(l, ex, data) },
+		},
+	}); err != nil {
+		return err
+	}
+	l.Info("Successfully Created Domain " + data.ID)
+	return nil
+}
+
+// Create the VM Disk as an Overlay of the Base Image
+func createDisk(l *zap.Logger, ex executor.Executor, baseImage string, data *message.VMData) error {
+	if output, err := ex.Output(
+		"qemu-img", "create",
+		"-f", "qcow2",
+		"-F", "qcow2",
+		"-o", "backing_file="+baseImage,
+		diskPath(data.ID),
+	); err != nil {
+		l.Error(
+			"unable to create vm disk",
+			zap.String(
+				"command",
+				fmt.Sprintf("qemu-img create -f qcow2 -F qcow2 -o backing_file=%s %s", baseImage, diskPath(data.ID)),
+			),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Grow the VM Disk to the Requested Size
+func resizeDisk(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if output, err := ex.Output(
+		"qemu-img", "resize",
+		diskPath(data.ID),
+		fmt.Sprintf("+%dG", data.Ssd-2),
+	); err != nil {
+		l.Error(
+			"unable to resize vm disk",
+			zap.String(
+				"command",
+				fmt.Sprintf("qemu-img resize %s +%dG", diskPath(data.ID), data.Ssd-2),
+			),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Define and Start the Domain with virt-install
+func installDomain(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData) error {
+	args := []string{
+		"--boot", profile.Boot,
+		"--arch", "aarch64",
+	}
+	if profile.Machine != "" {
+		args = append(args, "--machine", profile.Machine)
+	}
+	args = append(args,
+		"--name", data.ID,
+		"--memory", fmt.Sprintf("%d", data.Memory*1024),
+		"--vcpus", fmt.Sprintf("%d", data.Vcpus),
+	)
+	for _, iface := range Interfaces(data) {
+		args = append(args, "--network", fmt.Sprintf("bridge=vbr%d,model=virtio,mac=%s", iface.Index, iface.MAC))
+	}
+	for _, member := range data.Networks {
+		args = append(args, "--network", fmt.Sprintf("bridge=%s,model=virtio,mac=%s", NetworkBridge(member.VNI), member.MAC))
+	}
+	args = append(args,
+		"--import",
+		"--disk", fmt.Sprintf("path=%s,bus=virtio%s", diskPath(data.ID), iotuneDiskOptions(&data.IOTune)),
+		"--disk", fmt.Sprintf("path=%s,device=cdrom", seedPath(data.ID)),
+		"--channel", "unix,target.type=virtio,target.name="+GuestAgentChannel,
+		"--nographics", "--noautoconsole", "--autostart",
+	)
+	if output, err := ex.Output("virt-install", args...); err != nil {
+		l.Error(
+			"unable to run virt-install",
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Stop and Undefine a Domain, Ignoring One that was Never Defined
+func undefineDomain(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	ex.Output("virsh", "destroy", data.ID)
+	if output, err := ex.CombinedOutput(
+		"virsh",
+		"undefine",
+		"--nvram",
+		data.ID,
+	); err != nil && !strings.Contains(string(output), "failed to get domain") {
+		l.Error(
+			"unable to undefine domain",
+			zap.String("command", fmt.Sprintf("virsh undefine --nvram %s", data.ID)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Remove Files, Treating Already Missing Ones as Removed
+func removeFiles(paths ...string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
 			return err
 		}
-		l.Info("Successfully Created Domain " + data.ID)
-	} else {
+	}
+	return nil
+}
+
+// Create the Seed Image Handed to the Guest on First Boot
+func createSeed(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData) error {
+	// Intermediate Configs are Only Needed Until the Seed is Built
+	defer removeFiles(
+		tempPath(data.ID, "cloud-config.yml"),
+		tempPath(data.ID, "network-config.yml"),
+		tempPath(data.ID, "config-drive"),
+	)
+	switch profile.NetworkFormat {
+	case NetworkFormatFreeBSD:
+		return createConfigDriveSeed(l, ex, profile, data)
+	default:
+		return createNoCloudSeed(l, ex, profile, data)
+	}
+}
+
+// Create a NoCloud Seed Image with cloud-localds
+func createNoCloudSeed(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData) error {
+	tmplData, err := newSeedTemplateData(profile, data)
+	if err != nil {
+		l.Error("failed to hash root password", zap.String("id", data.ID), zap.Error(err))
+		return err
+	}
+	// Cloud Config Template Execution
+	var cloudConfig bytes.Buffer
+	if err := profile.cloudConfig.Execute(&cloudConfig, tmplData); err != nil {
+		l.Error(
+			"failed to execute cloud config template",
+			zap.String("file", data.ID+"-cloud-config.yml"),
+			zap.Error(err),
+		)
+		return err
+	}
+	// Merge User Supplied User-Data with the Platform Cloud Config
+	userData, err := BuildUserData(cloudConfig.Bytes(), data.UserData)
+	if err != nil {
+		l.Error(
+			"failed to build user-data",
+			zap.String("file", data.ID+"-cloud-config.yml"),
+			zap.Error(err),
+		)
+		return err
+	}
+	if err := os.WriteFile(tempPath(data.ID, "cloud-config.yml"), userData, 0600); err != nil {
+		l.Error(
+			"failed to create cloud config",
+			zap.String("file", data.ID+"-cloud-config.yml"),
+			zap.Error(err),
+		)
+		return err
+	}
+	// Network Config Template Execution
+	netplanConfigFile, err := os.Create(tempPath(data.ID, "network-config.yml"))
+	if err != nil {
+		l.Error(
+			"failed to create netplan config",
+			zap.String("file", data.ID+"-network-config.yml"),
+			zap.Error(err),
+		)
+		return err
+	}
+	defer netplanConfigFile.Close()
+	if err = profile.networkConfig.Execute(netplanConfigFile, tmplData); err != nil {
+		l.Error(
+			"failed to execute netplan config",
+			zap.String("file", data.ID+"-network-config.yml"),
+			zap.Error(err),
+		)
+		return err
+	}
+	// Create Cloud Init Image
+	if output, err := ex.Output(
+		"cloud-localds",
+		"-v",
+		"--network-config="+tempPath(data.ID, "network-config.yml"),
+		seedPath(data.ID),
+		tempPath(data.ID, "cloud-config.yml"),
+	); err != nil {
+		l.Error(
+			"unable to create cloud-init image",
+			zap.String(
+				"command",
+				fmt.Sprintf("cloud-localds -v --network-config=%s %s %s", tempPath(data.ID, "network-config.yml"), seedPath(data.ID), tempPath(data.ID, "cloud-config.yml")),
+			),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
 		return err
 	}
 	return nil
 }
 
-func DeleteDomain(l *zap.Logger, data *message.VMData) error {
+func DeleteDomain(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
 	// Destory (Shutdown) Domain, Continue Regardless of Errors
-	if output, err := exec.Command(
+	if output, err := ex.Output(
 		"virsh",
 		"destroy",
 		data.ID,
-	).Output(); err != nil {
+	); err != nil {
 		l.Error(
 			"domain was already destroyed or was unable to be shutdown",
 			zap.String("command", fmt.Sprintf("virsh destroy %s", data.ID)),
@@ -178,12 +321,12 @@ func DeleteDomain(l *zap.Logger, data *message.VMData) error {
 		)
 	}
 	// Undefine (Delete) Domain, Continue Regardless of Errors
-	if output, err := exec.Command(
+	if output, err := ex.Output(
 		"virsh",
 		"undefine",
 		"--nvram",
 		data.ID,
-	).Output(); err != nil {
+	); err != nil {
 		l.Error(
 			"domain was already undefined or was unable to be undefined",
 			zap.String("command", fmt.Sprintf("virsh undefine --nvram %s", data.ID)),
@@ -192,14 +335,10 @@ func DeleteDomain(l *zap.Logger, data *message.VMData) error {
 		)
 	}
 	// Remove Virtual Machine Files from Host
-	if output, err := exec.Command(
-		"rm", "-rf",
-		fmt.Sprintf("/opt/aarch64/vms/%s*", data.ID),
-	).Output(); err != nil {
+	if err := removeFiles(diskPath(data.ID), seedPath(data.ID)); err != nil {
 		l.Error(
 			"unable to delete virtual machine files from host",
-			zap.String("command", fmt.Sprintf("rm -rf /opt/aarch64/vms/%s*", data.ID)),
-			zap.ByteString("output", output),
+			zap.String("path", config.VMPath),
 			zap.Error(err),
 		)
 		return err
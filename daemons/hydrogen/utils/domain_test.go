@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Point Provisioning Paths at a Scratch Directory with a Debian Base Image
+func testPaths(t *testing.T) {
+	t.Helper()
+	oldConfig := config
+	dir := t.TempDir()
+	config.VMPath = filepath.Join(dir, "vms")
+	config.ImagePath = filepath.Join(dir, "images")
+	config.TempPath = filepath.Join(dir, "tmp")
+	t.Cleanup(func() { Configure(oldConfig) })
+	for _, path := range []string{config.VMPath, config.ImagePath, config.TempPath} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(config.ImagePath, "debian.qcow2"), testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func debianProfile(t *testing.T) *Profile {
+	t.Helper()
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadProfiles: %v", err)
+	}
+	profile, _ := profiles.Get("debian")
+	return profile
+}
+
+func debianVM() *message.VMData {
+	return &message.VMData{
+		ID:       "60f1c1a2b3c4d5e6f7a8b9c1",
+		Hostname: "debian-box",
+		Os:       "debian",
+		Vcpus:    2,
+		Memory:   4,
+		Ssd:      10,
+		Password: "0a1b2c3d",
+		Index:    4,
+		Prefix:   "2001:db8:0:4::/64",
+		MAC:      "52:54:00:00:00:04",
+		Gateway:  "2001:db8:0:4::1",
+		Address:  "2001:db8:0:4::2/64",
+	}
+}
+
+// Commands Expected to Create a Domain, up to and Including virt-install
+func expectCreate(fake *executor.Fake, data *message.VMData, virtInstallErr error) {
+	fake.Expect("virsh list --all --name", "\n", nil)
+	expectInstall(fake, data, virtInstallErr)
+}
+
+// Commands Expected Once a Domain is Known Not to Exist
+func expectInstall(fake *executor.Fake, data *message.VMData, virtInstallErr error) {
+	fake.Expect(fmt.Sprintf(
+		"cloud-localds -v --network-config=%s %s %s",
+		tempPath(data.ID, "network-config.yml"), seedPath(data.ID), tempPath(data.ID, "cloud-config.yml"),
+	), "", nil)
+	fake.Expect(fmt.Sprintf(
+		"qemu-img create -f qcow2 -F qcow2 -o backing_file=%s %s",
+		filepath.Join(config.ImagePath, "debian.qcow2"), diskPath(data.ID),
+	), "", nil)
+	fake.Expect(fmt.Sprintf("qemu-img resize %s +8G", diskPath(data.ID)), "", nil)
+	fake.Expect(fmt.Sprintf(
+		"virt-install --boot uefi --arch aarch64 --name %s --memory 4096 --vcpus 2 "+
+			"--network bridge=vbr4,model=virtio,mac=52:54:00:00:00:04 --import --disk path=%s,bus=virtio --disk path=%s,device=cdrom "+
+			"--channel unix,target.type=virtio,target.name=org.qemu.guest_agent.0 --nographics --noautoconsole --autostart",
+		data.ID, diskPath(data.ID), seedPath(data.ID),
+	), "", virtInstallErr)
+}
+
+func TestCreateDomain(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake()
+	expectCreate(fake, data, nil)
+
+	if err := CreateDomain(zap.NewNop(), fake, debianProfile(t), data); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(tempPath(data.ID, "cloud-config.yml")); !os.IsNotExist(err) {
+		t.Error("cloud config left behind in the temp path")
+	}
+}
+
+func TestCreateDomainAlreadyExists(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake().Expect("virsh list --all --name", data.ID+"\n\n", nil)
+	if err := CreateDomain(zap.NewNop(), fake, debianProfile(t), data); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateDomainIgnoresRescueDomain(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake().Expect("virsh list --all --name", data.ID+"-rescue\n\n", nil)
+	expectInstall(fake, data, nil)
+	if err := CreateDomain(zap.NewNop(), fake, debianProfile(t), data); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateDomainRollsBack(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake()
+	expectCreate(fake, data, errors.New("exit status 1"))
+	fake.Expect("virsh destroy "+data.ID, "", errors.New("exit status 1"))
+	fake.Expect("virsh undefine --nvram "+data.ID, "error: failed to get domain", errors.New("exit status 1"))
+	// Stand in for the Files the Faked Commands would have Created
+	for _, path := range []string{diskPath(data.ID), seedPath(data.ID)} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := CreateDomain(zap.NewNop(), fake, debianProfile(t), data)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "virt-install" {
+		t.Fatalf("CreateDomain error = %v, want virt-install step error", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	for _, path := range []string{diskPath(data.ID), seedPath(data.ID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after rollback", path)
+		}
+	}
+}
+
+func TestCreateDomainFailsBeforeDisk(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake()
+	fake.Expect("virsh list --all --name", "", nil)
+	fake.Expect(fmt.Sprintf(
+		"cloud-localds -v --network-config=%s %s %s",
+		tempPath(data.ID, "network-config.yml"), seedPath(data.ID), tempPath(data.ID, "cloud-config.yml"),
+	), "", errors.New("exit status 2"))
+
+	err := CreateDomain(zap.NewNop(), fake, debianProfile(t), data)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "seed" {
+		t.Fatalf("CreateDomain error = %v, want seed step error", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteDomain(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	other := filepath.Join(config.VMPath, "60f1c1a2b3c4d5e6f7a8b9c2-disk.qcow2")
+	for _, path := range []string{diskPath(data.ID), seedPath(data.ID), other} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := executor.NewFake()
+	// Failures to Stop or Undefine do Not Prevent Removing the Files
+	fake.Expect("virsh destroy "+data.ID, "", errors.New("exit status 1"))
+	fake.Expect("virsh undefine --nvram "+data.ID, "", nil)
+
+	if err := DeleteDomain(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	for _, path := range []string{diskPath(data.ID), seedPath(data.ID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("another domain's disk was removed: %v", err)
+	}
+}
+
+func TestCloudConfigHashesPassword(t *testing.T) {
+	profile := debianProfile(t)
+	tmplData, err := newSeedTemplateData(profile, debianVM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cloudConfig bytes.Buffer
+	if err := profile.cloudConfig.Execute(&cloudConfig, tmplData); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cloudConfig.String(), `  list: "root:$6$`) {
+		t.Errorf("cloud config does not set a hashed root password:\n%s", cloudConfig.String())
+	}
+	if strings.Contains(cloudConfig.String(), "0a1b2c3d") {
+		t.Errorf("cloud config carries the cleartext password:\n%s", cloudConfig.String())
+	}
+
+	data := debianVM()
+	data.Password = ""
+	if tmplData, err = newSeedTemplateData(profile, data); err != nil {
+		t.Fatal(err)
+	}
+	cloudConfig.Reset()
+	if err := profile.cloudConfig.Execute(&cloudConfig, tmplData); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cloudConfig.String(), "chpasswd") {
+		t.Errorf("cloud config sets a root password without one:\n%s", cloudConfig.String())
+	}
+}
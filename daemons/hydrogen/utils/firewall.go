@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Inbound Traffic Forwarded to a Bridge is Dispatched Through the vms
+// Verdict Map to that VM's Chain in the inet hydrogen Table
+const firewallTable = "inet hydrogen"
+
+func firewallChain(data *message.VMData) string {
+	return fmt.Sprintf("vm%d", data.Index)
+}
+
+// Shared Table, Forward Hook and Verdict Map, Safe to Repeat in Every Script
+func firewallBase() []string {
+	return []string{
+		"add table " + firewallTable,
+		"add chain " + firewallTable + " forward { type filter hook forward priority 0; policy accept; }",
+		"add map " + firewallTable + " vms { type ifname : verdict; }",
+		"flush chain " + firewallTable + " forward",
+		"add rule " + firewallTable + " forward oifname vmap @vms",
+	}
+}
+
+// Check a Firewall and Compile its Rules to nft Statements
+func compileFirewall(fw *message.Firewall) ([]string, error) {
+	if fw.Policy != "accept" && fw.Policy != "drop" {
+		return nil, fmt.Errorf("firewall policy %q must be accept or drop", fw.Policy)
+	}
+	statements := []string{}
+	for i, rule := range fw.Rules {
+		if rule.Action != "accept" && rule.Action != "drop" {
+			return nil, fmt.Errorf("firewall rule %d: action %q must be accept or drop", i, rule.Action)
+		}
+		matches := []string{}
+		if len(rule.Sources) > 0 {
+			for _, source := range rule.Sources {
+				ip, _, err := net.ParseCIDR(source)
+				if err != nil || ip.To4() != nil {
+					return nil, fmt.Errorf("firewall rule %d: source %q is not an ipv6 prefix", i, source)
+				}
+			}
+			matches = append(matches, "ip6 saddr { "+strings.Join(rule.Sources, ", ")+" }")
+		}
+		switch rule.Protocol {
+		case "tcp", "udp":
+			matches = append(matches, "meta l4proto "+rule.Protocol)
+		case "icmpv6":
+			matches = append(matches, "meta l4proto ipv6-icmp")
+		case "":
+		default:
+			return nil, fmt.Errorf("firewall rule %d: unsupported protocol %q", i, rule.Protocol)
+		}
+		if len(rule.Ports) > 0 {
+			if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+				return nil, fmt.Errorf("firewall rule %d: ports need protocol tcp or udp", i)
+			}
+			for _, port := range rule.Ports {
+				if !validPortRange(port) {
+					return nil, fmt.Errorf("firewall rule %d: invalid port %q", i, port)
+				}
+			}
+			matches = append(matches, "th dport { "+strings.Join(rule.Ports, ", ")+" }")
+		}
+		statements = append(statements, strings.TrimSpace(strings.Join(matches, " ")+" "+rule.Action))
+	}
+	return append(statements, fw.Policy), nil
+}
+
+// A Port or an Ascending Range of Ports such as 8000-8100
+func validPortRange(ports string) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil || low < 1 || low > 65535 {
+		return false
+	}
+	if len(bounds) == 1 {
+		return true
+	}
+	high, err := strconv.Atoi(bounds[1])
+	return err == nil && high >= low && high <= 65535
+}
+
+// Validate a Firewall Without Applying it. An Empty Policy is Valid
+func ValidateFirewall(fw *message.Firewall) error {
+	if fw.Policy == "" && len(fw.Rules) == 0 {
+		return nil
+	}
+	_, err := compileFirewall(fw)
+	return err
+}
+
+// Render an nft Script that Replaces the Chains of Every Interface of the VM
+// in One Transaction. Established Traffic is Always Let Through Before the
+// Rules
+func RenderFirewall(data *message.VMData) (string, error) {
+	statements, err := compileFirewall(&data.Firewall)
+	if err != nil {
+		return "", err
+	}
+	lines := firewallBase()
+	for _, iface := range Interfaces(data) {
+		ifaceData := InterfaceData(data, &iface)
+		chain := firewallTable + " " + firewallChain(ifaceData)
+		lines = append(lines,
+			"add chain "+chain,
+			"flush chain "+chain,
+			"add rule "+chain+" ct state established,related accept",
+		)
+		for _, statement := range statements {
+			lines = append(lines, "add rule "+chain+" "+statement)
+		}
+		lines = append(lines, fmt.Sprintf(`add element %s vms { "vbr%d" : jump %s }`, firewallTable, ifaceData.Index, firewallChain(ifaceData)))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Render an nft Script Removing the Chains of Every Interface of the VM,
+// Whether or Not they Exist
+func RenderFirewallRemoval(data *message.VMData) string {
+	lines := firewallBase()
+	for _, iface := range Interfaces(data) {
+		ifaceData := InterfaceData(data, &iface)
+		chain := firewallTable + " " + firewallChain(ifaceData)
+		element := fmt.Sprintf(`%s vms { "vbr%d" : jump %s }`, firewallTable, ifaceData.Index, firewallChain(ifaceData))
+		lines = append(lines,
+			"add chain "+chain,
+			"add element "+element,
+			fmt.Sprintf(`delete element %s vms { "vbr%d" }`, firewallTable, ifaceData.Index),
+			"delete chain "+chain,
+		)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Apply the VM's Firewall, or Remove it if the Policy is Empty
+func ApplyFirewall(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if data.Firewall.Policy == "" && len(data.Firewall.Rules) == 0 {
+		return RemoveFirewall(l, ex, data)
+	}
+	script, err := RenderFirewall(data)
+	if err != nil {
+		l.Error("invalid firewall", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	return runNft(l, ex, tempPath(data.ID, "firewall.nft"), script)
+}
+
+func RemoveFirewall(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	return runNft(l, ex, tempPath(data.ID, "firewall.nft"), RenderFirewallRemoval(data))
+}
+
+// Load an nft Script, which nft Applies Atomically
+func runNft(l *zap.Logger, ex executor.Executor, path string, script string) error {
+	if err := os.WriteFile(path, []byte(script), 0600); err != nil {
+		l.Error("unable to write nft script", zap.String("file", path), zap.Error(err))
+		return err
+	}
+	defer os.Remove(path)
+	if output, err := ex.CombinedOutput("nft", "-f", path); err != nil {
+		l.Error(
+			"unable to apply nft script",
+			zap.String("command", "nft -f "+path),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func TestRenderFirewall(t *testing.T) {
+	data := debianVM()
+	data.Firewall = message.Firewall{
+		Policy: "drop",
+		Rules: []message.FirewallRule{
+			{Action: "drop", Sources: []string{"2001:db8:bad::/48"}},
+			{Action: "accept", Protocol: "tcp", Ports: []string{"22", "8000-8100"}, Sources: []string{"2001:db8::/32"}},
+			{Action: "accept", Protocol: "icmpv6"},
+		},
+	}
+	script, err := RenderFirewall(data)
+	if err != nil {
+		t.Fatalf("RenderFirewall: %v", err)
+	}
+	want := []string{
+		"add chain inet hydrogen vm4",
+		"flush chain inet hydrogen vm4",
+		"add rule inet hydrogen vm4 ct state established,related accept",
+		"add rule inet hydrogen vm4 ip6 saddr { 2001:db8:bad::/48 } drop",
+		"add rule inet hydrogen vm4 ip6 saddr { 2001:db8::/32 } meta l4proto tcp th dport { 22, 8000-8100 } accept",
+		"add rule inet hydrogen vm4 meta l4proto ipv6-icmp accept",
+		"add rule inet hydrogen vm4 drop",
+		`add element inet hydrogen vms { "vbr4" : jump vm4 }`,
+	}
+	if !strings.HasSuffix(script, strings.Join(want, "\n")+"\n") {
+		t.Errorf("RenderFirewall =\n%s\nwant it to end with\n%s", script, strings.Join(want, "\n"))
+	}
+}
+
+// Every Interface's Bridge Gets the Same Rules, and Removal Covers them All
+func TestRenderFirewallInterfaces(t *testing.T) {
+	data := multihomedVM()
+	data.Firewall = message.Firewall{Policy: "drop"}
+	script, err := RenderFirewall(data)
+	if err != nil {
+		t.Fatalf("RenderFirewall: %v", err)
+	}
+	for _, index := range []string{"4", "9"} {
+		for _, line := range []string{
+			"add rule inet hydrogen vm" + index + " drop\n",
+			`add element inet hydrogen vms { "vbr` + index + `" : jump vm` + index + " }\n",
+		} {
+			if !strings.Contains(script, line) {
+				t.Errorf("RenderFirewall does not cover vbr%s, missing %q", index, line)
+			}
+		}
+		if removal := RenderFirewallRemoval(data); !strings.Contains(removal, "delete chain inet hydrogen vm"+index+"\n") {
+			t.Errorf("RenderFirewallRemoval does not remove vm%s:\n%s", index, removal)
+		}
+	}
+}
+
+func TestValidateFirewall(t *testing.T) {
+	tests := []struct {
+		name    string
+		fw      message.Firewall
+		wantErr bool
+	}{
+		{"no firewall", message.Firewall{}, false},
+		{"accept all", message.Firewall{Policy: "accept"}, false},
+		{"bad policy", message.Firewall{Policy: "reject"}, true},
+		{"rules without policy", message.Firewall{Rules: []message.FirewallRule{{Action: "accept"}}}, true},
+		{"bad action", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "allow"}}}, true},
+		{"ports without protocol", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Ports: []string{"22"}}}}, true},
+		{"bad port", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Protocol: "tcp", Ports: []string{"70000"}}}}, true},
+		{"reversed range", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Protocol: "udp", Ports: []string{"100-10"}}}}, true},
+		{"ipv4 source", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Sources: []string{"192.0.2.0/24"}}}}, true},
+		{"injected source", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Sources: []string{"::/0 } accept; flush ruleset #"}}}}, true},
+		{"bad protocol", message.Firewall{Policy: "drop", Rules: []message.FirewallRule{{Action: "accept", Protocol: "sctp"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateFirewall(&tt.fw); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateFirewall error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyFirewall(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	script := tempPath(data.ID, "firewall.nft")
+
+	data.Firewall = message.Firewall{Policy: "drop"}
+	fake := executor.NewFake().Expect("nft -f "+script, "", nil)
+	if err := ApplyFirewall(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("ApplyFirewall: %v", err)
+	}
+	// Clearing the Policy Removes the Chain
+	data.Firewall = message.Firewall{}
+	fake.Expect("nft -f "+script, "", nil)
+	if err := ApplyFirewall(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("ApplyFirewall: %v", err)
+	}
+	// A Rejected Script is Reported
+	data.Firewall = message.Firewall{Policy: "accept"}
+	fake.Expect("nft -f "+script, "Error: syntax error", errors.New("exit status 1"))
+	if err := ApplyFirewall(zap.NewNop(), fake, data); err == nil {
+		t.Error("ApplyFirewall succeeded although nft failed")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+//go:embed templates/freebsd-user-data.sh
+var freebsd_user_data_file string
+
+//go:embed templates/freebsd-rc.conf
+var freebsd_rc_conf_file string
+
+// RFC 1123 Host Names, which Need No Quoting in rc.conf or Cloud Config
+var hostnamePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Check a Host Name is Safe to Render Raw into Guest Configs
+func ValidateHostname(hostname string) error {
+	if len(hostname) > 253 || !hostnamePattern.MatchString(hostname) {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	return nil
+}
+
+// OpenStack Config Drive Paths Read by nuageinit
+const (
+	configDriveMetaData = "openstack/latest/meta_data.json"
+	configDriveUserData = "openstack/latest/user_data"
+)
+
+// meta_data.json of a Config Drive
+type configDriveMeta struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+}
+
+// Render the Files of a Config Drive, Keyed by their Path on the Drive
+func RenderConfigDrive(profile *Profile, data *message.VMData) (map[string][]byte, error) {
+	tmplData, err := newSeedTemplateData(profile, data)
+	if err != nil {
+		return nil, err
+	}
+	// rc.conf Network Config is Embedded in the User-Data Script
+	var networkConfig bytes.Buffer
+	if err := profile.networkConfig.Execute(&networkConfig, tmplData); err != nil {
+		return nil, err
+	}
+	tmplData.NetworkConfig = networkConfig.String()
+	var userData bytes.Buffer
+	if err := profile.cloudConfig.Execute(&userData, tmplData); err != nil {
+		return nil, err
+	}
+	metaData, err := json.Marshal(configDriveMeta{UUID: data.ID, Name: data.Hostname, Hostname: data.Hostname})
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		configDriveMetaData: metaData,
+		configDriveUserData: userData.Bytes(),
+	}, nil
+}
+
+// Create a Config Drive Seed Image for Guests Provisioned by nuageinit
+func createConfigDriveSeed(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData) error {
+	files, err := RenderConfigDrive(profile, data)
+	if err != nil {
+		l.Error(
+			"failed to render config drive",
+			zap.String("domain", data.ID),
+			zap.Error(err),
+		)
+		return err
+	}
+	configDriveDir := tempPath(data.ID, "config-drive")
+	if err = os.RemoveAll(configDriveDir); err != nil {
+		l.Error("failed to clear config drive", zap.String("path", configDriveDir), zap.Error(err))
+		return err
+	}
+	for name, content := range files {
+		path := filepath.Join(configDriveDir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			l.Error("failed to create config drive", zap.String("path", path), zap.Error(err))
+			return err
+		}
+		if err = os.WriteFile(path, content, 0600); err != nil {
+			l.Error("failed to create config drive", zap.String("path", path), zap.Error(err))
+			return err
+		}
+	}
+	// Create Config Drive Image
+	if output, err := ex.Output(
+		"genisoimage",
+		"-output", seedPath(data.ID),
+		"-volid", "config-2",
+		"-joliet", "-rock",
+		configDriveDir,
+	); err != nil {
+		l.Error(
+			"unable to create config drive image",
+			zap.String(
+				"command",
+				fmt.Sprintf("genisoimage -output %s -volid config-2 -joliet -rock %s", seedPath(data.ID), configDriveDir),
+			),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func freebsdProfile(t *testing.T) *Profile {
+	t.Helper()
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadProfiles: %v", err)
+	}
+	profile, err := profiles.Get("freebsd")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return profile
+}
+
+func freebsdVM() *message.VMData {
+	return &message.VMData{
+		ID:       "60f1c1a2b3c4d5e6f7a8b9c0",
+		Hostname: "bsd-box",
+		Os:       "freebsd",
+		Ssd:      8,
+		Password: "0a1b2c3d",
+		Index:    3,
+		Prefix:   "2001:db8:0:3::/64",
+		Gateway:  "2001:db8:0:3::1",
+		Address:  "2001:db8:0:3::2/64",
+	}
+}
+
+func TestRenderConfigDriveNetwork(t *testing.T) {
+	files, err := RenderConfigDrive(freebsdProfile(t), freebsdVM())
+	if err != nil {
+		t.Fatalf("RenderConfigDrive: %v", err)
+	}
+	userData := string(files[configDriveUserData])
+	if !strings.HasPrefix(userData, "#!/bin/sh\n") {
+		t.Errorf("user_data is not a shell script:\n%s", userData)
+	}
+	for _, want := range []string{
+		`hostname="bsd-box"`,
+		`ifconfig_vtnet0_ipv6="inet6 2001:db8:0:3::2 prefixlen 64"`,
+		`ipv6_defaultrouter="2001:db8:0:3::1"`,
+		"nameserver 2606:4700:4700::64\n",
+		"nameserver 2606:4700:4700::6400\n",
+		"echo '$6$",
+		"' | pw usermod root -H 0",
+	} {
+		if !strings.Contains(userData, want) {
+			t.Errorf("user_data missing %q:\n%s", want, userData)
+		}
+	}
+	if strings.Contains(userData, "0a1b2c3d") {
+		t.Errorf("user_data carries the cleartext password:\n%s", userData)
+	}
+	if strings.Contains(userData, "AARCH64_USER_DATA") {
+		t.Errorf("user_data embeds user-data that was not supplied:\n%s", userData)
+	}
+}
+
+func TestRenderConfigDriveMetaData(t *testing.T) {
+	files, err := RenderConfigDrive(freebsdProfile(t), freebsdVM())
+	if err != nil {
+		t.Fatalf("RenderConfigDrive: %v", err)
+	}
+	var metaData map[string]string
+	if err := json.Unmarshal(files[configDriveMetaData], &metaData); err != nil {
+		t.Fatalf("meta_data.json: %v", err)
+	}
+	if metaData["uuid"] != "60f1c1a2b3c4d5e6f7a8b9c0" || metaData["hostname"] != "bsd-box" {
+		t.Errorf("unexpected meta_data.json: %v", metaData)
+	}
+}
+
+func TestRenderConfigDriveUserScript(t *testing.T) {
+	vm := freebsdVM()
+	vm.UserData = "#!/bin/sh\npkg install -y nginx\n"
+	files, err := RenderConfigDrive(freebsdProfile(t), vm)
+	if err != nil {
+		t.Fatalf("RenderConfigDrive: %v", err)
+	}
+	userData := string(files[configDriveUserData])
+	platform := strings.Index(userData, "service sshd restart")
+	user := strings.Index(userData, "pkg install -y nginx")
+	if platform < 0 || user < 0 || user < platform {
+		t.Errorf("user script must run after the platform steps:\n%s", userData)
+	}
+}
+
+func TestFreeBSDProfileValidate(t *testing.T) {
+	profile := freebsdProfile(t)
+	tests := []struct {
+		name     string
+		ssd      int
+		userData string
+		wantErr  bool
+	}{
+		{"no user-data", 8, "", false},
+		{"shell script", 8, "#!/bin/sh\ntrue\n", false},
+		{"cloud-config", 8, "#cloud-config\npackages: [nginx]\n", true},
+		{"disk too small", 4, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := freebsdVM()
+			vm.Ssd = tt.ssd
+			vm.UserData = tt.userData
+			if err := profile.Validate(vm); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		wantErr  bool
+	}{
+		{"bsd-box", false},
+		{"web1.example.com", false},
+		{"", true},
+		{"-box", true},
+		{"box-", true},
+		{`box"`, true},
+		{"box\nsshd_enable=\"NO\"", true},
+		{"box name", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a.", 127) + "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if err := ValidateHostname(tt.hostname); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateHostname(%q) error = %v, wantErr %v", tt.hostname, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfileRejectsInjectedHostname(t *testing.T) {
+	data := freebsdVM()
+	data.Hostname = "bsd-box\"\nsshd_enable=\"NO"
+	if err := freebsdProfile(t).Validate(data); err == nil {
+		t.Error("Validate accepted a hostname that breaks out of rc.conf")
+	}
+}
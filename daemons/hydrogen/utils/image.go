@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Versioned Bases Live in <os>/<version>.qcow2 Under the Image Path with
+// <os>/current.qcow2 Pointing at the Active One, while Images Installed by
+// Ansible are Plain <os>.qcow2 Files
+const currentImage = "current.qcow2"
+
+// Formats a Download may Declare. qemu-img is Never Left to Probe the
+// Format of an Untrusted File
+var imageFormats = map[string]bool{"qcow2": true, "raw": true}
+
+var ErrChecksumMismatch = errors.New("image checksum mismatch")
+var ErrImageTooLarge = errors.New("image exceeds the maximum size")
+
+// Client for Base Image Downloads. Connecting and Waiting for Headers are
+// Bounded Separately so a Dead Mirror Fails Fast, and the Whole Download is
+// Bounded by image_download_timeout
+func imageClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(config.ImageDownloadTimeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+	}
+}
+
+// Parse a "<algorithm>:<hex digest>" Checksum
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid checksum %q", checksum)
+	}
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid checksum %q: %w", checksum, err)
+	}
+	switch parts[0] {
+	case "sha256":
+		return sha256.New(), digest, nil
+	case "sha512":
+		return sha512.New(), digest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", parts[0])
+}
+
+// Check an Image Name or Version is Safe to Use as a File Name
+func validImageName(name string) bool {
+	return name != "" && name != "current" &&
+		!strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// Download an Image of at Most maxSize Bytes to dst and Verify it Against
+// the Expected Checksum. dst is Removed if the Download Fails or the
+// Checksum does not Match
+func FetchImage(client *http.Client, url string, checksum string, maxSize int64, dst string) (err error) {
+	h, digest, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return fmt.Errorf("%w: %s is %d bytes", ErrImageTooLarge, url, resp.ContentLength)
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	// Read One Byte Past the Limit to Tell a Full Sized Image from a Larger One
+	written, err := io.Copy(io.MultiWriter(file, h), io.LimitReader(resp.Body, maxSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written > maxSize {
+		return fmt.Errorf("%w: %s is over %d bytes", ErrImageTooLarge, url, maxSize)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, digest) {
+		return fmt.Errorf("%w: expected %x, got %x", ErrChecksumMismatch, digest, sum)
+	}
+	return nil
+}
+
+// Download, Verify and Convert an Image, then Atomically Make it the Current
+// Base for its OS. Previous Versions are Kept for Existing Disk Overlays
+func InstallImage(l *zap.Logger, ex executor.Executor, data *message.ImageData) error {
+	if !validImageName(data.Os) || !validImageName(data.Version) {
+		err := fmt.Errorf("invalid image name %q version %q", data.Os, data.Version)
+		l.Error("unable to install image", zap.Error(err))
+		return err
+	}
+	if !imageFormats[data.Format] {
+		err := fmt.Errorf("unsupported image format %q", data.Format)
+		l.Error("unable to install image", zap.Error(err))
+		return err
+	}
+	osDir := filepath.Join(config.ImagePath, data.Os)
+	if err := os.MkdirAll(osDir, 0755); err != nil {
+		l.Error("unable to create image directory", zap.String("path", osDir), zap.Error(err))
+		return err
+	}
+	imagePath := filepath.Join(osDir, data.Version+".qcow2")
+	if _, err := os.Stat(imagePath); err == nil {
+		err = fmt.Errorf("image %s version %s already installed", data.Os, data.Version)
+		l.Error("unable to install image", zap.Error(err))
+		return err
+	}
+
+	// Download and Verify Image
+	downloadPath := filepath.Join(osDir, "."+data.Version+".download")
+	defer os.Remove(downloadPath)
+	maxSize := int64(config.MaxImageSize) << 30
+	if err := FetchImage(imageClient(), data.URL, data.Checksum, maxSize, downloadPath); err != nil {
+		l.Error(
+			"unable to download image",
+			zap.String("url", data.URL),
+			zap.Error(err),
+		)
+		return err
+	}
+	if err := checkImage(l, ex, downloadPath, data.Format); err != nil {
+		return err
+	}
+	// Convert Image to qcow2
+	convertPath := filepath.Join(osDir, "."+data.Version+".qcow2")
+	defer os.Remove(convertPath)
+	if output, err := ex.CombinedOutput(
+		"qemu-img", "convert",
+		"-f", data.Format,
+		"-O", "qcow2",
+		downloadPath,
+		convertPath,
+	); err != nil {
+		l.Error(
+			"unable to convert image",
+			zap.String("command", fmt.Sprintf("qemu-img convert -f %s -O qcow2 %s %s", data.Format, downloadPath, convertPath)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	if err := os.Rename(convertPath, imagePath); err != nil {
+		l.Error("unable to install image", zap.String("path", imagePath), zap.Error(err))
+		return err
+	}
+	// Swap the Current Pointer
+	linkPath := filepath.Join(osDir, ".current.qcow2")
+	os.Remove(linkPath)
+	if err := os.Symlink(data.Version+".qcow2", linkPath); err != nil {
+		l.Error("unable to link current image", zap.String("path", linkPath), zap.Error(err))
+		return err
+	}
+	if err := os.Rename(linkPath, filepath.Join(osDir, currentImage)); err != nil {
+		l.Error("unable to link current image", zap.String("path", linkPath), zap.Error(err))
+		return err
+	}
+	l.Info("Successfully Installed Image", zap.String("os", data.Os), zap.String("version", data.Version))
+	return nil
+}
+
+// Reject a Downloaded Image with a Backing File, which would Make Converting
+// it Read Whatever File on the Host it Names
+func checkImage(l *zap.Logger, ex executor.Executor, path string, format string) error {
+	output, err := ex.Output("qemu-img", "info", "-f", format, "--output=json", path)
+	if err != nil {
+		l.Error(
+			"unable to inspect image",
+			zap.String("command", fmt.Sprintf("qemu-img info -f %s --output=json %s", format, path)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	var info struct {
+		BackingFilename string `json:"backing-filename"`
+	}
+	if err = json.Unmarshal(output, &info); err != nil {
+		l.Error("invalid qemu-img info output", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	if info.BackingFilename != "" {
+		err = fmt.Errorf("image has a backing file %q", info.BackingFilename)
+		l.Error("unable to install image", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Resolve the Base Image Path New Disks Should be Backed by. Versioned Bases
+// are Resolved to their Immutable Path so Later Updates Don't Affect the Disk
+func BaseImagePath(image string) (string, error) {
+	current := filepath.Join(config.ImagePath, image, currentImage)
+	if _, err := os.Lstat(current); err == nil {
+		return filepath.EvalSymlinks(current)
+	}
+	legacy := filepath.Join(config.ImagePath, image+".qcow2")
+	if _, err := os.Stat(legacy); err != nil {
+		return "", err
+	}
+	return legacy, nil
+}
+
+// List the Base Images Available on this Host
+func ImageInventory() ([]message.ImageInfo, error) {
+	entries, err := os.ReadDir(config.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	images := []message.ImageInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !entry.IsDir() {
+			if !strings.HasSuffix(name, ".qcow2") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			osName := strings.TrimSuffix(name, ".qcow2")
+			_, err = os.Lstat(filepath.Join(config.ImagePath, osName, currentImage))
+			images = append(images, message.ImageInfo{
+				Os:      osName,
+				Version: "legacy",
+				Current: err != nil,
+				Size:    info.Size(),
+			})
+			continue
+		}
+		current, _ := os.Readlink(filepath.Join(config.ImagePath, name, currentImage))
+		versions, err := filepath.Glob(filepath.Join(config.ImagePath, name, "*.qcow2"))
+		if err != nil {
+			continue
+		}
+		for _, version := range versions {
+			base := filepath.Base(version)
+			if base == currentImage || strings.HasPrefix(base, ".") {
+				continue
+			}
+			info, err := os.Stat(version)
+			if err != nil {
+				continue
+			}
+			images = append(images, message.ImageInfo{
+				Os:      name,
+				Version: strings.TrimSuffix(base, ".qcow2"),
+				Current: base == current,
+				Size:    info.Size(),
+			})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Os != images[j].Os {
+			return images[i].Os < images[j].Os
+		}
+		return images[i].Version < images[j].Version
+	})
+	return images, nil
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+var testImage = []byte("QFI\xfb not really a qcow2 image")
+
+func imageServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/debian.qcow2":
+			w.Write(testImage)
+		case "/chunked.qcow2":
+			// No Content-Length, so Only the Copy Limit Catches the Size
+			w.(http.Flusher).Flush()
+			w.Write(testImage)
+		case "/stalled.qcow2":
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchImage(t *testing.T) {
+	server := imageServer(t)
+	good := fmt.Sprintf("sha256:%x", sha256.Sum256(testImage))
+	bad := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("something else")))
+	size := int64(len(testImage))
+	tests := []struct {
+		name     string
+		path     string
+		checksum string
+		maxSize  int64
+		wantErr  error
+		// Expected in the Error Message when there is No Sentinel Error
+		wantText string
+	}{
+		{"valid checksum", "/debian.qcow2", good, size, nil, ""},
+		{"checksum mismatch", "/debian.qcow2", bad, size, ErrChecksumMismatch, ""},
+		{"missing image", "/ubuntu.qcow2", good, size, nil, "404"},
+		{"unsupported algorithm", "/debian.qcow2", "md5:00", size, nil, "unsupported checksum algorithm"},
+		{"malformed checksum", "/debian.qcow2", "sha256", size, nil, "invalid checksum"},
+		{"declared size too large", "/debian.qcow2", good, size - 1, ErrImageTooLarge, ""},
+		{"streamed size too large", "/chunked.qcow2", good, size - 1, ErrImageTooLarge, ""},
+		{"stalled mirror", "/stalled.qcow2", good, size, nil, "Client.Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "image.download")
+			client := server.Client()
+			client.Timeout = 200 * time.Millisecond
+			err := FetchImage(client, server.URL+tt.path, tt.checksum, tt.maxSize, dst)
+			if tt.wantErr == nil && tt.wantText == "" {
+				if err != nil {
+					t.Fatalf("FetchImage: %v", err)
+				}
+				content, err := os.ReadFile(dst)
+				if err != nil || string(content) != string(testImage) {
+					t.Errorf("downloaded image = %q, %v", content, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("FetchImage succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("FetchImage error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantText != "" && !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("FetchImage error = %v, want it to mention %q", err, tt.wantText)
+			}
+			if _, statErr := os.Stat(dst); !os.IsNotExist(statErr) {
+				t.Errorf("failed download left %s behind", dst)
+			}
+		})
+	}
+}
+
+func TestInstallImage(t *testing.T) {
+	server := imageServer(t)
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(testImage))
+	tests := []struct {
+		name     string
+		format   string
+		info     string
+		wantErr  string
+		wantCmds bool
+	}{
+		{"qcow2", "qcow2", `{"format": "qcow2", "virtual-size": 2147483648}`, "", true},
+		{"backing file", "qcow2", `{"format": "qcow2", "backing-filename": "/etc/shadow"}`, "backing file", true},
+		{"undeclared format", "", "", "unsupported image format", false},
+		{"probed format", "vmdk", "", "unsupported image format", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPaths(t)
+			data := &message.ImageData{Os: "debian", Version: "12", URL: server.URL + "/debian.qcow2", Checksum: checksum, Format: tt.format}
+			osDir := filepath.Join(config.ImagePath, "debian")
+			download := filepath.Join(osDir, ".12.download")
+			converted := filepath.Join(osDir, ".12.qcow2")
+			fake := executor.NewFake()
+			if tt.wantCmds {
+				fake.Expect("qemu-img info -f qcow2 --output=json "+download, tt.info, nil)
+			}
+			if tt.wantCmds && tt.wantErr == "" {
+				fake.Expect("qemu-img convert -f qcow2 -O qcow2 "+download+" "+converted, "", nil)
+				// Stand in for the File qemu-img would have Written
+				if err := os.MkdirAll(osDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(converted, testImage, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := InstallImage(zap.NewNop(), fake, data)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("InstallImage: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("InstallImage error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+			_, statErr := os.Stat(filepath.Join(osDir, "current.qcow2"))
+			if installed := statErr == nil; installed != (tt.wantErr == "") {
+				t.Errorf("image installed = %v", installed)
+			}
+		})
+	}
+}
+
+func TestBaseImagePathAndInventory(t *testing.T) {
+	oldConfig := config
+	config.ImagePath = t.TempDir()
+	t.Cleanup(func() { Configure(oldConfig) })
+
+	write := func(name string) {
+		path := filepath.Join(config.ImagePath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, testImage, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ubuntu.qcow2")
+	write("debian.qcow2")
+	write("debian/10.8.qcow2")
+	write("debian/11.0.qcow2")
+	write("debian/.12.0.qcow2")
+	if err := os.Symlink("11.0.qcow2", filepath.Join(config.ImagePath, "debian", currentImage)); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err := BaseImagePath("debian"); err != nil || path != filepath.Join(config.ImagePath, "debian", "11.0.qcow2") {
+		t.Errorf("BaseImagePath(debian) = %q, %v", path, err)
+	}
+	if path, err := BaseImagePath("ubuntu"); err != nil || path != filepath.Join(config.ImagePath, "ubuntu.qcow2") {
+		t.Errorf("BaseImagePath(ubuntu) = %q, %v", path, err)
+	}
+	if _, err := BaseImagePath("rocky"); err == nil {
+		t.Error("BaseImagePath(rocky) succeeded for a missing image")
+	}
+
+	images, err := ImageInventory()
+	if err != nil {
+		t.Fatalf("ImageInventory: %v", err)
+	}
+	want := []string{"debian 10.8 false", "debian 11.0 true", "debian legacy false", "ubuntu legacy true"}
+	if len(images) != len(want) {
+		t.Fatalf("ImageInventory = %+v, want %v", images, want)
+	}
+	for i, image := range images {
+		if got := fmt.Sprintf("%s %s %t", image.Os, image.Version, image.Current); got != want[i] {
+			t.Errorf("image %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
@@ -2,76 +2,76 @@ package utils
 
 import (
 	"fmt"
-	"os/exec"
+	"net"
 	"strings"
 
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
 	"github.com/fosshostorg/aarch64/daemons/internal/message"
 	"go.uber.org/zap"
 )
 
-// Create the Bridge Network if Not Already Present and Start it Either Way
-func CreateAndStartBridge(l *zap.Logger, data *message.VMData) error {
-	// Check if Domain Interface Already Exists. If not, Create Bridge
-	output, err := exec.Command("ip", "addr", "show").Output()
-	if err != nil {
-		l.Error(
-			"unable to access system interfaces",
-			zap.String("command", "ip addr show"),
-			zap.Error(err),
-		)
-		return err
-	}
+// Create the Bridge Network if Not Already Present and Start it Either Way.
+// created Reports Whether this Call Added the Bridge, so Rolling Back Only
+// Removes Bridges it Owns
+func CreateAndStartBridge(l *zap.Logger, ex executor.Executor, data *message.VMData) (created bool, err error) {
 	interfaceName := fmt.Sprintf("vbr%d", data.Index)
-	if !strings.Contains(string(output), interfaceName) {
-		// Delete Possibly Existing Bridge Network
-		exec.Command("ip", "link", "del", interfaceName).Output()
+	if exists, _ := LinkState(ex, interfaceName); !exists {
 		// Create New Bridge Network
-		if _, err = exec.Command("ip", "link", "add", interfaceName, "type", "bridge").Output(); err != nil {
+		if _, err = ex.Output("ip", "link", "add", interfaceName, "type", "bridge"); err != nil {
 			l.Error(
 				"unable to create network virtual bridge",
 				zap.String("command", "ip link add "+interfaceName+" type bridge"),
 				zap.Error(err),
 			)
-			return err
+			return false, err
 		}
+		created = true
 		// Give the New Bridge an IP Assignment
-		if _, err = exec.Command("ip", "addr", "add", "dev", interfaceName, fmt.Sprintf("%s/64", data.Gateway)).Output(); err != nil {
+		if _, err = ex.Output("ip", "addr", "add", "dev", interfaceName, fmt.Sprintf("%s/64", data.Gateway)); err != nil {
 			l.Error(
 				"unable to assign ip address to new network bridge",
 				zap.String("command", "ip addr add dev "+interfaceName+" "+data.Gateway+"/64"),
 				zap.Error(err),
 			)
-			return err
-		}
-		// Start the Bridge Network
-		if _, err = exec.Command("ip", "link", "set", "dev", interfaceName, "up").Output(); err != nil {
-			l.Error(
-				"unable to start network bridge",
-				zap.String("command", "ip link set dev "+interfaceName+" up"),
-				zap.Error(err),
-			)
-			return err
+			return created, err
 		}
-	} else {
-		if _, err = exec.Command("ip", "link", "set", "dev", interfaceName, "up").Output(); err != nil {
+	}
+	// Start the Bridge Network
+	if _, err = ex.Output("ip", "link", "set", "dev", interfaceName, "up"); err != nil {
+		l.Error(
+			"unable to start network bridge",
+			zap.String("command", "ip link set dev "+interfaceName+" up"),
+			zap.Error(err),
+		)
+		return created, err
+	}
+	// Route Additional Prefixes to the VM, Replacing Routes Left Over
+	address := strings.SplitN(data.Address, "/", 2)[0]
+	for _, route := range data.Routes {
+		if output, err := ex.CombinedOutput("ip", "-6", "route", "replace", route, "via", address, "dev", interfaceName); err != nil {
 			l.Error(
-				"unable to restart network bridge",
-				zap.String("command", "ip link set dev "+interfaceName+" up"),
+				"unable to route prefix to domain",
+				zap.String("command", fmt.Sprintf("ip -6 route replace %s via %s dev %s", route, address, interfaceName)),
+				zap.ByteString("output", output),
 				zap.Error(err),
 			)
-			return err
+			return created, err
 		}
 	}
-	return nil
+	// Install or Repair the Source Filter Keeping the VM to its Own Addresses
+	if !SpoofFilterInstalled(ex, data) {
+		l.Info("Installing Source Filter", zap.String("network", interfaceName))
+		return created, ApplySpoofFilter(l, ex, data)
+	}
+	return created, nil
 }
 
-func DeleteBridge(l *zap.Logger, data *message.VMData) error {
+func DeleteBridge(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
 	bridgeNet := fmt.Sprintf("vbr%d", data.Index)
+	// Remove the Source Filter Even if the Bridge is Already Gone
+	RemoveSpoofFilter(l, ex, data)
 	// Check if Bridge Exists
-	if output, err := exec.Command(
-		"ls",
-		"/sys/class/net",
-	).Output(); err != nil || !strings.Contains(string(output), bridgeNet) {
+	if exists, _ := LinkState(ex, bridgeNet); !exists {
 		l.Error(
 			"bridge network does not exist",
 			zap.String("network", bridgeNet),
@@ -79,9 +79,9 @@ func DeleteBridge(l *zap.Logger, data *message.VMData) error {
 		return nil
 	}
 	// Delete Bridge
-	if output, err := exec.Command(
+	if output, err := ex.Output(
 		"ip", "link", "del", bridgeNet,
-	).Output(); err != nil {
+	); err != nil {
 		l.Error(
 			"bridge network could not be deleted",
 			zap.String("command", fmt.Sprintf("ip link del %s", bridgeNet)),
@@ -92,3 +92,142 @@ func DeleteBridge(l *zap.Logger, data *message.VMData) error {
 	}
 	return nil
 }
+
+// Whether a Network Device Exists, and is Administratively Up
+func LinkState(ex executor.Executor, device string) (exists bool, up bool) {
+	output, err := ex.Output("ip", "link", "show", "dev", device)
+	if err != nil {
+		return false, false
+	}
+	// e.g. "5: vbr4: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 ..."
+	line := string(output)
+	if start, end := strings.Index(line, "<"), strings.Index(line, ">"); start >= 0 && end > start {
+		for _, flag := range strings.Split(line[start+1:end], ",") {
+			if flag == "UP" {
+				return true, true
+			}
+		}
+	}
+	return true, false
+}
+
+// All Interfaces of a Domain, Starting with the Primary One. Domains
+// Without Additional Interfaces Only Have the Primary One
+func Interfaces(data *message.VMData) []message.Interface {
+	interfaces := []message.Interface{{
+		Index:   data.Index,
+		Prefix:  data.Prefix,
+		MAC:     data.MAC,
+		Gateway: data.Gateway,
+		Address: data.Address,
+		Routes:  data.Routes,
+	}}
+	return append(interfaces, data.Interfaces...)
+}
+
+// EUI-64 Link-Local Address a Guest Derives from its Interface's MAC, or an
+// Empty String for an Invalid MAC
+func LinkLocalAddress(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return ""
+	}
+	ip := net.IP{0xfe, 0x80, 0, 0, 0, 0, 0, 0, hw[0] ^ 0x02, hw[1], hw[2], 0xff, 0xfe, hw[3], hw[4], hw[5]}
+	return ip.String()
+}
+
+// Domain Data Describing a Single Interface, for the Per-Bridge Helpers that
+// Read the Bridge Index, Addresses and MAC from VMData
+func InterfaceData(data *message.VMData, iface *message.Interface) *message.VMData {
+	ifaceData := *data
+	ifaceData.Index = iface.Index
+	ifaceData.Prefix = iface.Prefix
+	ifaceData.MAC = iface.MAC
+	ifaceData.Gateway = iface.Gateway
+	ifaceData.Address = iface.Address
+	ifaceData.Routes = iface.Routes
+	// Routes Need a Next Hop the Guest Answers for, which on a Hot Plugged
+	// Interface is its EUI-64 Link-Local Address Rather than the Static One
+	if iface.Hotplugged {
+		ifaceData.Address = LinkLocalAddress(iface.MAC) + "/64"
+	}
+	// The IPv4 Address is Only Mapped to the Primary Interface
+	ifaceData.IPv4Address = ""
+	ifaceData.Interfaces = nil
+	return &ifaceData
+}
+
+// Check Additional Interfaces Use Distinct Bridges and Valid Addresses
+func ValidateInterfaces(data *message.VMData) error {
+	bridges := map[int]bool{data.Index: true}
+	for i, iface := range data.Interfaces {
+		if iface.Index <= 0 || bridges[iface.Index] {
+			return fmt.Errorf("interface %d: bridge index %d is invalid or already in use", i, iface.Index)
+		}
+		bridges[iface.Index] = true
+		if err := validateInterface(&iface); err != nil {
+			return fmt.Errorf("interface %d: %w", i, err)
+		}
+	}
+	for _, route := range data.Routes {
+		if ip, _, err := net.ParseCIDR(route); err != nil || ip.To4() != nil {
+			return fmt.Errorf("route %q is not an ipv6 prefix", route)
+		}
+	}
+	return nil
+}
+
+func validateInterface(iface *message.Interface) error {
+	if _, err := net.ParseMAC(iface.MAC); err != nil {
+		return fmt.Errorf("invalid mac address %q", iface.MAC)
+	}
+	for _, cidr := range append([]string{iface.Prefix, iface.Address}, iface.Routes...) {
+		if ip, _, err := net.ParseCIDR(cidr); err != nil || ip.To4() != nil {
+			return fmt.Errorf("%q is not an ipv6 prefix", cidr)
+		}
+	}
+	if ip := net.ParseIP(iface.Gateway); ip == nil || ip.To4() != nil {
+		return fmt.Errorf("invalid gateway %q", iface.Gateway)
+	}
+	return nil
+}
+
+// Hot Plug an Interface on a Bridge into a Domain, Keeping it in the
+// Domain Definition Across Restarts
+func AttachInterface(l *zap.Logger, ex executor.Executor, data *message.VMData, bridge string, mac string) error {
+	if output, err := ex.CombinedOutput(
+		"virsh", "attach-interface", data.ID,
+		"bridge", bridge,
+		"--model", "virtio",
+		"--mac", mac,
+		"--persistent",
+	); err != nil {
+		l.Error(
+			"unable to attach interface",
+			zap.String("command", fmt.Sprintf("virsh attach-interface %s bridge %s --model virtio --mac %s --persistent", data.ID, bridge, mac)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Unplug an Interface from a Domain, Ignoring One that is Already Gone
+func DetachInterface(l *zap.Logger, ex executor.Executor, data *message.VMData, mac string) error {
+	if output, err := ex.CombinedOutput(
+		"virsh", "detach-interface", data.ID,
+		"bridge",
+		"--mac", mac,
+		"--persistent",
+	); err != nil && !strings.Contains(string(output), "No interface found") {
+		l.Error(
+			"unable to detach interface",
+			zap.String("command", fmt.Sprintf("virsh detach-interface %s bridge --mac %s --persistent", data.ID, mac)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Listing of an Installed Source Filter, as Printed by nft
+const installedSpoofChain = `table bridge hydrogen {
+	chain spoof4 {
+		ether saddr != 52:54:00:00:00:04 drop
+		arp saddr ether != 52:54:00:00:00:04 drop
+		icmpv6 type nd-router-advert drop
+		ip6 saddr != { ::, 2001:db8:0:4::/64, fe80::/10 } drop
+		ip saddr != 0.0.0.0 drop
+		arp saddr ip != 0.0.0.0 drop
+	}
+}
+`
+
+func TestCreateAndStartBridge(t *testing.T) {
+	linkFailed := errors.New("exit status 2")
+	tests := []struct {
+		name        string
+		expect      func(*executor.Fake)
+		wantCreated bool
+		wantErr     bool
+	}{
+		{
+			"new bridge",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", `Device "vbr4" does not exist.`, errors.New("exit status 1"))
+				f.Expect("ip link add vbr4 type bridge", "", nil)
+				f.Expect("ip addr add dev vbr4 2001:db8:0:4::1/64", "", nil)
+				f.Expect("ip link set dev vbr4 up", "", nil)
+				f.Expect("nft list chain bridge hydrogen spoof4", "", errors.New("exit status 1"))
+				f.Expect("nft -f "+tempPath(debianVM().ID, "spoof.nft"), "", nil)
+			},
+			true,
+			false,
+		},
+		{
+			"existing bridge",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST> mtu 1500", nil)
+				f.Expect("ip link set dev vbr4 up", "", nil)
+				f.Expect("nft list chain bridge hydrogen spoof4", installedSpoofChain, nil)
+			},
+			false,
+			false,
+		},
+		{
+			"stale source filter",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST> mtu 1500", nil)
+				f.Expect("ip link set dev vbr4 up", "", nil)
+				f.Expect("nft list chain bridge hydrogen spoof4", strings.Replace(installedSpoofChain, "2001:db8:0:4::/64", "2001:db8:0:9::/64", 1), nil)
+				f.Expect("nft -f "+tempPath(debianVM().ID, "spoof.nft"), "", nil)
+			},
+			false,
+			false,
+		},
+		{
+			"add fails",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", `Device "vbr4" does not exist.`, errors.New("exit status 1"))
+				f.Expect("ip link add vbr4 type bridge", "", linkFailed)
+			},
+			false,
+			true,
+		},
+		{
+			"address fails after creating",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", `Device "vbr4" does not exist.`, errors.New("exit status 1"))
+				f.Expect("ip link add vbr4 type bridge", "", nil)
+				f.Expect("ip addr add dev vbr4 2001:db8:0:4::1/64", "", linkFailed)
+			},
+			true,
+			true,
+		},
+	}
+	testPaths(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := executor.NewFake()
+			tt.expect(fake)
+			created, err := CreateAndStartBridge(zap.NewNop(), fake, debianVM())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateAndStartBridge error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if created != tt.wantCreated {
+				t.Errorf("CreateAndStartBridge created = %t, want %t", created, tt.wantCreated)
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeleteBridge(t *testing.T) {
+	tests := []struct {
+		name    string
+		expect  func(*executor.Fake)
+		wantErr bool
+	}{
+		{
+			"existing bridge",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST> mtu 1500", nil)
+				f.Expect("ip link del vbr4", "", nil)
+			},
+			false,
+		},
+		{
+			"missing bridge",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", `Device "vbr4" does not exist.`, errors.New("exit status 1"))
+			},
+			false,
+		},
+		{
+			"delete fails",
+			func(f *executor.Fake) {
+				f.Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST> mtu 1500", nil)
+				f.Expect("ip link del vbr4", "", errors.New("exit status 2"))
+			},
+			true,
+		},
+	}
+	testPaths(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := executor.NewFake()
+			fake.Expect("nft -f "+tempPath(debianVM().ID, "spoof.nft"), "", nil)
+			tt.expect(fake)
+			err := DeleteBridge(zap.NewNop(), fake, debianVM())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DeleteBridge error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := fake.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Debian VM with a Routed Prefix and a Second Interface on vbr9
+func multihomedVM() *message.VMData {
+	data := debianVM()
+	data.Routes = []string{"2001:db8:100::/56"}
+	data.Interfaces = []message.Interface{{
+		Index:   9,
+		Prefix:  "2001:db8:0:9::/64",
+		MAC:     "52:54:00:00:00:09",
+		Gateway: "2001:db8:0:9::1",
+		Address: "2001:db8:0:9::2/64",
+	}}
+	return data
+}
+
+func TestInterfaces(t *testing.T) {
+	legacy := debianVM()
+	if got := Interfaces(legacy); len(got) != 1 || got[0].Index != 4 || got[0].MAC != legacy.MAC || got[0].Address != legacy.Address {
+		t.Errorf("Interfaces of a single homed domain = %+v", got)
+	}
+
+	data := multihomedVM()
+	interfaces := Interfaces(data)
+	if len(interfaces) != 2 || interfaces[0].Routes[0] != "2001:db8:100::/56" || interfaces[1].Index != 9 {
+		t.Fatalf("Interfaces = %+v", interfaces)
+	}
+	second := InterfaceData(data, &interfaces[1])
+	if second.ID != data.ID || second.Index != 9 || second.Gateway != "2001:db8:0:9::1" || second.Routes != nil || second.Interfaces != nil {
+		t.Errorf("InterfaceData = %+v", second)
+	}
+	if data.Index != 4 {
+		t.Error("InterfaceData modified the domain")
+	}
+}
+
+func TestValidateInterfaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*message.VMData)
+		wantErr bool
+	}{
+		{"valid", func(*message.VMData) {}, false},
+		{"primary bridge reused", func(d *message.VMData) { d.Interfaces[0].Index = 4 }, true},
+		{"bridge reused", func(d *message.VMData) { d.Interfaces = append(d.Interfaces, d.Interfaces[0]) }, true},
+		{"missing mac", func(d *message.VMData) { d.Interfaces[0].MAC = "" }, true},
+		{"ipv4 address", func(d *message.VMData) { d.Interfaces[0].Address = "192.0.2.2/24" }, true},
+		{"bad gateway", func(d *message.VMData) { d.Interfaces[0].Gateway = "vbr9" }, true},
+		{"bad route", func(d *message.VMData) { d.Routes = []string{"2001:db8:100::/56 via ::1"} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := multihomedVM()
+			tt.modify(data)
+			if err := ValidateInterfaces(data); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateInterfaces error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateAndStartBridgeRoutes(t *testing.T) {
+	testPaths(t)
+	data := multihomedVM()
+	fake := executor.NewFake().
+		Expect("ip link show dev vbr4", "7: vbr4: <BROADCAST,MULTICAST> mtu 1500", nil).
+		Expect("ip link set dev vbr4 up", "", nil).
+		Expect("ip -6 route replace 2001:db8:100::/56 via 2001:db8:0:4::2 dev vbr4", "", nil).
+		Expect("nft list chain bridge hydrogen spoof4", installedSpoofChain, nil).
+		Expect("nft -f "+tempPath(data.ID, "spoof.nft"), "", nil)
+	if _, err := CreateAndStartBridge(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("CreateAndStartBridge: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLinkLocalAddress(t *testing.T) {
+	tests := map[string]string{
+		"52:54:00:00:00:09": "fe80::5054:ff:fe00:9",
+		"02:00:5e:10:20:30": "fe80::5eff:fe10:2030",
+		"not a mac":         "",
+	}
+	for mac, want := range tests {
+		if got := LinkLocalAddress(mac); got != want {
+			t.Errorf("LinkLocalAddress(%q) = %q, want %q", mac, got, want)
+		}
+	}
+}
+
+// Routes of a Hot Plugged Interface go Via the Guest's Link-Local Address,
+// as the Guest Never Configures the Static One
+func TestCreateAndStartBridgeHotpluggedRoutes(t *testing.T) {
+	testPaths(t)
+	data := multihomedVM()
+	data.Interfaces[0].Hotplugged = true
+	data.Interfaces[0].Routes = []string{"2001:db8:200::/56"}
+	ifaceData := InterfaceData(data, &data.Interfaces[0])
+	fake := executor.NewFake().
+		Expect("ip link show dev vbr9", "8: vbr9: <BROADCAST,MULTICAST,UP> mtu 1500", nil).
+		Expect("ip link set dev vbr9 up", "", nil).
+		Expect("ip -6 route replace 2001:db8:200::/56 via fe80::5054:ff:fe00:9 dev vbr9", "", nil).
+		Expect("nft list chain bridge hydrogen spoof9", "", errors.New("exit status 1")).
+		Expect("nft -f "+tempPath(data.ID, "spoof.nft"), "", nil)
+	if _, err := CreateAndStartBridge(zap.NewNop(), fake, ifaceData); err != nil {
+		t.Fatalf("CreateAndStartBridge: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttachDetachInterface(t *testing.T) {
+	data := multihomedVM()
+	mac := data.Interfaces[0].MAC
+	fake := executor.NewFake().
+		Expect("virsh attach-interface "+data.ID+" bridge vbr9 --model virtio --mac 52:54:00:00:00:09 --persistent", "Interface attached successfully", nil).
+		Expect("virsh detach-interface "+data.ID+" bridge --mac 52:54:00:00:00:09 --persistent", "error: No interface found whose type is bridge and MAC address is 52:54:00:00:00:09", errors.New("exit status 1")).
+		Expect("virsh detach-interface "+data.ID+" bridge --mac 52:54:00:00:00:09 --persistent", "error: Failed to detach interface", errors.New("exit status 1"))
+	if err := AttachInterface(zap.NewNop(), fake, data, "vbr9", mac); err != nil {
+		t.Errorf("AttachInterface: %v", err)
+	}
+	if err := DetachInterface(zap.NewNop(), fake, data, mac); err != nil {
+		t.Errorf("DetachInterface of a missing interface: %v", err)
+	}
+	if err := DetachInterface(zap.NewNop(), fake, data, mac); err == nil {
+		t.Error("DetachInterface succeeded although virsh failed")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNetworkConfigInterfaces(t *testing.T) {
+	profile := debianProfile(t)
+	var netplan bytes.Buffer
+	if err := profile.networkConfig.Execute(&netplan, newTemplateData(profile, multihomedVM())); err != nil {
+		t.Fatal(err)
+	}
+	want := `  eth1:
+     match:
+       macaddress: "52:54:00:00:00:09"
+     set-name: eth1
+     addresses:
+       - 2001:db8:0:9::2/64
+`
+	if !strings.HasSuffix(netplan.String(), want) {
+		t.Errorf("netplan does not configure the second interface:\n%s", netplan.String())
+	}
+
+	bsd := freebsdVM()
+	bsd.Interfaces = multihomedVM().Interfaces
+	files, err := RenderConfigDrive(freebsdProfile(t), bsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(files[configDriveUserData]), `ifconfig_vtnet1_ipv6="inet6 2001:db8:0:9::2 prefixlen 64"`) {
+		t.Error("freebsd rc.conf does not configure the second interface")
+	}
+}
+
+func TestLinkState(t *testing.T) {
+	fake := executor.NewFake().
+		Expect("ip link show dev vbr4", "5: vbr4: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT", nil).
+		Expect("ip link show dev vbr9", "9: vbr9: <BROADCAST,MULTICAST> mtu 1500 qdisc noop state DOWN mode DEFAULT", nil).
+		Expect("ip link show dev vbr7", `Device "vbr7" does not exist.`, errors.New("exit status 1"))
+	for _, tt := range []struct {
+		device     string
+		exists, up bool
+	}{
+		{"vbr4", true, true},
+		{"vbr9", true, false},
+		{"vbr7", false, false},
+	} {
+		if exists, up := LinkState(fake, tt.device); exists != tt.exists || up != tt.up {
+			t.Errorf("LinkState(%s) = %v, %v, want %v, %v", tt.device, exists, up, tt.exists, tt.up)
+		}
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
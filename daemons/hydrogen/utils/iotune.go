@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+// A libvirt iotune Setting, Named as in the Domain XML
+type IOTuneSetting struct {
+	Name  string
+	Value uint64
+}
+
+func ValidateIOTune(tune *message.IOTune) error {
+	if tune.ReadIOPS < 0 || tune.WriteIOPS < 0 || tune.ReadMBps < 0 || tune.WriteMBps < 0 {
+		return fmt.Errorf("disk i/o limits must not be negative")
+	}
+	return nil
+}
+
+// Every Setting a Limit Maps to, Including Zero Ones, which Clear a
+// Limit When Set on a Running Domain
+func IOTuneSettings(tune *message.IOTune) []IOTuneSetting {
+	return []IOTuneSetting{
+		{"read_iops_sec", uint64(tune.ReadIOPS)},
+		{"write_iops_sec", uint64(tune.WriteIOPS)},
+		{"read_bytes_sec", uint64(tune.ReadMBps) << 20},
+		{"write_bytes_sec", uint64(tune.WriteMBps) << 20},
+	}
+}
+
+// Suffix for a virt-install --disk Option, Empty Without Limits
+func iotuneDiskOptions(tune *message.IOTune) string {
+	options := ""
+	for _, setting := range IOTuneSettings(tune) {
+		if setting.Value > 0 {
+			options += fmt.Sprintf(",iotune.%s=%d", setting.Name, setting.Value)
+		}
+	}
+	return options
+}
+
+// iotune Element for a Disk's Device XML, Empty Without Limits
+func iotuneXML(tune *message.IOTune) string {
+	elements := []string{}
+	for _, setting := range IOTuneSettings(tune) {
+		if setting.Value > 0 {
+			elements = append(elements, fmt.Sprintf("<%s>%d</%s>", setting.Name, setting.Value, setting.Name))
+		}
+	}
+	if len(elements) == 0 {
+		return ""
+	}
+	return "<iotune>" + strings.Join(elements, "") + "</iotune>"
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func TestIOTuneDiskOptions(t *testing.T) {
+	tests := []struct {
+		tune message.IOTune
+		want string
+	}{
+		{message.IOTune{}, ""},
+		{message.IOTune{ReadIOPS: 1000, WriteIOPS: 500}, ",iotune.read_iops_sec=1000,iotune.write_iops_sec=500"},
+		{message.IOTune{ReadMBps: 200, WriteMBps: 1}, ",iotune.read_bytes_sec=209715200,iotune.write_bytes_sec=1048576"},
+	}
+	for _, tt := range tests {
+		if got := iotuneDiskOptions(&tt.tune); got != tt.want {
+			t.Errorf("iotuneDiskOptions(%+v) = %q, want %q", tt.tune, got, tt.want)
+		}
+	}
+}
+
+func TestIOTuneSettingsClearUnsetLimits(t *testing.T) {
+	settings := IOTuneSettings(&message.IOTune{WriteIOPS: 10})
+	if len(settings) != 4 {
+		t.Fatalf("IOTuneSettings = %+v, want all four settings", settings)
+	}
+	for _, setting := range settings {
+		if (setting.Name == "write_iops_sec") != (setting.Value != 0) {
+			t.Errorf("IOTuneSettings = %+v", settings)
+		}
+	}
+	if err := ValidateIOTune(&message.IOTune{ReadMBps: -1}); err == nil {
+		t.Error("ValidateIOTune accepted a negative limit")
+	}
+}
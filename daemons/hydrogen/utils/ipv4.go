@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+var ErrIPv4PoolExhausted = errors.New("ipv4 pool exhausted")
+
+// Markers Around the Part of tayga.conf Owned by Hydrogen
+const (
+	taygaBegin = "# BEGIN hydrogen managed maps"
+	taygaEnd   = "# END hydrogen managed maps"
+)
+
+// First Address of the Pool Not Already Taken. Pool Entries are Single
+// Addresses or CIDR Blocks, Searched in Order. The Network and Broadcast
+// Addresses of Blocks Larger than a /31 are Never Handed Out
+func AllocateIPv4(pool []string, taken []string) (string, error) {
+	used := make(map[string]bool, len(taken))
+	for _, address := range taken {
+		used[address] = true
+	}
+	for _, entry := range pool {
+		if !strings.Contains(entry, "/") {
+			entry += "/32"
+		}
+		ip, network, err := net.ParseCIDR(entry)
+		if err != nil || ip.To4() == nil {
+			return "", fmt.Errorf("invalid ipv4 pool entry %q", entry)
+		}
+		ones, _ := network.Mask.Size()
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = network.IP.To4()[i] | ^network.Mask[i]
+		}
+		for ip := network.IP.To4(); network.Contains(ip); ip = nextIPv4(ip) {
+			reserved := ones < 31 && (ip.Equal(network.IP) || ip.Equal(broadcast))
+			if !reserved && !used[ip.String()] {
+				return ip.String(), nil
+			}
+			if ip.Equal(net.IPv4bcast) {
+				break
+			}
+		}
+	}
+	return "", ErrIPv4PoolExhausted
+}
+
+func nextIPv4(ip net.IP) net.IP {
+	next := make(net.IP, net.IPv4len)
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// IPv4 to IPv6 Maps for Every Domain with an IPv4 Address
+func IPv4Mappings(domains map[string]message.VMData) map[string]string {
+	mappings := make(map[string]string)
+	for _, data := range domains {
+		if data.IPv4Address != "" {
+			mappings[data.IPv4Address] = strings.SplitN(data.Address, "/", 2)[0]
+		}
+	}
+	return mappings
+}
+
+// Replace the Hydrogen Managed Block of a tayga.conf with a map Line per
+// Mapping, Appending the Block if it is Not There Yet
+func RenderTaygaConfig(conf string, mappings map[string]string) string {
+	ipv4s := make([]string, 0, len(mappings))
+	for ipv4 := range mappings {
+		ipv4s = append(ipv4s, ipv4)
+	}
+	sort.Strings(ipv4s)
+	block := []string{taygaBegin}
+	for _, ipv4 := range ipv4s {
+		block = append(block, fmt.Sprintf("map %s %s", ipv4, mappings[ipv4]))
+	}
+	block = append(block, taygaEnd)
+
+	lines := []string{}
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimRight(conf, "\n"), "\n") {
+		switch {
+		case line == taygaBegin:
+			inBlock = true
+		case line == taygaEnd:
+			inBlock = false
+		case !inBlock && (line != "" || len(lines) > 0):
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(append(lines, block...), "\n") + "\n"
+}
+
+// IPv4 to IPv6 Maps in the Hydrogen Managed Block of a tayga.conf
+func ParseTaygaMappings(conf string) map[string]string {
+	mappings := make(map[string]string)
+	inBlock := false
+	for _, line := range strings.Split(conf, "\n") {
+		switch line {
+		case taygaBegin:
+			inBlock = true
+		case taygaEnd:
+			inBlock = false
+		default:
+			if fields := strings.Fields(line); inBlock && len(fields) == 3 && fields[0] == "map" {
+				mappings[fields[1]] = fields[2]
+			}
+		}
+	}
+	return mappings
+}
+
+// Maps Hydrogen has Written to tayga.conf, which Outlive the Domain Cache
+func ReadTaygaMappings(l *zap.Logger) (map[string]string, error) {
+	conf, err := os.ReadFile(config.TaygaConfigPath)
+	if err != nil {
+		l.Error("unable to read tayga config", zap.String("path", config.TaygaConfigPath), zap.Error(err))
+		return nil, err
+	}
+	return ParseTaygaMappings(string(conf)), nil
+}
+
+// Write the Mappings into tayga.conf and Restart Tayga if they Changed
+func WriteTaygaMappings(l *zap.Logger, ex executor.Executor, mappings map[string]string) error {
+	conf, err := os.ReadFile(config.TaygaConfigPath)
+	if err != nil {
+		l.Error("unable to read tayga config", zap.String("path", config.TaygaConfigPath), zap.Error(err))
+		return err
+	}
+	rendered := []byte(RenderTaygaConfig(string(conf), mappings))
+	if bytes.Equal(conf, rendered) {
+		return nil
+	}
+	tmpPath := config.TaygaConfigPath + ".tmp"
+	if err = os.WriteFile(tmpPath, rendered, 0644); err == nil {
+		err = os.Rename(tmpPath, config.TaygaConfigPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		l.Error("unable to write tayga config", zap.String("path", config.TaygaConfigPath), zap.Error(err))
+		return err
+	}
+	if output, err := ex.CombinedOutput("systemctl", "restart", config.TaygaService); err != nil {
+		l.Error(
+			"unable to restart tayga",
+			zap.String("command", "systemctl restart "+config.TaygaService),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Route the Domain's IPv4 Address into the NAT64 Interface
+func AddIPv4Route(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if output, err := ex.CombinedOutput(
+		"ip", "route", "replace", data.IPv4Address+"/32", "dev", config.NAT64Interface,
+	); err != nil {
+		l.Error(
+			"unable to add ipv4 route",
+			zap.String("command", fmt.Sprintf("ip route replace %s/32 dev %s", data.IPv4Address, config.NAT64Interface)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Remove the Domain's IPv4 Route, Ignoring One that is Already Gone
+func DeleteIPv4Route(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if output, err := ex.CombinedOutput(
+		"ip", "route", "del", data.IPv4Address+"/32", "dev", config.NAT64Interface,
+	); err != nil && !strings.Contains(string(output), "No such process") {
+		l.Error(
+			"unable to delete ipv4 route",
+			zap.String("command", fmt.Sprintf("ip route del %s/32 dev %s", data.IPv4Address, config.NAT64Interface)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"go.uber.org/zap"
+)
+
+func TestAllocateIPv4(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    []string
+		taken   []string
+		want    string
+		wantErr bool
+	}{
+		{"single addresses", []string{"192.0.2.10", "192.0.2.11"}, []string{"192.0.2.10"}, "192.0.2.11", false},
+		{"first free in block", []string{"192.0.2.0/29"}, []string{"192.0.2.1", "192.0.2.3"}, "192.0.2.2", false},
+		{"skips network address", []string{"203.0.113.0/24"}, nil, "203.0.113.1", false},
+		{"skips broadcast address", []string{"192.0.2.0/30", "198.51.100.7"}, []string{"192.0.2.1", "192.0.2.2"}, "198.51.100.7", false},
+		{"point to point block", []string{"192.0.2.0/31"}, nil, "192.0.2.0", false},
+		{"next block", []string{"192.0.2.0/31", "198.51.100.7/32"}, []string{"192.0.2.0", "192.0.2.1"}, "198.51.100.7", false},
+		{"exhausted", []string{"192.0.2.0/31"}, []string{"192.0.2.0", "192.0.2.1"}, "", true},
+		{"empty pool", nil, nil, "", true},
+		{"ipv6 entry", []string{"2001:db8::/64"}, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AllocateIPv4(tt.pool, tt.taken)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("AllocateIPv4 = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTaygaConfig(t *testing.T) {
+	base := "tun-device nat64\nipv4-addr 192.168.255.1\nprefix 64:ff9b::/96\n"
+	mappings := map[string]string{
+		"192.0.2.11": "2001:db8:0:5::2",
+		"192.0.2.10": "2001:db8:0:4::2",
+	}
+	want := base + taygaBegin + "\nmap 192.0.2.10 2001:db8:0:4::2\nmap 192.0.2.11 2001:db8:0:5::2\n" + taygaEnd + "\n"
+
+	rendered := RenderTaygaConfig(base, mappings)
+	if rendered != want {
+		t.Fatalf("RenderTaygaConfig =\n%s\nwant\n%s", rendered, want)
+	}
+	// Rendering Again Replaces the Block Instead of Appending Another
+	delete(mappings, "192.0.2.11")
+	rendered = RenderTaygaConfig(rendered, mappings)
+	if strings.Count(rendered, taygaBegin) != 1 || strings.Contains(rendered, "192.0.2.11") {
+		t.Errorf("re-rendered config:\n%s", rendered)
+	}
+	if !strings.HasPrefix(rendered, base) {
+		t.Errorf("re-rendered config lost the static settings:\n%s", rendered)
+	}
+}
+
+func TestParseTaygaMappings(t *testing.T) {
+	conf := "tun-device nat64\nmap 192.0.2.99 2001:db8::99\n" + taygaBegin +
+		"\nmap 192.0.2.10 2001:db8:0:4::2\nmap 192.0.2.11 2001:db8:0:5::2\n" + taygaEnd + "\n"
+	want := map[string]string{"192.0.2.10": "2001:db8:0:4::2", "192.0.2.11": "2001:db8:0:5::2"}
+	if got := ParseTaygaMappings(conf); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTaygaMappings = %v, want %v", got, want)
+	}
+	// Parsing is the Inverse of Rendering
+	if got := ParseTaygaMappings(RenderTaygaConfig(conf, want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTaygaMappings of rendered config = %v, want %v", got, want)
+	}
+}
+
+func TestWriteTaygaMappings(t *testing.T) {
+	oldConfig := config
+	config.TaygaConfigPath = filepath.Join(t.TempDir(), "tayga.conf")
+	config.TaygaService = "tayga"
+	t.Cleanup(func() { Configure(oldConfig) })
+	if err := os.WriteFile(config.TaygaConfigPath, []byte("tun-device nat64\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mappings := map[string]string{"192.0.2.10": "2001:db8:0:4::2"}
+
+	fake := executor.NewFake().Expect("systemctl restart tayga", "", nil)
+	if err := WriteTaygaMappings(zap.NewNop(), fake, mappings); err != nil {
+		t.Fatalf("WriteTaygaMappings: %v", err)
+	}
+	// Unchanged Mappings do Not Restart Tayga
+	if err := WriteTaygaMappings(zap.NewNop(), fake, mappings); err != nil {
+		t.Fatalf("WriteTaygaMappings: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	conf, _ := os.ReadFile(config.TaygaConfigPath)
+	if !strings.Contains(string(conf), "map 192.0.2.10 2001:db8:0:4::2") {
+		t.Errorf("tayga.conf =\n%s", conf)
+	}
+}
+
+func TestNetworkConfigIPv4(t *testing.T) {
+	profile := debianProfile(t)
+	data := debianVM()
+	data.IPv4Address = "192.0.2.10"
+	var netplan bytes.Buffer
+	if err := profile.networkConfig.Execute(&netplan, &templateData{VMData: data, Profile: profile}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(netplan.String(), "- 2001:db8:0:4::2/64\n       - 192.0.2.10/32\n") {
+		t.Errorf("netplan does not carry the ipv4 address:\n%s", netplan.String())
+	}
+
+	bsd := freebsdVM()
+	bsd.IPv4Address = "192.0.2.10"
+	files, err := RenderConfigDrive(freebsdProfile(t), bsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(files["openstack/latest/user_data"]), `ifconfig_vtnet0_alias0="inet 192.0.2.10/32"`) {
+		t.Error("freebsd rc.conf does not carry the ipv4 address")
+	}
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+// Namespace and Prefix of Hydrogen's Element in a Domain's <metadata>
+const (
+	MetadataURI = "https://aarch64.com/xmlns/hydrogen/1"
+	MetadataKey = "hydrogen"
+)
+
+// Everything Needed to Take a Domain Back Under Management if the Domain
+// Cache is Lost. Volumes are Recovered from the Domain's Disks Instead
+type domainMetadata struct {
+	XMLName     xml.Name                `xml:"vm"`
+	ID          string                  `xml:"id,attr"`
+	Project     string                  `xml:"project,attr"`
+	Pop         string                  `xml:"pop,attr"`
+	Os          string                  `xml:"os,attr"`
+	Hostname    string                  `xml:"hostname,attr"`
+	IPv4Address string                  `xml:"ipv4_address,attr,omitempty"`
+	Rescued     bool                    `xml:"rescued,attr,omitempty"`
+	Plan        metadataPlan            `xml:"plan"`
+	Primary     message.Interface       `xml:"primary"`
+	Interfaces  []message.Interface     `xml:"interface"`
+	Networks    []message.NetworkMember `xml:"member"`
+	Firewall    message.Firewall        `xml:"firewall"`
+	Bandwidth   message.Bandwidth       `xml:"bandwidth"`
+	IOTune      message.IOTune          `xml:"iotune"`
+}
+
+type metadataPlan struct {
+	Vcpus  int `xml:"vcpus,attr"`
+	Memory int `xml:"memory,attr"` // GB
+	Ssd    int `xml:"ssd,attr"`    // GB
+}
+
+// Render a Domain's Metadata Element, for DomainSetMetadata Under MetadataURI
+func RenderMetadata(data *message.VMData) (string, error) {
+	content, err := xml.Marshal(domainMetadata{
+		ID:          data.ID,
+		Project:     data.Project,
+		Pop:         data.Pop,
+		Os:          data.Os,
+		Hostname:    data.Hostname,
+		IPv4Address: data.IPv4Address,
+		Rescued:     data.Rescued,
+		Plan:        metadataPlan{Vcpus: data.Vcpus, Memory: data.Memory, Ssd: data.Ssd},
+		Primary:     Interfaces(data)[0],
+		Interfaces:  data.Interfaces,
+		Networks:    data.Networks,
+		Firewall:    data.Firewall,
+		Bandwidth:   data.Bandwidth,
+		IOTune:      data.IOTune,
+	})
+	return string(content), err
+}
+
+// Rebuild a Domain's Cache Entry from its Metadata Element. libvirt Hands
+// it Back Prefixed with its Namespace, which Decoding Ignores
+func ParseMetadata(content string) (*message.VMData, error) {
+	var metadata domainMetadata
+	if err := xml.Unmarshal([]byte(content), &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.ID == "" || metadata.Primary.Index <= 0 {
+		return nil, fmt.Errorf("metadata does not identify a domain")
+	}
+	return &message.VMData{
+		ID:          metadata.ID,
+		Hostname:    metadata.Hostname,
+		Pop:         metadata.Pop,
+		Project:     metadata.Project,
+		Os:          metadata.Os,
+		Vcpus:       metadata.Plan.Vcpus,
+		Memory:      metadata.Plan.Memory,
+		Ssd:         metadata.Plan.Ssd,
+		IPv4:        metadata.IPv4Address != "",
+		IPv4Address: metadata.IPv4Address,
+		Firewall:    metadata.Firewall,
+		Bandwidth:   metadata.Bandwidth,
+		IOTune:      metadata.IOTune,
+		Index:       metadata.Primary.Index,
+		Prefix:      metadata.Primary.Prefix,
+		MAC:         metadata.Primary.MAC,
+		Gateway:     metadata.Primary.Gateway,
+		Address:     metadata.Primary.Address,
+		Routes:      metadata.Primary.Routes,
+		Interfaces:  metadata.Interfaces,
+		Networks:    metadata.Networks,
+		Rescued:     metadata.Rescued,
+	}, nil
+}
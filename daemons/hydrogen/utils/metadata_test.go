@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	data := multihomedVM()
+	data.Project = "alpha"
+	data.Pop = "fra1"
+	data.IPv4 = true
+	data.IPv4Address = "192.0.2.10"
+	data.Networks = []message.NetworkMember{{VNI: 1001, MAC: "52:55:00:00:00:04", Address: "fd00:1001::4/64"}}
+	data.Firewall = message.Firewall{Policy: "drop", Rules: []message.FirewallRule{
+		{Action: "accept", Protocol: "tcp", Ports: []string{"22", "8000-8100"}, Sources: []string{"2001:db8::/32"}},
+		{Action: "accept", Protocol: "icmpv6"},
+	}}
+	data.Bandwidth = message.Bandwidth{Inbound: 100, Outbound: 50}
+	data.IOTune = message.IOTune{ReadIOPS: 1000}
+	data.Rescued = true
+	content, err := RenderMetadata(data)
+	if err != nil {
+		t.Fatalf("RenderMetadata: %v", err)
+	}
+	if strings.Contains(content, data.Password) {
+		t.Errorf("metadata carries the password:\n%s", content)
+	}
+
+	recovered, err := ParseMetadata(content)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	// Only the Password and User-Data are Not Recoverable
+	want := *data
+	want.Password = ""
+	if !reflect.DeepEqual(*recovered, want) {
+		t.Errorf("recovered = %+v\nwant %+v", *recovered, want)
+	}
+}
+
+func TestParseMetadataFromLibvirt(t *testing.T) {
+	// libvirt Returns the Element with its Namespace Prefix
+	content := `<hydrogen:vm xmlns:hydrogen="https://aarch64.com/xmlns/hydrogen/1" id="60f1c1a2b3c4d5e6f7a8b9c1" project="alpha" pop="fra1" os="debian" hostname="debian-box">
+  <hydrogen:plan vcpus="2" memory="4" ssd="10"/>
+  <hydrogen:primary index="4" prefix="2001:db8:0:4::/64" mac="52:54:00:00:00:04" gateway="2001:db8:0:4::1" address="2001:db8:0:4::2/64"/>
+  <hydrogen:bandwidth inbound="0" outbound="0" packet_rate="0"/>
+  <hydrogen:iotune read_iops="0" write_iops="0" read_mbps="0" write_mbps="0"/>
+</hydrogen:vm>`
+	recovered, err := ParseMetadata(content)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	want := debianVM()
+	want.Password = ""
+	want.Project = "alpha"
+	want.Pop = "fra1"
+	if !reflect.DeepEqual(recovered, want) {
+		t.Errorf("recovered = %+v\nwant %+v", *recovered, *want)
+	}
+
+	if _, err := ParseMetadata(`<vm id="60f1c1a2b3c4d5e6f7a8b9c1"/>`); err == nil {
+		t.Error("ParseMetadata accepted metadata without a bridge index")
+	}
+}
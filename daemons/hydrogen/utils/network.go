@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Largest VNI a VXLAN Header Can Carry
+const maxVNI = 1<<24 - 1
+
+// Destination MAC of the Flooding Entries Pointing at Peers
+const floodMAC = "00:00:00:00:00:00"
+
+// Members of a Private Network Share Bridge pbr<vni>, Tunnelled over vx<vni>
+func NetworkBridge(vni int) string {
+	return fmt.Sprintf("pbr%d", vni)
+}
+
+func vxlanDevice(vni int) string {
+	return fmt.Sprintf("vx%d", vni)
+}
+
+// MAC of a VM on a Private Network. The VM Index Keeps it Unique on the
+// Network, and the First Free Slot Keeps it Unique Among the VM's Networks
+func PrivateMACAddress(data *message.VMData) string {
+	used := make(map[string]bool, len(data.Networks))
+	for _, member := range data.Networks {
+		used[member.MAC] = true
+	}
+	for slot := 0; slot < 256; slot++ {
+		mac := fmt.Sprintf("52:55:%02x:%02x:%02x:%02x", byte(slot), byte(data.Index>>16), byte(data.Index>>8), byte(data.Index))
+		if !used[mac] {
+			return mac
+		}
+	}
+	return ""
+}
+
+func ValidateNetwork(network *message.Network) error {
+	if network.VNI < 1 || network.VNI > maxVNI {
+		return fmt.Errorf("network vni %d is out of range", network.VNI)
+	}
+	if _, _, err := net.ParseCIDR(network.Prefix); err != nil {
+		return fmt.Errorf("network %d: invalid prefix %q", network.VNI, network.Prefix)
+	}
+	for _, peer := range network.Peers {
+		if net.ParseIP(peer) == nil {
+			return fmt.Errorf("network %d: invalid peer %q", network.VNI, peer)
+		}
+	}
+	return nil
+}
+
+// Check a Member's MAC, and that its Address is Inside the Network's Prefix
+func ValidateMember(network *message.Network, member *message.NetworkMember) error {
+	if _, err := net.ParseMAC(member.MAC); err != nil {
+		return fmt.Errorf("network %d: invalid mac address %q", network.VNI, member.MAC)
+	}
+	_, prefix, err := net.ParseCIDR(network.Prefix)
+	if err != nil {
+		return fmt.Errorf("network %d: invalid prefix %q", network.VNI, network.Prefix)
+	}
+	ip, _, err := net.ParseCIDR(member.Address)
+	if err != nil || !prefix.Contains(ip) {
+		return fmt.Errorf("network %d: address %q is not in %s", network.VNI, member.Address, network.Prefix)
+	}
+	return nil
+}
+
+// Create the Network's Bridge and VXLAN Tunnel if Missing, and Flood
+// Broadcast and Unknown Traffic to Exactly the Given Peers. The Local
+// Address is Skipped, so Every Host can be Sent the Same Peer List
+func CreateNetwork(l *zap.Logger, ex executor.Executor, network *message.Network, local string, port int) error {
+	if local == "" {
+		err := fmt.Errorf("hydrogen.vxlan_local is not set")
+		l.Error("unable to create network", zap.Int("vni", network.VNI), zap.Error(err))
+		return err
+	}
+	bridge, vxlan := NetworkBridge(network.VNI), vxlanDevice(network.VNI)
+	commands := [][]string{}
+	if _, err := ex.Output("ip", "link", "show", "dev", bridge); err != nil {
+		commands = append(commands, []string{"link", "add", bridge, "type", "bridge"})
+	}
+	if _, err := ex.Output("ip", "link", "show", "dev", vxlan); err != nil {
+		commands = append(commands, []string{
+			"link", "add", vxlan, "type", "vxlan",
+			"id", strconv.Itoa(network.VNI),
+			"local", local,
+			"dstport", strconv.Itoa(port),
+		})
+	}
+	commands = append(commands,
+		[]string{"link", "set", "dev", vxlan, "master", bridge},
+		[]string{"link", "set", "dev", vxlan, "up"},
+		[]string{"link", "set", "dev", bridge, "up"},
+	)
+	for _, args := range commands {
+		if output, err := ex.CombinedOutput("ip", args...); err != nil {
+			l.Error(
+				"unable to create network",
+				zap.String("command", executor.CommandLine("ip", args...)),
+				zap.ByteString("output", output),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return setPeers(l, ex, vxlan, network.Peers, local)
+}
+
+// Replace the Flooding Entries of a VXLAN Device with the Peers
+func setPeers(l *zap.Logger, ex executor.Executor, vxlan string, peers []string, local string) error {
+	output, err := ex.Output("bridge", "fdb", "show", "dev", vxlan)
+	if err != nil {
+		l.Error(
+			"unable to list network peers",
+			zap.String("command", "bridge fdb show dev "+vxlan),
+			zap.Error(err),
+		)
+		return err
+	}
+	wanted := map[string]bool{}
+	for _, peer := range peers {
+		if ip := net.ParseIP(peer); ip != nil && !ip.Equal(net.ParseIP(local)) {
+			wanted[ip.String()] = true
+		}
+	}
+	commands := [][]string{}
+	current := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != floodMAC || fields[1] != "dst" {
+			continue
+		}
+		current[fields[2]] = true
+		if !wanted[fields[2]] {
+			commands = append(commands, []string{"fdb", "del", floodMAC, "dev", vxlan, "dst", fields[2]})
+		}
+	}
+	for _, peer := range peers {
+		if ip := net.ParseIP(peer); ip != nil && wanted[ip.String()] && !current[ip.String()] {
+			commands = append(commands, []string{"fdb", "append", floodMAC, "dev", vxlan, "dst", ip.String()})
+			current[ip.String()] = true
+		}
+	}
+	for _, args := range commands {
+		if output, err := ex.CombinedOutput("bridge", args...); err != nil {
+			l.Error(
+				"unable to update network peers",
+				zap.String("command", executor.CommandLine("bridge", args...)),
+				zap.ByteString("output", output),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the Network's Tunnel and Bridge, Ignoring Ones Already Gone
+func DeleteNetwork(l *zap.Logger, ex executor.Executor, network *message.Network) error {
+	for _, device := range []string{vxlanDevice(network.VNI), NetworkBridge(network.VNI)} {
+		if output, err := ex.CombinedOutput("ip", "link", "del", device); err != nil && !strings.Contains(string(output), "Cannot find device") {
+			l.Error(
+				"unable to delete network",
+				zap.String("command", "ip link del "+device),
+				zap.ByteString("output", output),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return nil
+}
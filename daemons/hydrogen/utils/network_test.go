@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func projectNetwork() *message.Network {
+	return &message.Network{
+		VNI:     1001,
+		Project: "alpha",
+		Prefix:  "fd00:1001::/64",
+		Peers:   []string{"2001:db8:ffff::1", "2001:db8:ffff::2", "2001:db8:ffff::3"},
+	}
+}
+
+func TestCreateNetwork(t *testing.T) {
+	missing := errors.New("exit status 1")
+	fake := executor.NewFake().
+		Expect("ip link show dev pbr1001", `Device "pbr1001" does not exist.`, missing).
+		Expect("ip link show dev vx1001", `Device "vx1001" does not exist.`, missing).
+		Expect("ip link add pbr1001 type bridge", "", nil).
+		Expect("ip link add vx1001 type vxlan id 1001 local 2001:db8:ffff::1 dstport 4789", "", nil).
+		Expect("ip link set dev vx1001 master pbr1001", "", nil).
+		Expect("ip link set dev vx1001 up", "", nil).
+		Expect("ip link set dev pbr1001 up", "", nil).
+		Expect("bridge fdb show dev vx1001", "", nil).
+		Expect("bridge fdb append 00:00:00:00:00:00 dev vx1001 dst 2001:db8:ffff::2", "", nil).
+		Expect("bridge fdb append 00:00:00:00:00:00 dev vx1001 dst 2001:db8:ffff::3", "", nil)
+	if err := CreateNetwork(zap.NewNop(), fake, projectNetwork(), "2001:db8:ffff::1", 4789); err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateNetworkUpdatesPeers(t *testing.T) {
+	fdb := strings.Join([]string{
+		"52:55:00:00:00:07 dst 2001:db8:ffff::2 self",
+		"00:00:00:00:00:00 dst 2001:db8:ffff::2 self permanent",
+		"00:00:00:00:00:00 dst 2001:db8:ffff::9 self permanent",
+	}, "\n")
+	fake := executor.NewFake().
+		Expect("ip link show dev pbr1001", "", nil).
+		Expect("ip link show dev vx1001", "", nil).
+		Expect("ip link set dev vx1001 master pbr1001", "", nil).
+		Expect("ip link set dev vx1001 up", "", nil).
+		Expect("ip link set dev pbr1001 up", "", nil).
+		Expect("bridge fdb show dev vx1001", fdb, nil).
+		Expect("bridge fdb del 00:00:00:00:00:00 dev vx1001 dst 2001:db8:ffff::9", "", nil).
+		Expect("bridge fdb append 00:00:00:00:00:00 dev vx1001 dst 2001:db8:ffff::3", "", nil)
+	if err := CreateNetwork(zap.NewNop(), fake, projectNetwork(), "2001:db8:ffff::1", 4789); err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	if err := CreateNetwork(zap.NewNop(), executor.NewFake(), projectNetwork(), "", 4789); err == nil {
+		t.Error("CreateNetwork succeeded without a local vxlan address")
+	}
+}
+
+func TestDeleteNetwork(t *testing.T) {
+	fake := executor.NewFake().
+		Expect("ip link del vx1001", `Cannot find device "vx1001"`, errors.New("exit status 1")).
+		Expect("ip link del pbr1001", "", nil)
+	if err := DeleteNetwork(zap.NewNop(), fake, projectNetwork()); err != nil {
+		t.Fatalf("DeleteNetwork: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*message.Network)
+		wantErr bool
+	}{
+		{"valid", func(*message.Network) {}, false},
+		{"private ipv4", func(n *message.Network) { n.Prefix = "10.1.0.0/24" }, false},
+		{"zero vni", func(n *message.Network) { n.VNI = 0 }, true},
+		{"vni too large", func(n *message.Network) { n.VNI = 1 << 24 }, true},
+		{"bad prefix", func(n *message.Network) { n.Prefix = "fd00:1001::" }, true},
+		{"bad peer", func(n *message.Network) { n.Peers = []string{"hv2"} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := projectNetwork()
+			tt.modify(network)
+			if err := ValidateNetwork(network); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateNetwork error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	member := &message.NetworkMember{VNI: 1001, MAC: "52:55:00:00:00:04", Address: "fd00:1001::4/64"}
+	if err := ValidateMember(projectNetwork(), member); err != nil {
+		t.Errorf("ValidateMember: %v", err)
+	}
+	member.Address = "fd00:1002::4/64"
+	if err := ValidateMember(projectNetwork(), member); err == nil {
+		t.Error("ValidateMember accepted an address outside the network")
+	}
+}
+
+func TestPrivateMACAddress(t *testing.T) {
+	data := debianVM()
+	if mac := PrivateMACAddress(data); mac != "52:55:00:00:00:04" {
+		t.Errorf("PrivateMACAddress = %s", mac)
+	}
+	data.Networks = []message.NetworkMember{{VNI: 1001, MAC: "52:55:00:00:00:04"}}
+	if mac := PrivateMACAddress(data); mac != "52:55:01:00:00:04" {
+		t.Errorf("PrivateMACAddress with one network = %s", mac)
+	}
+}
+
+func TestNetworkConfigPrivateNetwork(t *testing.T) {
+	profile := debianProfile(t)
+	data := multihomedVM()
+	data.Networks = []message.NetworkMember{{VNI: 1001, MAC: "52:55:00:00:00:04", Address: "fd00:1001::4/64"}}
+	var netplan bytes.Buffer
+	if err := profile.networkConfig.Execute(&netplan, newTemplateData(profile, data)); err != nil {
+		t.Fatal(err)
+	}
+	want := `  eth2:
+     match:
+       macaddress: "52:55:00:00:00:04"
+     set-name: eth2
+     addresses:
+       - fd00:1001::4/64
+`
+	if !strings.HasSuffix(netplan.String(), want) {
+		t.Errorf("netplan does not configure the private network:\n%s", netplan.String())
+	}
+}
+
+// FreeBSD Configures IPv4 Private Addresses with inet, Not inet6
+func TestNetworkConfigPrivateNetworkFreeBSD(t *testing.T) {
+	profile := freebsdProfile(t)
+	data := freebsdVM()
+	data.Networks = []message.NetworkMember{
+		{VNI: 1001, MAC: "52:55:00:00:00:03", Address: "fd00:1001::3/64"},
+		{VNI: 1002, MAC: "52:55:01:00:00:03", Address: "10.1.0.3/24"},
+	}
+	var rcConf bytes.Buffer
+	if err := profile.networkConfig.Execute(&rcConf, newTemplateData(profile, data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ifconfig_vtnet1=\"up\"\nifconfig_vtnet1_ipv6=\"inet6 fd00:1001::3 prefixlen 64\"\n",
+		"ifconfig_vtnet2=\"inet 10.1.0.3/24\"\n",
+	} {
+		if !strings.Contains(rcConf.String(), want) {
+			t.Errorf("rc.conf missing %q:\n%s", want, rcConf.String())
+		}
+	}
+	if strings.Contains(rcConf.String(), "inet6 10.1.0.3") {
+		t.Errorf("rc.conf configures an ipv4 address as inet6:\n%s", rcConf.String())
+	}
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+var ErrUnknownOS = errors.New("unknown operating system")
+
+// Network Config Formats a Profile can Render
+const (
+	NetworkFormatNetplan = "netplan"
+	NetworkFormatFreeBSD = "freebsd"
+)
+
+// Provisioning Profile for a Guest Operating System
+type Profile struct {
+	Name string `json:"name"`
+	// Base Image Name in the Images Directory, Defaults to the Profile Name
+	Image string `json:"image"`
+	// Format of the Rendered Guest Network Config
+	NetworkFormat string `json:"network_format"`
+	// Interface Name the Image Boots with. Netplan Guests have it Renamed to
+	// eth0, FreeBSD Guests have it Configured in rc.conf
+	Interface string `json:"interface"`
+	// Extra Commands Run After the Platform Setup Steps
+	RunCmd []string `json:"runcmd"`
+	// Firmware and Machine Options Passed to virt-install
+	Boot    string `json:"boot"`
+	Machine string `json:"machine"`
+	// Minimum Disk Size in GB
+	MinDisk int `json:"min_disk"`
+	// Template Overrides, Relative to the Profile Directory
+	CloudConfigTemplate   string `json:"cloud_config_template"`
+	NetworkConfigTemplate string `json:"network_config_template"`
+
+	cloudConfig   *template.Template
+	networkConfig *template.Template
+}
+
+// Profiles Shipped with Hydrogen, Overridable from the Profile Directory
+var builtinProfiles = []Profile{
+	{
+		Name:    "debian",
+		RunCmd:  []string{"systemctl restart sshd"},
+		MinDisk: 4,
+	},
+	{
+		Name:      "ubuntu",
+		Interface: "enp1s0",
+		RunCmd: []string{
+			"systemctl restart sshd",
+			`sed -i 's/^GRUB_CMDLINE_LINUX_DEFAULT.*/GRUB_CMDLINE_LINUX_DEFAULT="quiet splash net.ifnames=0"/' /etc/default/grub`,
+			"/usr/sbin/update-grub",
+		},
+		MinDisk: 4,
+	},
+	{
+		Name:      "rocky",
+		Interface: "enp1s0",
+		MinDisk:   4,
+	},
+	{
+		Name:          "freebsd",
+		NetworkFormat: NetworkFormatFreeBSD,
+		Interface:     "vtnet0",
+		MinDisk:       6,
+	},
+}
+
+// Data Handed to Cloud Config and Network Config Templates
+type templateData struct {
+	*message.VMData
+	Profile *Profile
+	// Resolvers Handed to the Guest
+	Nameservers []string
+	// Interfaces Beyond the Primary One, Followed by Private Network
+	// Interfaces, Named as the Guest Sees them
+	ExtraInterfaces []guestInterface
+	// Rendered Network Config, for Seeds that Embed it in the User-Data
+	NetworkConfig string
+	// SHA-512 crypt Hash of the Root Password, Empty Without a Password
+	PasswordHash string
+}
+
+type guestInterface struct {
+	Name string
+	message.Interface
+}
+
+func newTemplateData(profile *Profile, data *message.VMData) *templateData {
+	tmplData := &templateData{VMData: data, Profile: profile, Nameservers: config.Nameservers}
+	// Netplan Guests Name Interfaces eth<n>, FreeBSD Guests Number them
+	// After the Driver, e.g. vtnet<n>
+	base := "eth"
+	if profile.NetworkFormat == NetworkFormatFreeBSD {
+		base = strings.TrimRight(profile.Interface, "0123456789")
+	}
+	interfaces := append([]message.Interface(nil), data.Interfaces...)
+	for _, member := range data.Networks {
+		interfaces = append(interfaces, message.Interface{MAC: member.MAC, Address: member.Address})
+	}
+	for i, iface := range interfaces {
+		tmplData.ExtraInterfaces = append(tmplData.ExtraInterfaces, guestInterface{
+			Name:      fmt.Sprintf("%s%d", base, i+1),
+			Interface: iface,
+		})
+	}
+	return tmplData
+}
+
+// Template Data for a Seed Image, Carrying the Hashed Root Password
+func newSeedTemplateData(profile *Profile, data *message.VMData) (*templateData, error) {
+	tmplData := newTemplateData(profile, data)
+	if data.Password != "" {
+		hash, err := hashPassword(data.Password)
+		if err != nil {
+			return nil, err
+		}
+		tmplData.PasswordHash = hash
+	}
+	return tmplData, nil
+}
+
+var templateFuncs = template.FuncMap{
+	// Render a String as a YAML Double Quoted Scalar
+	"quote": func(input string) (string, error) {
+		quoted, err := json.Marshal(input)
+		return string(quoted), err
+	},
+	// Render a String as a Single Quoted Shell Word
+	"shquote": func(input string) string {
+		return "'" + strings.ReplaceAll(input, "'", `'\''`) + "'"
+	},
+	// Split an Address in CIDR Notation
+	"address": func(cidr string) string {
+		return strings.SplitN(cidr, "/", 2)[0]
+	},
+	"ipv4": func(cidr string) bool {
+		return net.ParseIP(strings.SplitN(cidr, "/", 2)[0]).To4() != nil
+	},
+	"prefixlen": func(cidr string) string {
+		parts := strings.SplitN(cidr, "/", 2)
+		if len(parts) < 2 {
+			return "64"
+		}
+		return parts[1]
+	},
+}
+
+// Fill in Defaults and Parse the Profile's Templates
+func (p *Profile) prepare(dir string) error {
+	if p.Image == "" {
+		p.Image = p.Name
+	}
+	if p.NetworkFormat == "" {
+		p.NetworkFormat = NetworkFormatNetplan
+	}
+	if p.Boot == "" {
+		p.Boot = "uefi"
+	}
+	var cloudConfig, networkConfig string
+	switch p.NetworkFormat {
+	case NetworkFormatNetplan:
+		cloudConfig, networkConfig = cloud_cfg_file, netplan_cfg_file
+	case NetworkFormatFreeBSD:
+		cloudConfig, networkConfig = freebsd_user_data_file, freebsd_rc_conf_file
+	default:
+		return fmt.Errorf("unsupported network format %q", p.NetworkFormat)
+	}
+	if p.CloudConfigTemplate != "" {
+		content, err := os.ReadFile(filepath.Join(dir, p.CloudConfigTemplate))
+		if err != nil {
+			return err
+		}
+		cloudConfig = string(content)
+	}
+	if p.NetworkConfigTemplate != "" {
+		content, err := os.ReadFile(filepath.Join(dir, p.NetworkConfigTemplate))
+		if err != nil {
+			return err
+		}
+		networkConfig = string(content)
+	}
+	var err error
+	if p.cloudConfig, err = template.New("cloud-config.yml").Funcs(templateFuncs).Parse(cloudConfig); err != nil {
+		return err
+	}
+	if p.networkConfig, err = template.New("network-config.yml").Funcs(templateFuncs).Parse(networkConfig); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check a VM can be Provisioned with this Profile
+func (p *Profile) Validate(data *message.VMData) error {
+	if err := ValidateHostname(data.Hostname); err != nil {
+		return err
+	}
+	if data.Ssd < p.MinDisk {
+		return fmt.Errorf("%s requires at least %dG of disk, got %dG", p.Name, p.MinDisk, data.Ssd)
+	}
+	// nuageinit Only Runs a Single Script, so Only Scripts can be Embedded
+	if p.NetworkFormat == NetworkFormatFreeBSD && data.UserData != "" && !strings.HasPrefix(data.UserData, "#!") {
+		return fmt.Errorf("%s only supports shell script user-data", p.Name)
+	}
+	return nil
+}
+
+// OS Profile Registry Keyed by VMData.Os
+type Profiles map[string]*Profile
+
+// Load the Built-In Profiles and Apply any Profiles Found in the Directory.
+// A File Named after a Built-In Profile Only Overrides the Fields it Sets
+func LoadProfiles(l *zap.Logger, dir string) (Profiles, error) {
+	profiles := make(Profiles)
+	for _, builtin := range builtinProfiles {
+		profile := builtin
+		profile.RunCmd = append([]string(nil), builtin.RunCmd...)
+		profiles[profile.Name] = &profile
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		l.Info("no os profiles found, using built-in profiles", zap.String("path", dir))
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		profile, ok := profiles[name]
+		if !ok {
+			profile = &Profile{}
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(content, profile); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		profile.Name = name
+		profiles[name] = profile
+	}
+
+	for _, profile := range profiles {
+		if err := profile.prepare(dir); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+	}
+	l.Info("Loaded OS Profiles", zap.Strings("profiles", profiles.Names()))
+	return profiles, nil
+}
+
+// Select the Profile for an Operating System
+func (p Profiles) Get(name string) (*Profile, error) {
+	profile, ok := p[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOS, name)
+	}
+	return profile, nil
+}
+
+// Sorted Names of All Known Profiles
+func (p Profiles) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func writeProfile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProfilesDefaults(t *testing.T) {
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadProfiles: %v", err)
+	}
+	if names := profiles.Names(); !reflect.DeepEqual(names, []string{"debian", "freebsd", "rocky", "ubuntu"}) {
+		t.Errorf("Names = %v, want the built-in profiles", names)
+	}
+	tests := []struct {
+		os            string
+		wantImage     string
+		wantFormat    string
+		wantInterface string
+		wantMinDisk   int
+	}{
+		{"debian", "debian", NetworkFormatNetplan, "", 4},
+		{"ubuntu", "ubuntu", NetworkFormatNetplan, "enp1s0", 4},
+		{"rocky", "rocky", NetworkFormatNetplan, "enp1s0", 4},
+		{"freebsd", "freebsd", NetworkFormatFreeBSD, "vtnet0", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.os, func(t *testing.T) {
+			profile, err := profiles.Get(tt.os)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if profile.Image != tt.wantImage || profile.NetworkFormat != tt.wantFormat ||
+				profile.Interface != tt.wantInterface || profile.MinDisk != tt.wantMinDisk || profile.Boot != "uefi" {
+				t.Errorf("profile = %+v", profile)
+			}
+			if profile.cloudConfig == nil || profile.networkConfig == nil {
+				t.Error("templates not parsed")
+			}
+		})
+	}
+}
+
+func TestProfilesGetUnknown(t *testing.T) {
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.Get("templeos"); !errors.Is(err, ErrUnknownOS) {
+		t.Errorf("Get error = %v, want ErrUnknownOS", err)
+	}
+}
+
+func TestLoadProfilesOverrides(t *testing.T) {
+	dir := t.TempDir()
+	writeProfile(t, dir, "debian.json", `{"min_disk": 8, "image": "debian-12"}`)
+	writeProfile(t, dir, "alpine.json", `{"interface": "eth0", "network_config_template": "alpine.tmpl"}`)
+	writeProfile(t, dir, "alpine.tmpl", "network: {{ .Hostname }}")
+
+	profiles, err := LoadProfiles(zap.NewNop(), dir)
+	if err != nil {
+		t.Fatalf("LoadProfiles: %v", err)
+	}
+	debian, _ := profiles.Get("debian")
+	if debian.MinDisk != 8 || debian.Image != "debian-12" {
+		t.Errorf("debian override not applied: %+v", debian)
+	}
+	// Fields the Override Leaves Out Keep their Built-In Values
+	if len(debian.RunCmd) != 1 || debian.NetworkFormat != NetworkFormatNetplan {
+		t.Errorf("debian lost built-in fields: %+v", debian)
+	}
+	alpine, err := profiles.Get("alpine")
+	if err != nil {
+		t.Fatalf("Get alpine: %v", err)
+	}
+	if alpine.Image != "alpine" || alpine.NetworkFormat != NetworkFormatNetplan || alpine.Boot != "uefi" {
+		t.Errorf("alpine defaults not filled in: %+v", alpine)
+	}
+	var rendered strings.Builder
+	if err := alpine.networkConfig.Execute(&rendered, &message.VMData{Hostname: "box"}); err != nil || rendered.String() != "network: box" {
+		t.Errorf("alpine network template rendered %q, %v", rendered.String(), err)
+	}
+}
+
+func TestLoadProfilesDoesNotShareBuiltins(t *testing.T) {
+	dir := t.TempDir()
+	writeProfile(t, dir, "ubuntu.json", `{"runcmd": ["true"]}`)
+	if _, err := LoadProfiles(zap.NewNop(), dir); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ubuntu, _ := profiles.Get("ubuntu")
+	if len(ubuntu.RunCmd) != 3 {
+		t.Errorf("override leaked into the built-in profile: %v", ubuntu.RunCmd)
+	}
+}
+
+func TestLoadProfilesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"invalid json", map[string]string{"debian.json": "{"}, "debian.json"},
+		{"unknown network format", map[string]string{"plan9.json": `{"network_format": "plan9"}`}, "unsupported network format"},
+		{"missing template", map[string]string{"debian.json": `{"cloud_config_template": "missing.yml"}`}, "missing.yml"},
+		{"broken template", map[string]string{"debian.json": `{"cloud_config_template": "broken.yml"}`, "broken.yml": "{{ .Hostname"}, "profile debian"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeProfile(t, dir, name, content)
+			}
+			_, err := LoadProfiles(zap.NewNop(), dir)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadProfiles error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	profiles, err := LoadProfiles(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		os       string
+		ssd      int
+		userData string
+		wantErr  bool
+	}{
+		{"enough disk", "debian", 4, "", false},
+		{"too little disk", "debian", 3, "", true},
+		{"freebsd minimum", "freebsd", 5, "", true},
+		{"freebsd script", "freebsd", 10, "#!/bin/sh\n", false},
+		{"freebsd cloud config", "freebsd", 10, "#cloud-config\n", true},
+		{"debian cloud config", "debian", 10, "#cloud-config\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, _ := profiles.Get(tt.os)
+			err := profile.Validate(&message.VMData{Hostname: "box", Ssd: tt.ssd, UserData: tt.userData})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Lifetimes Advertised to Guests, in Seconds
+const (
+	raRouterLifetime    = 1800
+	raValidLifetime     = 86400
+	raPreferredLifetime = 14400
+)
+
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+)
+
+// Build an ICMPv6 Router Advertisement Making the Sender the Default Router
+// and Offering the Prefix for SLAAC and the Nameservers over RDNSS. The
+// Checksum is Left Zero for the Kernel to Fill in
+func BuildRouterAdvertisement(prefix *net.IPNet, mac net.HardwareAddr, nameservers []net.IP, rdnssLifetime uint32) ([]byte, error) {
+	ones, bits := prefix.Mask.Size()
+	if prefix.IP.To4() != nil || bits != 128 {
+		return nil, fmt.Errorf("prefix %s is not ipv6", prefix)
+	}
+	packet := []byte{
+		icmpv6RouterAdvertisement, 0, 0, 0, // Type, Code, Checksum
+		64, 0, // Current Hop Limit, No Managed or Other Flags
+		0, 0, // Router Lifetime
+		0, 0, 0, 0, // Reachable Time
+		0, 0, 0, 0, // Retransmit Timer
+	}
+	binary.BigEndian.PutUint16(packet[6:8], raRouterLifetime)
+
+	// Source Link-Layer Address
+	if len(mac) == 6 {
+		packet = append(packet, 1, 1)
+		packet = append(packet, mac...)
+	}
+
+	// Prefix Information, On-Link and Autonomous
+	info := make([]byte, 32)
+	info[0], info[1], info[2], info[3] = 3, 4, byte(ones), 0xc0
+	binary.BigEndian.PutUint32(info[4:8], raValidLifetime)
+	binary.BigEndian.PutUint32(info[8:12], raPreferredLifetime)
+	copy(info[16:32], prefix.IP.To16())
+	packet = append(packet, info...)
+
+	// Recursive DNS Servers
+	servers := []net.IP{}
+	for _, nameserver := range nameservers {
+		if nameserver.To4() == nil && nameserver.To16() != nil {
+			servers = append(servers, nameserver.To16())
+		}
+	}
+	if len(servers) > 0 {
+		rdnss := make([]byte, 8, 8+16*len(servers))
+		rdnss[0], rdnss[1] = 25, byte(1+2*len(servers))
+		binary.BigEndian.PutUint32(rdnss[4:8], rdnssLifetime)
+		for _, server := range servers {
+			rdnss = append(rdnss, server...)
+		}
+		packet = append(packet, rdnss...)
+	}
+	return packet, nil
+}
+
+// Copy of a Router Advertisement Withdrawing the Sender as Default Router
+// and Deprecating its Prefixes and Nameservers, Sent When Advertising Stops.
+// The Valid Lifetime is Left Alone, Guests Ignore Attempts to Shorten it
+func FinalRouterAdvertisement(packet []byte) []byte {
+	final := make([]byte, len(packet))
+	copy(final, packet)
+	binary.BigEndian.PutUint16(final[6:8], 0)
+	for rest := final[16:]; len(rest) >= 8 && rest[1] != 0 && int(rest[1])*8 <= len(rest); rest = rest[int(rest[1])*8:] {
+		switch rest[0] {
+		case 3:
+			binary.BigEndian.PutUint32(rest[8:12], 0)
+		case 25:
+			binary.BigEndian.PutUint32(rest[4:8], 0)
+		}
+	}
+	return final
+}
+
+// Sends Router Advertisements on VM Bridges, One Goroutine per Bridge
+type Advertiser struct {
+	l        *zap.Logger
+	interval time.Duration
+	mutex    sync.Mutex
+	running  map[int]*advertisement
+}
+
+// A Running Advertiser Goroutine. goodbye is Set Before Cancelling when a
+// Final Advertisement should be Sent, which is Not the Case on Restarts
+type advertisement struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	goodbye int32
+}
+
+func NewAdvertiser(l *zap.Logger, interval time.Duration) *Advertiser {
+	return &Advertiser{
+		l:        l,
+		interval: interval,
+		running:  make(map[int]*advertisement),
+	}
+}
+
+// Start Advertising the Domain's Prefix on its Bridge, Restarting any
+// Advertiser Already Running There. A Zero Interval Disables Advertising
+func (a *Advertiser) Start(data *message.VMData) error {
+	if a.interval <= 0 {
+		return nil
+	}
+	_, prefix, err := net.ParseCIDR(data.Prefix)
+	if err != nil {
+		return fmt.Errorf("domain %s: invalid prefix %q", data.ID, data.Prefix)
+	}
+	bridge := fmt.Sprintf("vbr%d", data.Index)
+	iface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return err
+	}
+	nameservers := []net.IP{}
+	for _, nameserver := range config.Nameservers {
+		nameservers = append(nameservers, net.ParseIP(nameserver))
+	}
+	// RDNSS Entries Outlive a Few Missed Advertisements
+	packet, err := BuildRouterAdvertisement(prefix, iface.HardwareAddr, nameservers, uint32(3*a.interval/time.Second))
+	if err != nil {
+		return err
+	}
+	fd, err := openRASocket(iface)
+	if err != nil {
+		a.l.Error("unable to open router advertisement socket", zap.String("network", bridge), zap.Error(err))
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if running, ok := a.running[data.Index]; ok {
+		running.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ad := &advertisement{cancel: cancel, done: make(chan struct{})}
+	a.running[data.Index] = ad
+	go a.advertise(ctx, ad, fd, bridge, packet)
+	a.l.Info("Started Router Advertisements", zap.String("network", bridge), zap.String("prefix", prefix.String()))
+	return nil
+}
+
+// Stop Advertising on the Domain's Bridge, Waiting for the Final
+// Advertisement to be Sent so the Bridge can be Deleted Afterwards
+func (a *Advertiser) Stop(data *message.VMData) {
+	a.mutex.Lock()
+	ad, ok := a.running[data.Index]
+	if ok {
+		atomic.StoreInt32(&ad.goodbye, 1)
+		ad.cancel()
+		delete(a.running, data.Index)
+	}
+	a.mutex.Unlock()
+	if ok {
+		<-ad.done
+	}
+}
+
+// Raw ICMPv6 Socket Bound to the Bridge, Joined to All-Routers so Router
+// Solicitations are Received
+func openRASocket(iface *net.Interface) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return -1, err
+	}
+	mreq := &syscall.IPv6Mreq{Interface: uint32(iface.Index)}
+	copy(mreq.Multiaddr[:], net.ParseIP("ff02::2"))
+	err = syscall.BindToDevice(fd, iface.Name)
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+	}
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 255)
+	}
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+	}
+	if err == nil {
+		err = syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	}
+	if err == nil {
+		// Wake Up Regularly to Notice Cancellation
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// Advertise Every Interval and Straight Away on a Router Solicitation
+func (a *Advertiser) advertise(ctx context.Context, ad *advertisement, fd int, bridge string, packet []byte) {
+	defer close(ad.done)
+	defer syscall.Close(fd)
+	allNodes := &syscall.SockaddrInet6{}
+	copy(allNodes.Addr[:], net.ParseIP("ff02::1"))
+	send := func() {
+		if err := syscall.Sendto(fd, packet, 0, allNodes); err != nil {
+			a.l.Error("unable to send router advertisement", zap.String("network", bridge), zap.Error(err))
+		}
+	}
+
+	send()
+	next := time.Now().Add(a.interval)
+	buf := make([]byte, 1500)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == nil && n > 0 && buf[0] == icmpv6RouterSolicitation {
+			send()
+			next = time.Now().Add(a.interval)
+			continue
+		}
+		if time.Now().After(next) {
+			send()
+			next = time.Now().Add(a.interval)
+		}
+	}
+	if atomic.LoadInt32(&ad.goodbye) == 1 {
+		packet = FinalRouterAdvertisement(packet)
+		send()
+	}
+	a.l.Info("Stopped Router Advertisements", zap.String("network", bridge))
+}
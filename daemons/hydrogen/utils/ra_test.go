@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestBuildRouterAdvertisement(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:4::/64")
+	mac, _ := net.ParseMAC("52:54:00:aa:bb:cc")
+	nameservers := []net.IP{net.ParseIP("2606:4700:4700::64"), net.ParseIP("192.0.2.53"), net.ParseIP("2606:4700:4700::6400")}
+
+	packet, err := BuildRouterAdvertisement(prefix, mac, nameservers, 180)
+	if err != nil {
+		t.Fatalf("BuildRouterAdvertisement: %v", err)
+	}
+	if packet[0] != icmpv6RouterAdvertisement || packet[4] != 64 {
+		t.Errorf("header = % x", packet[:16])
+	}
+	if lifetime := binary.BigEndian.Uint16(packet[6:8]); lifetime != raRouterLifetime {
+		t.Errorf("router lifetime = %d, want %d", lifetime, raRouterLifetime)
+	}
+
+	// Walk the Options, Each Length Counted in Units of 8 Octets
+	options := map[byte][]byte{}
+	for rest := packet[16:]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] == 0 || int(rest[1])*8 > len(rest) {
+			t.Fatalf("malformed options % x", rest)
+		}
+		options[rest[0]] = rest[:int(rest[1])*8]
+		rest = rest[int(rest[1])*8:]
+	}
+	if sll := options[1]; !bytes.Equal(sll[2:], mac) {
+		t.Errorf("source link-layer option = % x", sll)
+	}
+	info := options[3]
+	if len(info) != 32 || info[2] != 64 || info[3] != 0xc0 || !net.IP(info[16:32]).Equal(prefix.IP) {
+		t.Errorf("prefix information option = % x", info)
+	}
+	if valid := binary.BigEndian.Uint32(info[4:8]); valid != raValidLifetime {
+		t.Errorf("valid lifetime = %d", valid)
+	}
+	rdnss := options[25]
+	if len(rdnss) != 8+2*16 || binary.BigEndian.Uint32(rdnss[4:8]) != 180 {
+		t.Fatalf("rdnss option = % x, want two ipv6 servers", rdnss)
+	}
+	if !net.IP(rdnss[8:24]).Equal(nameservers[0]) || !net.IP(rdnss[24:40]).Equal(nameservers[2]) {
+		t.Errorf("rdnss servers = % x", rdnss[8:])
+	}
+}
+
+func TestBuildRouterAdvertisementWithoutOptionalParts(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:4::/64")
+	packet, err := BuildRouterAdvertisement(prefix, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("BuildRouterAdvertisement: %v", err)
+	}
+	if len(packet) != 16+32 || packet[16] != 3 {
+		t.Errorf("packet = % x, want header and prefix information only", packet)
+	}
+
+	_, ipv4, _ := net.ParseCIDR("192.0.2.0/24")
+	if _, err := BuildRouterAdvertisement(ipv4, nil, nil, 0); err == nil {
+		t.Error("BuildRouterAdvertisement accepted an ipv4 prefix")
+	}
+}
+
+func TestFinalRouterAdvertisement(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:4::/64")
+	mac, _ := net.ParseMAC("52:54:00:aa:bb:cc")
+	packet, err := BuildRouterAdvertisement(prefix, mac, []net.IP{net.ParseIP("2606:4700:4700::64")}, 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := append([]byte{}, packet...)
+	final := FinalRouterAdvertisement(packet)
+	if !bytes.Equal(packet, original) {
+		t.Error("FinalRouterAdvertisement modified the regular advertisement")
+	}
+	if lifetime := binary.BigEndian.Uint16(final[6:8]); lifetime != 0 {
+		t.Errorf("router lifetime = %d, want 0", lifetime)
+	}
+	// Source Link-Layer Address, then Prefix Information, then RDNSS
+	info, rdnss := final[24:56], final[56:]
+	if valid := binary.BigEndian.Uint32(info[4:8]); valid != raValidLifetime {
+		t.Errorf("valid lifetime = %d, want it unchanged", valid)
+	}
+	if preferred := binary.BigEndian.Uint32(info[8:12]); preferred != 0 {
+		t.Errorf("preferred lifetime = %d, want 0", preferred)
+	}
+	if lifetime := binary.BigEndian.Uint32(rdnss[4:8]); rdnss[0] != 25 || lifetime != 0 {
+		t.Errorf("rdnss option = % x, want a zero lifetime", rdnss)
+	}
+	if !bytes.Equal(final[8:32], original[8:32]) || !bytes.Equal(final[36:60], original[36:60]) || !bytes.Equal(final[64:], original[64:]) {
+		t.Errorf("final advertisement changed more than the lifetimes: % x", final)
+	}
+}
@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+//go:embed templates/rescue-config.yml
+var rescue_cfg_file string
+
+var rescueConfig = template.Must(template.New("rescue-config.yml").Funcs(templateFuncs).Parse(rescue_cfg_file))
+
+// Data Handed to the Rescue Cloud Config Template
+type rescueTemplateData struct {
+	*templateData
+	Rescue *message.Rescue
+	// SHA-512 crypt Hash of the Rescue Password, Empty Without One
+	RescueHash string
+}
+
+// The Rescue Domain is Defined Next to the VM's Own Domain, which is Left
+// Untouched so Exiting Rescue Only has to Start it Again. Its Disk and
+// Seed are Named After it Like any Other Domain's
+func rescueData(data *message.VMData) *message.VMData {
+	rescue := *data
+	rescue.ID = data.ID + "-rescue"
+	rescue.Password = ""
+	// The Rescue System Only Brings up the Primary Interface
+	rescue.Interfaces = nil
+	rescue.Networks = nil
+	return &rescue
+}
+
+func RescueDomain(data *message.VMData) string {
+	return rescueData(data).ID
+}
+
+func ValidateRescue(profile *Profile, rescue *message.Rescue) error {
+	if profile.NetworkFormat != NetworkFormatNetplan {
+		return fmt.Errorf("rescue os %s must use netplan network config", profile.Name)
+	}
+	if rescue.Password == "" && len(rescue.SSHKeys) == 0 {
+		return fmt.Errorf("rescue needs a password or an ssh key")
+	}
+	if strings.ContainsAny(rescue.Password, "\r\n") {
+		return fmt.Errorf("rescue password must not contain line breaks")
+	}
+	for _, key := range rescue.SSHKeys {
+		if strings.TrimSpace(key) == "" || strings.ContainsAny(key, "\r\n") {
+			return fmt.Errorf("invalid rescue ssh key")
+		}
+	}
+	return nil
+}
+
+// Stop the VM and Boot a Rescue Domain from the Rescue Profile's Image,
+// with the VM's Disk Attached as vdb and the Rescue Credentials Injected
+// Through its Seed. On Failure the VM is Started Again
+func EnterRescue(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData, rescue *message.Rescue) error {
+	if err := ValidateRescue(profile, rescue); err != nil {
+		l.Error("invalid rescue request", zap.String("id", data.ID), zap.Error(err))
+		return err
+	}
+	baseImage, err := BaseImagePath(profile.Image)
+	if err != nil {
+		l.Error("unable to locate rescue image", zap.String("image", profile.Image), zap.Error(err))
+		return err
+	}
+	rescueVM := rescueData(data)
+	if err = RunSteps(l, []Step{
+		{
+			Name: "seed",
+			Do:   func() error { return createRescueSeed(l, ex, profile, rescueVM, rescue) },
+			Undo: func() error { return removeFiles(seedPath(rescueVM.ID)) },
+		},
+		{
+			Name: "disk",
+			Do:   func() error { return createDisk(l, ex, baseImage, rescueVM) },
+			Undo: func() error { return removeFiles(diskPath(rescueVM.ID)) },
+		},
+		{
+			Name: "stop",
+			Do:   func() error { return stopDomain(l, ex, data.ID) },
+			Undo: func() error { return startDomain(l, ex, data.ID) },
+		},
+		{
+			Name: "virt-install",
+			Do:   func() error { return installRescueDomain(l, ex, profile, data, rescueVM) },
+			Undo: func() error { return undefineDomain(l, ex, rescueVM) },
+		},
+	}); err != nil {
+		return err
+	}
+	l.Info("Successfully Entered Rescue for Domain " + data.ID)
+	return nil
+}
+
+// Tear Down the Rescue Domain and Boot the VM from its Own Disk Again
+func ExitRescue(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	if err := DeleteRescue(l, ex, data); err != nil {
+		return err
+	}
+	if err := startDomain(l, ex, data.ID); err != nil {
+		return err
+	}
+	l.Info("Successfully Exited Rescue for Domain " + data.ID)
+	return nil
+}
+
+// Remove the Rescue Domain and its Files, Leaving the VM Stopped
+func DeleteRescue(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	rescueVM := rescueData(data)
+	if err := undefineDomain(l, ex, rescueVM); err != nil {
+		return err
+	}
+	if err := removeFiles(diskPath(rescueVM.ID), seedPath(rescueVM.ID)); err != nil {
+		l.Error(
+			"unable to delete rescue files from host",
+			zap.String("path", config.VMPath),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Keep a Rescued VM Stopped and its Rescue Domain Running, e.g. After a
+// Host Reboot Autostarted the VM
+func ResumeRescue(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	ex.Output("virsh", "destroy", data.ID)
+	return startDomain(l, ex, RescueDomain(data))
+}
+
+// How Often stopDomain Checks Whether the Guest has Shut Down
+var shutdownPollInterval = time.Second
+
+// Ask a Domain to Shut Down and Wait up to the Shutdown Timeout for the
+// Guest to Power Off, Only Then Destroying it. A Domain Already Shut Off
+// is Left Alone
+func stopDomain(l *zap.Logger, ex executor.Executor, id string) error {
+	if state, err := ex.Output("virsh", "domstate", id); err == nil && strings.TrimSpace(string(state)) == "shut off" {
+		return nil
+	}
+	if output, err := ex.CombinedOutput("virsh", "shutdown", id); err != nil {
+		l.Error(
+			"unable to shutdown domain",
+			zap.String("command", "virsh shutdown "+id),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+	}
+	deadline := time.Now().Add(time.Duration(config.ShutdownTimeout) * time.Second)
+	for {
+		if state, err := ex.Output("virsh", "domstate", id); err == nil && strings.TrimSpace(string(state)) == "shut off" {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	l.Error("domain ignored shutdown request, destroying it", zap.String("domain", id))
+	if output, err := ex.CombinedOutput("virsh", "destroy", id); err != nil && !strings.Contains(string(output), "not running") {
+		l.Error(
+			"unable to destroy domain",
+			zap.String("command", "virsh destroy "+id),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Start a Defined Domain, Treating One Already Running as Started
+func startDomain(l *zap.Logger, ex executor.Executor, id string) error {
+	if output, err := ex.CombinedOutput("virsh", "start", id); err != nil && !strings.Contains(string(output), "already active") {
+		l.Error(
+			"unable to start domain",
+			zap.String("command", "virsh start "+id),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Create a NoCloud Seed Setting up the Rescue Credentials Instead of the
+// VM's Own Config
+func createRescueSeed(l *zap.Logger, ex executor.Executor, profile *Profile, rescueVM *message.VMData, rescue *message.Rescue) error {
+	defer removeFiles(
+		tempPath(rescueVM.ID, "cloud-config.yml"),
+		tempPath(rescueVM.ID, "network-config.yml"),
+	)
+	tmplData := newTemplateData(profile, rescueVM)
+	rescueTmplData := &rescueTemplateData{templateData: tmplData, Rescue: rescue}
+	if rescue.Password != "" {
+		hash, err := hashPassword(rescue.Password)
+		if err != nil {
+			l.Error("failed to hash rescue password", zap.String("id", rescueVM.ID), zap.Error(err))
+			return err
+		}
+		rescueTmplData.RescueHash = hash
+	}
+	var cloudConfig, networkConfig bytes.Buffer
+	if err := rescueConfig.Execute(&cloudConfig, rescueTmplData); err != nil {
+		l.Error("failed to execute rescue config template", zap.String("id", rescueVM.ID), zap.Error(err))
+		return err
+	}
+	if err := profile.networkConfig.Execute(&networkConfig, tmplData); err != nil {
+		l.Error("failed to execute netplan config", zap.String("id", rescueVM.ID), zap.Error(err))
+		return err
+	}
+	for name, content := range map[string][]byte{
+		"cloud-config.yml":   cloudConfig.Bytes(),
+		"network-config.yml": networkConfig.Bytes(),
+	} {
+		if err := os.WriteFile(tempPath(rescueVM.ID, name), content, 0600); err != nil {
+			l.Error("failed to write rescue seed config", zap.String("file", rescueVM.ID+"-"+name), zap.Error(err))
+			return err
+		}
+	}
+	if output, err := ex.Output(
+		"cloud-localds",
+		"-v",
+		"--network-config="+tempPath(rescueVM.ID, "network-config.yml"),
+		seedPath(rescueVM.ID),
+		tempPath(rescueVM.ID, "cloud-config.yml"),
+	); err != nil {
+		l.Error(
+			"unable to create rescue cloud-init image",
+			zap.String(
+				"command",
+				fmt.Sprintf("cloud-localds -v --network-config=%s %s %s", tempPath(rescueVM.ID, "network-config.yml"), seedPath(rescueVM.ID), tempPath(rescueVM.ID, "cloud-config.yml")),
+			),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Define and Start the Rescue Domain. It Takes Over the VM's Primary
+// Interface, and is Not Autostarted, as Reconciling Restarts it
+func installRescueDomain(l *zap.Logger, ex executor.Executor, profile *Profile, data *message.VMData, rescueVM *message.VMData) error {
+	args := []string{
+		"--boot", profile.Boot,
+		"--arch", "aarch64",
+	}
+	if profile.Machine != "" {
+		args = append(args, "--machine", profile.Machine)
+	}
+	args = append(args,
+		"--name", rescueVM.ID,
+		"--memory", fmt.Sprintf("%d", data.Memory*1024),
+		"--vcpus", fmt.Sprintf("%d", data.Vcpus),
+		"--network", fmt.Sprintf("bridge=vbr%d,model=virtio,mac=%s", data.Index, data.MAC),
+		"--import",
+		"--disk", fmt.Sprintf("path=%s,bus=virtio", diskPath(rescueVM.ID)),
+		"--disk", fmt.Sprintf("path=%s,bus=virtio%s", diskPath(data.ID), iotuneDiskOptions(&data.IOTune)),
+		"--disk", fmt.Sprintf("path=%s,device=cdrom", seedPath(rescueVM.ID)),
+		"--nographics", "--noautoconsole",
+	)
+	if output, err := ex.Output("virt-install", args...); err != nil {
+		l.Error(
+			"unable to run virt-install for rescue domain",
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Commands Expected to Boot a Rescue Domain, up to and Including virt-install
+func expectEnterRescue(fake *executor.Fake, data *message.VMData, virtInstallErr error) {
+	rescueID := data.ID + "-rescue"
+	fake.Expect(fmt.Sprintf(
+		"cloud-localds -v --network-config=%s %s %s",
+		tempPath(rescueID, "network-config.yml"), seedPath(rescueID), tempPath(rescueID, "cloud-config.yml"),
+	), "", nil)
+	fake.Expect(fmt.Sprintf(
+		"qemu-img create -f qcow2 -F qcow2 -o backing_file=%s %s",
+		filepath.Join(config.ImagePath, "debian.qcow2"), diskPath(rescueID),
+	), "", nil)
+	fake.Expect("virsh domstate "+data.ID, "running\n", nil)
+	fake.Expect("virsh shutdown "+data.ID, "", nil)
+	fake.Expect("virsh domstate "+data.ID, "shut off\n", nil)
+	fake.Expect(fmt.Sprintf(
+		"virt-install --boot uefi --arch aarch64 --name %s --memory 4096 --vcpus 2 "+
+			"--network bridge=vbr4,model=virtio,mac=52:54:00:00:00:04 --import --disk path=%s,bus=virtio "+
+			"--disk path=%s,bus=virtio --disk path=%s,device=cdrom --nographics --noautoconsole",
+		rescueID, diskPath(rescueID), diskPath(data.ID), seedPath(rescueID),
+	), "", virtInstallErr)
+}
+
+func TestEnterRescue(t *testing.T) {
+	testPaths(t)
+	data := multihomedVM()
+	fake := executor.NewFake()
+	expectEnterRescue(fake, data, nil)
+
+	if err := EnterRescue(zap.NewNop(), fake, debianProfile(t), data, &message.Rescue{Password: "hunter2"}); err != nil {
+		t.Fatalf("EnterRescue: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(tempPath(RescueDomain(data), "cloud-config.yml")); !os.IsNotExist(err) {
+		t.Error("rescue config left behind in the temp path")
+	}
+}
+
+func TestEnterRescueRollsBack(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	rescueID := RescueDomain(data)
+	fake := executor.NewFake()
+	expectEnterRescue(fake, data, errors.New("exit status 1"))
+	fake.Expect("virsh destroy "+rescueID, "", errors.New("exit status 1"))
+	fake.Expect("virsh undefine --nvram "+rescueID, "error: failed to get domain", errors.New("exit status 1"))
+	fake.Expect("virsh start "+data.ID, "", nil)
+	for _, path := range []string{diskPath(rescueID), seedPath(rescueID)} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := EnterRescue(zap.NewNop(), fake, debianProfile(t), data, &message.Rescue{SSHKeys: []string{"ssh-ed25519 AAAA admin"}})
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "virt-install" {
+		t.Fatalf("EnterRescue error = %v, want virt-install step error", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	for _, path := range []string{diskPath(rescueID), seedPath(rescueID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after rollback", path)
+		}
+	}
+}
+
+func TestStopDomainFallsBackToDestroy(t *testing.T) {
+	testPaths(t)
+	config.ShutdownTimeout = 0
+	data := debianVM()
+	fake := executor.NewFake().
+		Expect("virsh domstate "+data.ID, "running\n", nil).
+		Expect("virsh shutdown "+data.ID, "", nil).
+		Expect("virsh domstate "+data.ID, "running\n", nil).
+		Expect("virsh destroy "+data.ID, "", nil)
+	if err := stopDomain(zap.NewNop(), fake, data.ID); err != nil {
+		t.Fatalf("stopDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStopDomainAlreadyShutOff(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	fake := executor.NewFake().Expect("virsh domstate "+data.ID, "shut off\n", nil)
+	if err := stopDomain(zap.NewNop(), fake, data.ID); err != nil {
+		t.Fatalf("stopDomain: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExitRescue(t *testing.T) {
+	testPaths(t)
+	data := debianVM()
+	rescueID := RescueDomain(data)
+	for _, path := range []string{diskPath(rescueID), seedPath(rescueID), diskPath(data.ID)} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := executor.NewFake().
+		Expect("virsh destroy "+rescueID, "", nil).
+		Expect("virsh undefine --nvram "+rescueID, "", nil).
+		Expect("virsh start "+data.ID, "error: Domain is already active", errors.New("exit status 1"))
+
+	if err := ExitRescue(zap.NewNop(), fake, data); err != nil {
+		t.Fatalf("ExitRescue: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+	for _, path := range []string{diskPath(rescueID), seedPath(rescueID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+	if _, err := os.Stat(diskPath(data.ID)); err != nil {
+		t.Errorf("domain disk was removed: %v", err)
+	}
+}
+
+func TestRescueConfig(t *testing.T) {
+	profile := debianProfile(t)
+	rescue := &message.Rescue{Password: `p"w`, SSHKeys: []string{"ssh-ed25519 AAAA admin"}}
+	var cloudConfig bytes.Buffer
+	tmplData := &rescueTemplateData{
+		templateData: newTemplateData(profile, rescueData(debianVM())),
+		Rescue:       rescue,
+		RescueHash:   sha512Crypt(rescue.Password, "saltstring"),
+	}
+	if err := rescueConfig.Execute(&cloudConfig, tmplData); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"hostname: debian-box-rescue\n",
+		`      - "ssh-ed25519 AAAA admin"` + "\n",
+		`  list: "root:` + tmplData.RescueHash + `"` + "\n",
+		"ssh_pwauth: true\n",
+	} {
+		if !strings.Contains(cloudConfig.String(), want) {
+			t.Errorf("rescue config is missing %q:\n%s", want, cloudConfig.String())
+		}
+	}
+}
+
+func TestValidateRescue(t *testing.T) {
+	profile := debianProfile(t)
+	tests := []struct {
+		name    string
+		rescue  message.Rescue
+		wantErr bool
+	}{
+		{"password", message.Rescue{Password: "hunter2"}, false},
+		{"ssh key", message.Rescue{SSHKeys: []string{"ssh-ed25519 AAAA admin"}}, false},
+		{"no credentials", message.Rescue{}, true},
+		{"password with line break", message.Rescue{Password: "a\nb"}, true},
+		{"multi-line key", message.Rescue{SSHKeys: []string{"ssh-ed25519 AAAA\nssh-rsa BBBB"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRescue(profile, &tt.rescue); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRescue error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+// Frames Entering a Bridge from its VM are Dispatched Through the bridges
+// Verdict Map to that Bridge's Chain in the bridge hydrogen Table
+const spoofTable = "bridge hydrogen"
+
+func spoofChain(data *message.VMData) string {
+	return fmt.Sprintf("spoof%d", data.Index)
+}
+
+// Locally Administered MAC Derived from the Bridge Index, Unique per PoP
+func MACAddress(index int) string {
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", byte(index>>16), byte(index>>8), byte(index))
+}
+
+// Shared Table, Prerouting Hook and Verdict Map, Safe to Repeat in Every Script
+func spoofBase() []string {
+	return []string{
+		"add table " + spoofTable,
+		"add chain " + spoofTable + " prerouting { type filter hook prerouting priority -200; policy accept; }",
+		"add map " + spoofTable + " bridges { type ifname : verdict; }",
+		"flush chain " + spoofTable + " prerouting",
+		"add rule " + spoofTable + " prerouting meta ibrname vmap @bridges",
+	}
+}
+
+// Rules Dropping Frames the VM has No Business Sending: Foreign MACs,
+// Router Advertisements, IPv6 Sources Outside its /64, its Routed Prefixes
+// and Link-Local, and IPv4 or ARP Sources Other than its Mapped IPv4 Address
+func spoofRules(data *message.VMData) ([]string, error) {
+	mac, err := net.ParseMAC(data.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("domain %s: invalid mac address %q", data.ID, data.MAC)
+	}
+	_, prefix, err := net.ParseCIDR(data.Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("domain %s: invalid prefix %q", data.ID, data.Prefix)
+	}
+	sources := []string{"::", "fe80::/10", prefix.String()}
+	for _, route := range data.Routes {
+		_, routed, err := net.ParseCIDR(route)
+		if err != nil || routed.IP.To4() != nil {
+			return nil, fmt.Errorf("domain %s: invalid route %q", data.ID, route)
+		}
+		sources = append(sources, routed.String())
+	}
+	ipv4Sources := ipv4Sources(data)
+	if ipv4Sources == nil {
+		return nil, fmt.Errorf("domain %s: invalid ipv4 address %q", data.ID, data.IPv4Address)
+	}
+	return []string{
+		"ether saddr != " + mac.String() + " drop",
+		"arp saddr ether != " + mac.String() + " drop",
+		"icmpv6 type nd-router-advert drop",
+		"ip6 saddr != { " + strings.Join(sources, ", ") + " } drop",
+		"ip saddr != { " + strings.Join(ipv4Sources, ", ") + " } drop",
+		"arp saddr ip != { " + strings.Join(ipv4Sources, ", ") + " } drop",
+	}, nil
+}
+
+// IPv4 Sources the VM may Use: the Unspecified Address for DHCP and ARP
+// Probes, and its Mapped Address if it has One. Nil if the Address is Invalid
+func ipv4Sources(data *message.VMData) []string {
+	sources := []string{"0.0.0.0"}
+	if data.IPv4Address == "" {
+		return sources
+	}
+	ip := net.ParseIP(data.IPv4Address).To4()
+	if ip == nil {
+		return nil
+	}
+	return append(sources, ip.String())
+}
+
+// Render an nft Script that Replaces the Bridge's Filter in One Transaction
+func RenderSpoofFilter(data *message.VMData) (string, error) {
+	rules, err := spoofRules(data)
+	if err != nil {
+		return "", err
+	}
+	chain := spoofTable + " " + spoofChain(data)
+	lines := append(spoofBase(), "add chain "+chain, "flush chain "+chain)
+	for _, rule := range rules {
+		lines = append(lines, "add rule "+chain+" "+rule)
+	}
+	lines = append(lines, fmt.Sprintf(`add element %s bridges { "vbr%d" : jump %s }`, spoofTable, data.Index, spoofChain(data)))
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Render an nft Script Removing the Bridge's Filter, Whether or Not it Exists
+func RenderSpoofFilterRemoval(data *message.VMData) string {
+	chain := spoofTable + " " + spoofChain(data)
+	lines := append(spoofBase(),
+		"add chain "+chain,
+		fmt.Sprintf(`add element %s bridges { "vbr%d" : jump %s }`, spoofTable, data.Index, spoofChain(data)),
+		fmt.Sprintf(`delete element %s bridges { "vbr%d" }`, spoofTable, data.Index),
+		"delete chain "+chain,
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func ApplySpoofFilter(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	script, err := RenderSpoofFilter(data)
+	if err != nil {
+		l.Error("unable to render source filter", zap.String("domain", data.ID), zap.Error(err))
+		return err
+	}
+	return runNft(l, ex, tempPath(data.ID, "spoof.nft"), script)
+}
+
+func RemoveSpoofFilter(l *zap.Logger, ex executor.Executor, data *message.VMData) error {
+	return runNft(l, ex, tempPath(data.ID, "spoof.nft"), RenderSpoofFilterRemoval(data))
+}
+
+// Check the Bridge's Filter is Installed for the Domain's Current MAC,
+// Prefix, Routes and IPv4 Address. nft Reorders Set Elements When Listing, so Only Key Parts are
+// Compared. Any Error Listing it Counts as Missing
+func SpoofFilterInstalled(ex executor.Executor, data *message.VMData) bool {
+	output, err := ex.Output("nft", "list", "chain", "bridge", "hydrogen", spoofChain(data))
+	if err != nil {
+		return false
+	}
+	mac, err := net.ParseMAC(data.MAC)
+	if err != nil {
+		return false
+	}
+	_, prefix, err := net.ParseCIDR(data.Prefix)
+	if err != nil {
+		return false
+	}
+	parts := []string{
+		"ether saddr != " + mac.String() + " drop",
+		"arp saddr ether != " + mac.String() + " drop",
+		"nd-router-advert",
+		prefix.String(),
+		"ip saddr != ",
+		"arp saddr ip != ",
+	}
+	for _, route := range data.Routes {
+		if _, routed, err := net.ParseCIDR(route); err == nil {
+			parts = append(parts, routed.String())
+		}
+	}
+	parts = append(parts, ipv4Sources(data)...)
+	for _, part := range parts {
+		if !strings.Contains(string(output), part) {
+			return false
+		}
+	}
+	return true
+}
+
+// MAC Address of the Domain's Interface on its Bridge, According to libvirt
+func DomainMAC(ex executor.Executor, data *message.VMData) (string, error) {
+	output, err := ex.Output("virsh", "domiflist", data.ID)
+	if err != nil {
+		return "", err
+	}
+	bridge := fmt.Sprintf("vbr%d", data.Index)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 5 && fields[2] == bridge {
+			return fields[4], nil
+		}
+	}
+	return "", fmt.Errorf("domain %s has no interface on %s", data.ID, bridge)
+}
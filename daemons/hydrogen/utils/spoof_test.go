@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+)
+
+func TestMACAddress(t *testing.T) {
+	tests := map[int]string{
+		4:      "52:54:00:00:00:04",
+		300:    "52:54:00:00:01:2c",
+		65535:  "52:54:00:00:ff:ff",
+		123456: "52:54:00:01:e2:40",
+	}
+	for index, want := range tests {
+		if got := MACAddress(index); got != want {
+			t.Errorf("MACAddress(%d) = %s, want %s", index, got, want)
+		}
+	}
+}
+
+func TestRenderSpoofFilter(t *testing.T) {
+	script, err := RenderSpoofFilter(debianVM())
+	if err != nil {
+		t.Fatalf("RenderSpoofFilter: %v", err)
+	}
+	want := strings.Join([]string{
+		"add chain bridge hydrogen spoof4",
+		"flush chain bridge hydrogen spoof4",
+		"add rule bridge hydrogen spoof4 ether saddr != 52:54:00:00:00:04 drop",
+		"add rule bridge hydrogen spoof4 arp saddr ether != 52:54:00:00:00:04 drop",
+		"add rule bridge hydrogen spoof4 icmpv6 type nd-router-advert drop",
+		"add rule bridge hydrogen spoof4 ip6 saddr != { ::, fe80::/10, 2001:db8:0:4::/64 } drop",
+		"add rule bridge hydrogen spoof4 ip saddr != { 0.0.0.0 } drop",
+		"add rule bridge hydrogen spoof4 arp saddr ip != { 0.0.0.0 } drop",
+		`add element bridge hydrogen bridges { "vbr4" : jump spoof4 }`,
+	}, "\n") + "\n"
+	if !strings.HasSuffix(script, want) {
+		t.Errorf("RenderSpoofFilter =\n%s\nwant it to end with\n%s", script, want)
+	}
+
+	withIPv4 := debianVM()
+	withIPv4.IPv4Address = "192.0.2.10"
+	script, err = RenderSpoofFilter(withIPv4)
+	if err != nil {
+		t.Fatalf("RenderSpoofFilter: %v", err)
+	}
+	for _, rule := range []string{"ip saddr != { 0.0.0.0, 192.0.2.10 } drop", "arp saddr ip != { 0.0.0.0, 192.0.2.10 } drop"} {
+		if !strings.Contains(script, rule) {
+			t.Errorf("RenderSpoofFilter does not allow the mapped ipv4 address, missing %q", rule)
+		}
+	}
+
+	bad := debianVM()
+	bad.MAC = ""
+	if _, err := RenderSpoofFilter(bad); err == nil {
+		t.Error("RenderSpoofFilter accepted a domain without a mac address")
+	}
+	bad = debianVM()
+	bad.Prefix = "2001:db8:0:4::/64 } accept"
+	if _, err := RenderSpoofFilter(bad); err == nil {
+		t.Error("RenderSpoofFilter accepted an invalid prefix")
+	}
+	bad = debianVM()
+	bad.IPv4Address = "192.0.2.10 } accept"
+	if _, err := RenderSpoofFilter(bad); err == nil {
+		t.Error("RenderSpoofFilter accepted an invalid ipv4 address")
+	}
+}
+
+func TestSpoofFilterInstalled(t *testing.T) {
+	data := debianVM()
+	fake := executor.NewFake()
+	fake.Expect("nft list chain bridge hydrogen spoof4", installedSpoofChain, nil)
+	fake.Expect("nft list chain bridge hydrogen spoof4", "", errors.New("No such file or directory"))
+	if !SpoofFilterInstalled(fake, data) {
+		t.Error("installed filter reported missing")
+	}
+	if SpoofFilterInstalled(fake, data) {
+		t.Error("missing filter reported installed")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Chains Missing any of the Source Checks are Replaced
+func TestSpoofFilterInstalledMissingRules(t *testing.T) {
+	tests := map[string]string{
+		"ether saddr": "\t\tether saddr != 52:54:00:00:00:04 drop\n",
+		"arp ether":   "\t\tarp saddr ether != 52:54:00:00:00:04 drop\n",
+		"ip saddr":    "\t\tip saddr != 0.0.0.0 drop\n",
+		"arp ip":      "\t\tarp saddr ip != 0.0.0.0 drop\n",
+	}
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := executor.NewFake()
+			fake.Expect("nft list chain bridge hydrogen spoof4", strings.Replace(installedSpoofChain, rule, "", 1), nil)
+			if SpoofFilterInstalled(fake, debianVM()) {
+				t.Errorf("chain without %q reported installed", strings.TrimSpace(rule))
+			}
+		})
+	}
+	// A Mapped IPv4 Address has to be Allowed by the Installed Chain
+	data := debianVM()
+	data.IPv4Address = "192.0.2.10"
+	fake := executor.NewFake().Expect("nft list chain bridge hydrogen spoof4", installedSpoofChain, nil)
+	if SpoofFilterInstalled(fake, data) {
+		t.Error("chain without the ipv4 address reported installed")
+	}
+}
+
+func TestDomainMAC(t *testing.T) {
+	data := debianVM()
+	output := ` Interface   Type     Source   Model    MAC
+-----------------------------------------------------------
+ vnet0       bridge   vbr4     virtio   52:54:00:ab:cd:ef
+
+`
+	fake := executor.NewFake().Expect("virsh domiflist "+data.ID, output, nil)
+	if mac, err := DomainMAC(fake, data); err != nil || mac != "52:54:00:ab:cd:ef" {
+		t.Errorf("DomainMAC = %q, %v", mac, err)
+	}
+	fake.Expect("virsh domiflist "+data.ID, "", errors.New("failed to get domain"))
+	if _, err := DomainMAC(fake, data); err == nil {
+		t.Error("DomainMAC succeeded for a missing domain")
+	}
+}
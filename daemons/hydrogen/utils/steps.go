@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// A Provisioning Step and the Compensating Action that Reverts it. Undo
+// may be Nil, and Must Tolerate a Partially Applied Do
+type Step struct {
+	Name string
+	Do   func() error
+	Undo func() error
+}
+
+// Failure of a Single Step, Returned After Earlier Steps were Rolled Back
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Run Steps in Order. If One Fails, Undo it and Every Step Before it in
+// Reverse Order. Nested Step Errors are Returned As-Is so the Innermost
+// Failed Step is Reported
+func RunSteps(l *zap.Logger, steps []Step) error {
+	for i, step := range steps {
+		err := step.Do()
+		if err == nil {
+			continue
+		}
+		for j := i; j >= 0; j-- {
+			if steps[j].Undo == nil {
+				continue
+			}
+			if undoErr := steps[j].Undo(); undoErr != nil {
+				l.Error(
+					"unable to roll back step",
+					zap.String("step", steps[j].Name),
+					zap.Error(undoErr),
+				)
+			}
+		}
+		var stepErr *StepError
+		if errors.As(err, &stepErr) {
+			return err
+		}
+		return &StepError{Step: step.Name, Err: err}
+	}
+	return nil
+}
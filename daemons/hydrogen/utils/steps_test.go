@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRunStepsRollsBack(t *testing.T) {
+	var log []string
+	step := func(name string, fail error) Step {
+		return Step{
+			Name: name,
+			Do: func() error {
+				log = append(log, "do "+name)
+				return fail
+			},
+			Undo: func() error {
+				log = append(log, "undo "+name)
+				return nil
+			},
+		}
+	}
+	cause := errors.New("qemu-img failed")
+	err := RunSteps(zap.NewNop(), []Step{step("seed", nil), step("disk", cause), step("resize", nil)})
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "disk" || !errors.Is(err, cause) {
+		t.Fatalf("RunSteps error = %v, want disk step wrapping %v", err, cause)
+	}
+	want := []string{"do seed", "do disk", "undo disk", "undo seed"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("steps ran as %v, want %v", log, want)
+	}
+}
+
+func TestRunStepsKeepsInnermostStep(t *testing.T) {
+	inner := func() error {
+		return RunSteps(zap.NewNop(), []Step{{Name: "virt-install", Do: func() error { return errors.New("boom") }}})
+	}
+	err := RunSteps(zap.NewNop(), []Step{{Name: "domain", Do: inner}})
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "virt-install" {
+		t.Errorf("RunSteps error = %v, want the virt-install step", err)
+	}
+	if err := RunSteps(zap.NewNop(), []Step{{Name: "ok", Do: func() error { return nil }}}); err != nil {
+		t.Errorf("RunSteps = %v, want nil", err)
+	}
+}
@@ -0,0 +1,32 @@
+#!/bin/sh
+# Network Configuration
+cat >> /etc/rc.conf <<'AARCH64_RC_CONF'
+{{ .NetworkConfig }}AARCH64_RC_CONF
+cat > /etc/resolv.conf <<'AARCH64_RESOLV_CONF'{{ range .Nameservers }}
+nameserver {{ . }}
+{{- end }}
+AARCH64_RESOLV_CONF
+hostname {{ shquote .Hostname }}
+service netif restart
+service routing restart
+# Root Access
+{{- with .PasswordHash }}
+echo {{ shquote . }} | pw usermod root -H 0
+{{- end }}
+sed -i '' -E 's/^#?PermitRootLogin[[:space:]].*/PermitRootLogin yes/' /etc/ssh/sshd_config
+service sshd restart
+# Guest Agent
+env ASSUME_ALWAYS_YES=yes pkg install qemu-guest-agent
+sysrc qemu_guest_agent_enable=YES
+service qemu-guest-agent start
+{{- range .Profile.RunCmd }}
+{{ . }}
+{{- end }}
+{{- with .UserData }}
+# User Supplied User-Data
+cat > /var/tmp/user-data <<'AARCH64_USER_DATA'
+{{ . }}
+AARCH64_USER_DATA
+chmod 700 /var/tmp/user-data
+/var/tmp/user-data
+{{- end }}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// Maximum Size of User Supplied User-Data in Bytes
+const MaxUserDataSize = 16 * 1024
+
+// Merge User Cloud Configs into the Platform One Without Replacing Any of the
+// Platform's Keys, so Hostname, Password and Network Steps Always Run
+const userDataMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+var ErrUserDataTooLarge = fmt.Errorf("user-data exceeds %d bytes", MaxUserDataSize)
+var ErrUserDataFormat = errors.New("user-data must be a cloud-config or a shell script")
+
+// Detect the MIME Type of User Supplied User-Data
+func userDataContentType(userData string) (string, error) {
+	switch {
+	case strings.HasPrefix(userData, "#cloud-config"):
+		return "text/cloud-config", nil
+	case strings.HasPrefix(userData, "#!"):
+		return "text/x-shellscript", nil
+	}
+	return "", ErrUserDataFormat
+}
+
+// Validate User Supplied User-Data Before Any Resources are Created
+func ValidateUserData(userData string) error {
+	if userData == "" {
+		return nil
+	}
+	if len(userData) > MaxUserDataSize {
+		return ErrUserDataTooLarge
+	}
+	_, err := userDataContentType(userData)
+	return err
+}
+
+// Combine the Platform Cloud Config with the User's User-Data as a Multipart
+// MIME Document. The Platform Config is Returned Untouched if No User-Data
+// was Supplied
+func BuildUserData(platform []byte, userData string) ([]byte, error) {
+	if userData == "" {
+		return platform, nil
+	}
+	if err := ValidateUserData(userData); err != nil {
+		return nil, err
+	}
+	contentType, _ := userDataContentType(userData)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	// Platform Config Comes First so its Keys Take Precedence when Merging
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`text/cloud-config; charset="utf-8"`},
+		"Content-Disposition": {`attachment; filename="platform.yml"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(platform); err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":        {contentType + `; charset="utf-8"`},
+		"Content-Disposition": {`attachment; filename="user-data"`},
+	}
+	if contentType == "text/cloud-config" {
+		header.Set("Merge-Type", userDataMergeType)
+	}
+	if part, err = writer.CreatePart(header); err != nil {
+		return nil, err
+	}
+	if _, err = part.Write([]byte(userData)); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var document bytes.Buffer
+	fmt.Fprintf(&document, "Content-Type: multipart/mixed; boundary=\"%s\"\n", writer.Boundary())
+	fmt.Fprintf(&document, "MIME-Version: 1.0\n\n")
+	document.Write(body.Bytes())
+	return document.Bytes(), nil
+}
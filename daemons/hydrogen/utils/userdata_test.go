@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserData(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData string
+		wantErr  error
+	}{
+		{"empty", "", nil},
+		{"cloud config", "#cloud-config\npackages: [htop]\n", nil},
+		{"shell script", "#!/bin/sh\necho hi\n", nil},
+		{"largest allowed", "#!/bin/sh\n" + strings.Repeat("#", MaxUserDataSize-10), nil},
+		{"oversized", "#!/bin/sh\n" + strings.Repeat("#", MaxUserDataSize), ErrUserDataTooLarge},
+		{"unknown format", "packages: [htop]\n", ErrUserDataFormat},
+		{"leading whitespace", " #cloud-config\n", ErrUserDataFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateUserData(tt.userData); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateUserData error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A Rendered Part of a Multipart User-Data Document
+type userDataPart struct {
+	contentType string
+	mergeType   string
+	body        string
+}
+
+func parseUserData(t *testing.T, document []byte) []userDataPart {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(document)))
+	if err != nil {
+		t.Fatalf("user-data is not a MIME document: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("user-data content type = %q, want multipart/mixed", msg.Header.Get("Content-Type"))
+	}
+	var parts []userDataPart
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		parts = append(parts, userDataPart{
+			contentType: part.Header.Get("Content-Type"),
+			mergeType:   part.Header.Get("Merge-Type"),
+			body:        string(body),
+		})
+	}
+	return parts
+}
+
+func TestBuildUserData(t *testing.T) {
+	platform := []byte("#cloud-config\nhostname: box\n")
+	tests := []struct {
+		name          string
+		userData      string
+		wantErr       error
+		wantType      string
+		wantMergeType string
+	}{
+		{"cloud config", "#cloud-config\npackages: [htop]\n", nil, "text/cloud-config", userDataMergeType},
+		{"shell script", "#!/bin/sh\necho hi\n", nil, "text/x-shellscript", ""},
+		{"oversized", "#!/bin/sh\n" + strings.Repeat("#", MaxUserDataSize), ErrUserDataTooLarge, "", ""},
+		{"invalid", "hostname: evil\n", ErrUserDataFormat, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document, err := BuildUserData(platform, tt.userData)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("BuildUserData error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			parts := parseUserData(t, document)
+			if len(parts) != 2 {
+				t.Fatalf("user-data has %d parts, want 2", len(parts))
+			}
+			if parts[0].body != string(platform) || !strings.HasPrefix(parts[0].contentType, "text/cloud-config") {
+				t.Errorf("first part = %+v, want the platform config", parts[0])
+			}
+			if parts[1].body != tt.userData || !strings.HasPrefix(parts[1].contentType, tt.wantType) {
+				t.Errorf("second part = %+v, want the user's %s", parts[1], tt.wantType)
+			}
+			if parts[1].mergeType != tt.wantMergeType {
+				t.Errorf("merge type = %q, want %q", parts[1].mergeType, tt.wantMergeType)
+			}
+		})
+	}
+}
+
+func TestBuildUserDataWithoutUserData(t *testing.T) {
+	platform := []byte("#cloud-config\nhostname: box\n")
+	document, err := BuildUserData(platform, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(document) != string(platform) {
+		t.Errorf("BuildUserData = %q, want the platform config untouched", document)
+	}
+}
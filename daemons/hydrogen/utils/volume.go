@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+var ErrVolumeExists = errors.New("volume already exists")
+
+// The Guest did Not Release a Volume in Time. Detaching it Again Picks up
+// Where the Previous Attempt Left Off
+var ErrDetachTimeout = errors.New("volume is still attached to the running domain, retry the detach")
+
+// Volume IDs End up in File Names and Device XML
+var volumeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func VolumePath(id string) string {
+	return filepath.Join(config.VMPath, id+"-volume.qcow2")
+}
+
+// Whether a Domain's XML has a Disk Backed by the Volume. libvirt Quotes
+// Attributes with Single Quotes
+func VolumeInXML(xml string, id string) bool {
+	return strings.Contains(xml, "'"+VolumePath(id)+"'")
+}
+
+// Disks of a Domain Definition
+type domainDisks struct {
+	Disks []struct {
+		Source struct {
+			File string `xml:"file,attr"`
+		} `xml:"source"`
+		Target struct {
+			Dev string `xml:"dev,attr"`
+		} `xml:"target"`
+	} `xml:"devices>disk"`
+}
+
+// Volumes Attached to a Domain, Read Back from the Disks in its Definition.
+// Only the ID and Target are Known from the Disk Itself
+func ParseVolumeDisks(domainXML string) ([]message.Volume, error) {
+	var disks domainDisks
+	if err := xml.Unmarshal([]byte(domainXML), &disks); err != nil {
+		return nil, err
+	}
+	var volumes []message.Volume
+	for _, disk := range disks.Disks {
+		if id, ok := volumeID(disk.Source.File); ok {
+			volumes = append(volumes, message.Volume{ID: id, Target: disk.Target.Dev})
+		}
+	}
+	return volumes, nil
+}
+
+// IDs of All Volume Images on the Host
+func VolumeImages() ([]string, error) {
+	paths, err := filepath.Glob(VolumePath("*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, path := range paths {
+		if id, ok := volumeID(path); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Volume ID of an Image Path, if it is a Volume Image
+func volumeID(path string) (string, bool) {
+	if filepath.Dir(path) != filepath.Clean(config.VMPath) {
+		return "", false
+	}
+	id := strings.TrimSuffix(filepath.Base(path), "-volume.qcow2")
+	if id == filepath.Base(path) || !volumeIDPattern.MatchString(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// Size in GB of a Volume's Image. qemu Holds a Lock on Attached Volumes,
+// which Only Reading the Header Overrides
+func VolumeImageSize(l *zap.Logger, ex executor.Executor, id string) (int, error) {
+	path := VolumePath(id)
+	output, err := ex.Output("qemu-img", "info", "-U", "--output=json", path)
+	if err != nil {
+		l.Error(
+			"unable to read volume size",
+			zap.String("command", "qemu-img info -U --output=json "+path),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return 0, err
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err = json.Unmarshal(output, &info); err != nil {
+		l.Error("invalid qemu-img info output", zap.String("path", path), zap.Error(err))
+		return 0, err
+	}
+	return int(info.VirtualSize >> 30), nil
+}
+
+func ValidateVolume(vol *message.Volume) error {
+	if !volumeIDPattern.MatchString(vol.ID) {
+		return fmt.Errorf("invalid volume id %q", vol.ID)
+	}
+	if vol.Size <= 0 {
+		return fmt.Errorf("volume %s: size must be positive", vol.ID)
+	}
+	return nil
+}
+
+// Create an Empty qcow2 Image for a Volume, Refusing to Overwrite One
+func CreateVolumeImage(l *zap.Logger, ex executor.Executor, vol *message.Volume) error {
+	path := VolumePath(vol.ID)
+	if _, err := os.Stat(path); err == nil {
+		l.Error("unable to create volume", zap.String("path", path), zap.Error(ErrVolumeExists))
+		return ErrVolumeExists
+	}
+	if output, err := ex.CombinedOutput("qemu-img", "create", "-f", "qcow2", path, fmt.Sprintf("%dG", vol.Size)); err != nil {
+		l.Error(
+			"unable to create volume",
+			zap.String("command", fmt.Sprintf("qemu-img create -f qcow2 %s %dG", path, vol.Size)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// Grow a Detached Volume's Image. Attached Volumes are Resized Through
+// libvirt, as qemu Holds a Lock on their Image
+func ResizeVolumeImage(l *zap.Logger, ex executor.Executor, vol *message.Volume) error {
+	path := VolumePath(vol.ID)
+	if output, err := ex.CombinedOutput("qemu-img", "resize", path, fmt.Sprintf("%dG", vol.Size)); err != nil {
+		l.Error(
+			"unable to resize volume",
+			zap.String("command", fmt.Sprintf("qemu-img resize %s %dG", path, vol.Size)),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+func DeleteVolumeImage(l *zap.Logger, vol *message.Volume) error {
+	if err := removeFiles(VolumePath(vol.ID)); err != nil {
+		l.Error("unable to delete volume", zap.String("path", VolumePath(vol.ID)), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Device XML Attaching a Volume as a virtio Disk, Limited Like the
+// Domain's Other Disks. The Serial Shows up in the Guest Under
+// /dev/disk/by-id/virtio-<id>, Truncated to 20 Characters
+func VolumeXML(vol *message.Volume, tune *message.IOTune) string {
+	return fmt.Sprintf(
+		`<disk type='file' device='disk'><driver name='qemu' type='qcow2'/><source file='%s'/><target dev='%s' bus='virtio'/>%s<serial>%s</serial></disk>`,
+		VolumePath(vol.ID), vol.Target, iotuneXML(tune), vol.ID,
+	)
+}
+
+// First Free Guest Device for Another Volume on a Domain. vda is the Root Disk
+func FreeTarget(volumes map[string]message.Volume, domain string) (string, error) {
+	taken := map[string]bool{"vda": true}
+	for _, vol := range volumes {
+		if vol.Domain == domain {
+			taken[vol.Target] = true
+		}
+	}
+	for c := 'b'; c <= 'z'; c++ {
+		if target := "vd" + string(c); !taken[target] {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("domain %s has no free volume slot", domain)
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/executor"
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+	"go.uber.org/zap"
+)
+
+func TestCreateVolumeImage(t *testing.T) {
+	testPaths(t)
+	vol := &message.Volume{ID: "vol-1", Size: 20}
+	fake := executor.NewFake().Expect("qemu-img create -f qcow2 "+VolumePath("vol-1")+" 20G", "", nil)
+	if err := CreateVolumeImage(zap.NewNop(), fake, vol); err != nil {
+		t.Fatalf("CreateVolumeImage: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// Existing Data is Never Overwritten
+	if err := os.WriteFile(VolumePath("vol-1"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateVolumeImage(zap.NewNop(), executor.NewFake(), vol); err != ErrVolumeExists {
+		t.Errorf("CreateVolumeImage over an existing image = %v, want ErrVolumeExists", err)
+	}
+}
+
+func TestValidateVolume(t *testing.T) {
+	for _, vol := range []message.Volume{
+		{ID: "", Size: 1},
+		{ID: "../etc/passwd", Size: 1},
+		{ID: "vol'/><disk", Size: 1},
+		{ID: "vol-1", Size: 0},
+	} {
+		if err := ValidateVolume(&vol); err == nil {
+			t.Errorf("ValidateVolume accepted %+v", vol)
+		}
+	}
+	if err := ValidateVolume(&message.Volume{ID: "60f1c1a2b3c4d5e6f7a8b9c2", Size: 10}); err != nil {
+		t.Errorf("ValidateVolume: %v", err)
+	}
+}
+
+func TestFreeTarget(t *testing.T) {
+	volumes := map[string]message.Volume{
+		"a": {ID: "a", Domain: "vm1", Target: "vdb"},
+		"b": {ID: "b", Domain: "vm1", Target: "vdd"},
+		"c": {ID: "c", Domain: "vm2", Target: "vdc"},
+		"d": {ID: "d"},
+	}
+	if target, err := FreeTarget(volumes, "vm1"); err != nil || target != "vdc" {
+		t.Errorf("FreeTarget = %s, %v, want vdc", target, err)
+	}
+	if target, err := FreeTarget(volumes, "vm3"); err != nil || target != "vdb" {
+		t.Errorf("FreeTarget = %s, %v, want vdb", target, err)
+	}
+}
+
+func TestVolumeXML(t *testing.T) {
+	testPaths(t)
+	xml := VolumeXML(&message.Volume{ID: "vol-1", Target: "vdb"}, &message.IOTune{})
+	for _, want := range []string{"<source file='" + VolumePath("vol-1") + "'/>", "<target dev='vdb' bus='virtio'/><serial>vol-1</serial>"} {
+		if !strings.Contains(xml, want) {
+			t.Errorf("VolumeXML = %s, missing %s", xml, want)
+		}
+	}
+}
+
+func TestVolumeXMLIOTune(t *testing.T) {
+	xml := VolumeXML(&message.Volume{ID: "vol-1", Target: "vdb"}, &message.IOTune{ReadIOPS: 500, WriteMBps: 100})
+	if !strings.Contains(xml, "<iotune><read_iops_sec>500</read_iops_sec><write_bytes_sec>104857600</write_bytes_sec></iotune>") {
+		t.Errorf("VolumeXML = %s, missing iotune", xml)
+	}
+}
+
+func TestParseVolumeDisks(t *testing.T) {
+	testPaths(t)
+	domainXML := "<domain type='kvm'><name>vm1</name><devices>" +
+		"<disk type='file' device='disk'><source file='" + diskPath("vm1") + "'/><target dev='vda' bus='virtio'/></disk>" +
+		VolumeXML(&message.Volume{ID: "vol-1", Target: "vdc"}, &message.IOTune{}) +
+		"<disk type='file' device='cdrom'><source file='" + seedPath("vm1") + "'/><target dev='sda' bus='sata'/></disk>" +
+		"</devices></domain>"
+	volumes, err := ParseVolumeDisks(domainXML)
+	if err != nil {
+		t.Fatalf("ParseVolumeDisks: %v", err)
+	}
+	if len(volumes) != 1 || volumes[0] != (message.Volume{ID: "vol-1", Target: "vdc"}) {
+		t.Errorf("ParseVolumeDisks = %+v, want vol-1 on vdc", volumes)
+	}
+}
+
+func TestVolumeImageSize(t *testing.T) {
+	testPaths(t)
+	fake := executor.NewFake().Expect(
+		"qemu-img info -U --output=json "+VolumePath("vol-1"),
+		`{"virtual-size": 21474836480, "filename": "vol-1-volume.qcow2", "format": "qcow2"}`, nil,
+	)
+	if size, err := VolumeImageSize(zap.NewNop(), fake, "vol-1"); err != nil || size != 20 {
+		t.Errorf("VolumeImageSize = %d, %v, want 20", size, err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Error(err)
+	}
+}
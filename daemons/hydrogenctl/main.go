@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/admin"
+	"github.com/fosshostorg/aarch64/daemons/internal/commons"
+)
+
+const usage = `Usage: hydrogenctl [flags] <command>
+
+Commands:
+  vms                    List cached VMs and their libvirt state
+  bridges                Show the state of every expected bridge
+  status                 Show queue and worker status
+  reconcile              Bring the host in line with the caches
+  resync                 Reload the caches from disk, then reconcile
+  replay <action> <vm>   Run an action again with the VM's cached data
+
+Flags:
+`
+
+func main() {
+	var configPath, socket string
+	var asJSON bool
+	flag.StringVar(&configPath, "config", commons.ConfigPath, "The path to the daemon configuration file")
+	flag.StringVar(&socket, "socket", "", "The hydrogen control socket, overriding the config file")
+	flag.BoolVar(&asJSON, "json", false, "Print responses as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if socket == "" {
+		cfg, err := commons.LoadConfig(configPath)
+		if err != nil {
+			fail(err)
+		}
+		socket = cfg.Hydrogen.ControlSocket
+	}
+	client := admin.NewClient(socket)
+
+	var (
+		response interface{}
+		err      error
+	)
+	switch args := flag.Args(); args[0] {
+	case "vms":
+		response, err = client.VMs()
+	case "bridges":
+		response, err = client.Bridges()
+	case "status":
+		response, err = client.Status()
+	case "reconcile":
+		err = client.Reconcile()
+	case "resync":
+		err = client.Resync()
+	case "replay":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		response, err = client.Replay(admin.ReplayRequest{Action: args[1], ID: args[2]})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+		return
+	}
+	printTable(os.Stdout, response)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "hydrogenctl: %s\n", err)
+	os.Exit(1)
+}
+
+// Print a Response as a Table
+func printTable(out io.Writer, response interface{}) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	switch r := response.(type) {
+	case []admin.VM:
+		fmt.Fprintln(w, "ID\tHOSTNAME\tPROJECT\tOS\tBRIDGE\tADDRESS\tSTATE")
+		for _, vm := range r {
+			state := vm.State
+			if vm.RescueState != "" {
+				state += " (rescue " + vm.RescueState + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\tvbr%d\t%s\t%s\n", vm.ID, vm.Hostname, vm.Project, vm.Os, vm.Index, vm.Address, state)
+		}
+	case []admin.Bridge:
+		fmt.Fprintln(w, "BRIDGE\tOWNER\tEXISTS\tUP\tSPOOF FILTER")
+		for _, bridge := range r {
+			owner := bridge.Domain
+			if bridge.VNI != 0 {
+				owner = fmt.Sprintf("network %d", bridge.VNI)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", bridge.Name, owner, yesNo(bridge.Exists), yesNo(bridge.Up), yesNo(bridge.SpoofFilter || bridge.VNI != 0))
+		}
+	case admin.Status:
+		worker := "idle"
+		if r.Worker.Busy {
+			worker = "busy"
+		}
+		if r.Worker.Action != "" {
+			worker += fmt.Sprintf(" (%s since %s)", r.Worker.Action, r.Worker.Since.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "Started:\t%s\n", r.Started.Format(time.RFC3339))
+		fmt.Fprintf(w, "Cached:\t%d domains, %d networks, %d volumes\n", r.Domains, r.Networks, r.Volumes)
+		fmt.Fprintf(w, "Queue:\t%s/%s, %d connections\n", r.Queue.Topic, r.Queue.Channel, r.Queue.Connections)
+		fmt.Fprintf(w, "Messages:\t%d received, %d finished, %d requeued\n", r.Queue.Received, r.Queue.Finished, r.Queue.Requeued)
+		fmt.Fprintf(w, "Starved:\t%s\n", yesNo(r.Queue.Starved))
+		fmt.Fprintf(w, "Worker:\t%s, %d handled\n", worker, r.Worker.Handled)
+	case nil:
+		fmt.Fprintln(w, "ok")
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(r)
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
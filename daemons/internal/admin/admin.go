@@ -0,0 +1,169 @@
+// Package admin Holds the Types and Client of Hydrogen's Local Control
+// Socket, a Small JSON over HTTP API Served on a Unix Socket
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+// Endpoints, GET for Reports and POST for Operations
+const (
+	PathVMs       = "/vms"
+	PathBridges   = "/bridges"
+	PathStatus    = "/status"
+	PathReconcile = "/reconcile"
+	PathResync    = "/resync"
+	PathReplay    = "/replay"
+)
+
+// A Cached VM with the State libvirt Reports for it
+type VM struct {
+	message.VMData
+	State string `json:"state"`
+	// State of the Rescue Domain, Only for Rescued VMs
+	RescueState string `json:"rescue_state,omitempty"`
+}
+
+// A Bridge Hydrogen Expects on the Host, Either a VM Interface's or a
+// Private Network's
+type Bridge struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain,omitempty"`
+	VNI    int    `json:"vni,omitempty"`
+	Exists bool   `json:"exists"`
+	Up     bool   `json:"up"`
+	// Source Filter of a VM Interface is in Place
+	SpoofFilter bool `json:"spoof_filter"`
+}
+
+type Status struct {
+	Started  time.Time `json:"started"`
+	Domains  int       `json:"domains"`
+	Networks int       `json:"networks"`
+	Volumes  int       `json:"volumes"`
+	Queue    Queue     `json:"queue"`
+	Worker   Worker    `json:"worker"`
+}
+
+// The NSQ Consumer Hydrogen Takes Actions From
+type Queue struct {
+	Topic       string `json:"topic"`
+	Channel     string `json:"channel"`
+	Connections int    `json:"connections"`
+	Received    uint64 `json:"received"`
+	Finished    uint64 `json:"finished"`
+	Requeued    uint64 `json:"requeued"`
+	Starved     bool   `json:"starved"`
+}
+
+// The Handler Working Through Actions One at a Time
+type Worker struct {
+	Busy bool `json:"busy"`
+	// Action Being Handled, or Last Handled when Idle
+	Action  string    `json:"action"`
+	Since   time.Time `json:"since"`
+	Handled uint64    `json:"handled"`
+}
+
+// Run an Action Again for a Cached VM, with the VM Data from the Cache
+type ReplayRequest struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Client for the Control Socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+func (c *Client) VMs() (vms []VM, err error) {
+	return vms, c.do(http.MethodGet, PathVMs, nil, &vms)
+}
+
+func (c *Client) Bridges() (bridges []Bridge, err error) {
+	return bridges, c.do(http.MethodGet, PathBridges, nil, &bridges)
+}
+
+func (c *Client) Status() (status Status, err error) {
+	return status, c.do(http.MethodGet, PathStatus, nil, &status)
+}
+
+func (c *Client) Reconcile() error {
+	return c.do(http.MethodPost, PathReconcile, nil, nil)
+}
+
+func (c *Client) Resync() error {
+	return c.do(http.MethodPost, PathResync, nil, nil)
+}
+
+// Replay an Action, Returning its Result if the Action Publishes One
+func (c *Client) Replay(request ReplayRequest) (result *message.Result, err error) {
+	return result, c.do(http.MethodPost, PathReplay, request, &result)
+}
+
+func (c *Client) do(method string, path string, body interface{}, v interface{}) error {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	// The Host is Ignored, Every Request Goes to the Socket
+	request, err := http.NewRequest(method, "http://hydrogen"+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var failure errorResponse
+		if err := json.NewDecoder(response.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("hydrogen responded %s", response.Status)
+		}
+		return fmt.Errorf("%s", failure.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Write v as a JSON Response
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write an Error Response the Client Turns Back into an Error
+func WriteError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
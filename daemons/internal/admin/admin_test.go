@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func serve(t *testing.T, mux *http.ServeMux) *Client {
+	socket := filepath.Join(t.TempDir(), "hydrogen.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return NewClient(socket)
+}
+
+func TestClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathVMs, func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, []VM{{VMData: message.VMData{ID: "abc", Index: 4}, State: "running"}})
+	})
+	mux.HandleFunc(PathReplay, func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusNotFound, errors.New("unknown domain abc"))
+	})
+	client := serve(t, mux)
+
+	vms, err := client.VMs()
+	if err != nil {
+		t.Fatalf("VMs: %v", err)
+	}
+	if len(vms) != 1 || vms[0].ID != "abc" || vms[0].Index != 4 || vms[0].State != "running" {
+		t.Errorf("VMs = %+v", vms)
+	}
+	if _, err := client.Replay(ReplayRequest{Action: "add_domain", ID: "abc"}); err == nil || err.Error() != "unknown domain abc" {
+		t.Errorf("Replay error = %v, want the server's error", err)
+	}
+	if err := client.Reconcile(); err == nil {
+		t.Error("Reconcile against a missing endpoint succeeded")
+	}
+}
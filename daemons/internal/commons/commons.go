@@ -2,6 +2,7 @@ package commons
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,13 +13,8 @@ import (
 	"github.com/nsqio/go-nsq"
 )
 
-var NSQCoreUrl = "[fd0d:944c:1337:aa64:1::]:4150"
-var ProxyConfigPath = "/usr/local/openresty/nginx/conf/nginx.conf"
-var ProxyCachePath = "/etc/berrylium.json"
-var DomainCachePath = "/etc/hydrogen.json"
-
-func GetMachineID() int64 {
-	content, err := ioutil.ReadFile("/etc/mid")
+func GetMachineID(path string) int64 {
+	content, err := ioutil.ReadFile(path)
 
 	if err != nil {
 		log.Printf("Error reading machine ID: %s \n", err)
@@ -42,6 +38,20 @@ func GetHostname() string {
 	return host
 }
 
+// Split a Hypervisor Hostname into its PoP Name and Host Index, e.g.
+// "ams1" is Host 1 of the "ams" PoP
+func SplitHostname(hostname string) (string, int, error) {
+	pop := strings.TrimRight(hostname, "0123456789")
+	if pop == "" || pop == hostname {
+		return "", 0, fmt.Errorf("hostname %q is not a pop name followed by a host index", hostname)
+	}
+	index, err := strconv.Atoi(hostname[len(pop):])
+	if err != nil {
+		return "", 0, err
+	}
+	return pop, index, nil
+}
+
 func CreateNSQConsumer(uri string, topic string, channel string, handler nsq.Handler) *nsq.Consumer {
 	consumer, err := nsq.NewConsumer(topic, channel, nsq.NewConfig())
 	if err != nil {
@@ -55,8 +65,8 @@ func CreateNSQConsumer(uri string, topic string, channel string, handler nsq.Han
 	return consumer
 }
 
-func GetSnow() *snowflake.Node {
-	mid := GetMachineID()
+func GetSnow(machineIDPath string) *snowflake.Node {
+	mid := GetMachineID(machineIDPath)
 	snow, _ := snowflake.NewNode(mid)
 	return snow
 }
@@ -0,0 +1,23 @@
+package commons
+
+import "testing"
+
+func TestSplitHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		pop      string
+		index    int
+		wantErr  bool
+	}{
+		{"ams1", "ams", 1, false},
+		{"fra12", "fra", 12, false},
+		{"ams", "", 0, true},
+		{"42", "", 0, true},
+	}
+	for _, tt := range tests {
+		pop, index, err := SplitHostname(tt.hostname)
+		if (err != nil) != tt.wantErr || pop != tt.pop || index != tt.index {
+			t.Errorf("SplitHostname(%q) = %q, %d, %v", tt.hostname, pop, index, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package commons
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Default Location of the Shared Daemon Configuration File
+var ConfigPath = "/etc/aarch64/daemons.yml"
+
+// Prefix of Environment Variables Overriding Config Values, e.g.
+// AARCH64_NSQ_URI or AARCH64_HYDROGEN_VM_PATH
+const envPrefix = "AARCH64"
+
+type Config struct {
+	NSQ           NSQConfig       `yaml:"nsq"`
+	MachineIDPath string          `yaml:"machine_id_path"`
+	Hydrogen      HydrogenConfig  `yaml:"hydrogen"`
+	Helium        HeliumConfig    `yaml:"helium"`
+	Beryllium     BerylliumConfig `yaml:"beryllium"`
+}
+
+type NSQConfig struct {
+	URI string `yaml:"uri"`
+}
+
+type HydrogenConfig struct {
+	LibvirtSocket   string   `yaml:"libvirt_socket"`
+	DomainCachePath string   `yaml:"domain_cache_path"`
+	OSProfilePath   string   `yaml:"os_profile_path"`
+	VMPath          string   `yaml:"vm_path"`
+	ImagePath       string   `yaml:"image_path"`
+	TempPath        string   `yaml:"temp_path"`
+	Nameservers     []string `yaml:"nameservers"`
+	// Seconds Between Capacity Reports
+	CapacityInterval int     `yaml:"capacity_interval"`
+	CPUOvercommit    float64 `yaml:"cpu_overcommit"`
+	MemoryOvercommit float64 `yaml:"memory_overcommit"`
+	// Reported to the API so No New Domains are Placed on this Host
+	Disabled bool `yaml:"disabled"`
+	// Public IPv4 Addresses or CIDR Blocks Handed Out to Domains
+	IPv4Pool        []string `yaml:"ipv4_pool"`
+	TaygaConfigPath string   `yaml:"tayga_config_path"`
+	TaygaService    string   `yaml:"tayga_service"`
+	NAT64Interface  string   `yaml:"nat64_interface"`
+	// Seconds Between Router Advertisements on VM Bridges, 0 Disables them
+	RAInterval int `yaml:"ra_interval"`
+	// Private Project Networks, Tunnelled from this Host's vxlan_local Address
+	NetworkCachePath string `yaml:"network_cache_path"`
+	VXLANLocal       string `yaml:"vxlan_local"`
+	VXLANPort        int    `yaml:"vxlan_port"`
+	// OS Profile Whose Image and Network Config Rescue Domains Use
+	RescueOS string `yaml:"rescue_os"`
+	// Seconds a Guest Gets to Act on an ACPI Shutdown, and then on a Guest
+	// Agent Shutdown
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	// Unix Socket hydrogenctl Talks to, Accessible to Root Only
+	ControlSocket string `yaml:"control_socket"`
+	// Seconds a Base Image Download may Take, and its Largest Accepted Size
+	// in GB, so a Stalled or Runaway Mirror Can't Hold up the Handler
+	ImageDownloadTimeout int `yaml:"image_download_timeout"`
+	MaxImageSize         int `yaml:"max_image_size"`
+	// Seconds to Wait for a Guest to Release a Volume Being Detached
+	VolumeDetachTimeout int `yaml:"volume_detach_timeout"`
+}
+
+type HeliumConfig struct {
+	MongoURI string `yaml:"mongo_uri"`
+}
+
+type BerylliumConfig struct {
+	ProxyConfigPath string `yaml:"proxy_config_path"`
+	ProxyCachePath  string `yaml:"proxy_cache_path"`
+	OpenrestyPath   string `yaml:"openresty_path"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		NSQ: NSQConfig{
+			URI: "[fd0d:944c:1337:aa64:1::]:4150",
+		},
+		MachineIDPath: "/etc/mid",
+		Hydrogen: HydrogenConfig{
+			LibvirtSocket:        "/var/run/libvirt/libvirt-sock",
+			DomainCachePath:      "/etc/hydrogen.json",
+			OSProfilePath:        "/etc/hydrogen/profiles",
+			VMPath:               "/opt/aarch64/vms",
+			ImagePath:            "/opt/aarch64/images",
+			TempPath:             "/tmp",
+			Nameservers:          []string{"2606:4700:4700::64", "2606:4700:4700::6400"},
+			CapacityInterval:     60,
+			CPUOvercommit:        1,
+			MemoryOvercommit:     1,
+			IPv4Pool:             []string{},
+			TaygaConfigPath:      "/etc/tayga.conf",
+			TaygaService:         "tayga",
+			NAT64Interface:       "nat64",
+			RAInterval:           60,
+			NetworkCachePath:     "/etc/hydrogen-networks.json",
+			VXLANPort:            4789,
+			RescueOS:             "debian",
+			ShutdownTimeout:      60,
+			ControlSocket:        "/run/hydrogen.sock",
+			ImageDownloadTimeout: 3600,
+			MaxImageSize:         20,
+			VolumeDetachTimeout:  30,
+		},
+		Helium: HeliumConfig{
+			MongoURI: "mongodb://localhost/aarch64",
+		},
+		Beryllium: BerylliumConfig{
+			ProxyConfigPath: "/usr/local/openresty/nginx/conf/nginx.conf",
+			ProxyCachePath:  "/etc/berrylium.json",
+			OpenrestyPath:   "/usr/bin/openresty",
+		},
+	}
+}
+
+// Load the Config File on Top of the Defaults and Apply Environment
+// Overrides. A Missing File is Only an Error if it is Not the Default Path
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = yaml.UnmarshalStrict(content, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && path == ConfigPath:
+	default:
+		return nil, err
+	}
+	if err = applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Override Fields from Environment Variables Named after their YAML Keys
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Slice:
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(n)
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetFloat(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("%s: unsupported config type %s", name, field.Kind())
+		}
+	}
+	return nil
+}
+
+// Validate Settings Shared by Every Daemon
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.NSQ.URI); err != nil {
+		return fmt.Errorf("nsq.uri: %w", err)
+	}
+	if c.MachineIDPath == "" {
+		return errors.New("machine_id_path must be set")
+	}
+	return nil
+}
+
+func (c *HydrogenConfig) Validate() error {
+	if err := requireSet("hydrogen",
+		"libvirt_socket", c.LibvirtSocket,
+		"domain_cache_path", c.DomainCachePath,
+		"os_profile_path", c.OSProfilePath,
+		"vm_path", c.VMPath,
+		"image_path", c.ImagePath,
+		"temp_path", c.TempPath,
+		"network_cache_path", c.NetworkCachePath,
+		"rescue_os", c.RescueOS,
+		"control_socket", c.ControlSocket,
+	); err != nil {
+		return err
+	}
+	if len(c.Nameservers) == 0 {
+		return errors.New("hydrogen.nameservers must not be empty")
+	}
+	for _, nameserver := range c.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("hydrogen.nameservers: invalid address %q", nameserver)
+		}
+	}
+	for _, entry := range c.IPv4Pool {
+		if !strings.Contains(entry, "/") {
+			entry += "/32"
+		}
+		if ip, _, err := net.ParseCIDR(entry); err != nil || ip.To4() == nil {
+			return fmt.Errorf("hydrogen.ipv4_pool: invalid entry %q", entry)
+		}
+	}
+	if len(c.IPv4Pool) > 0 {
+		if err := requireSet("hydrogen",
+			"tayga_config_path", c.TaygaConfigPath,
+			"tayga_service", c.TaygaService,
+			"nat64_interface", c.NAT64Interface,
+		); err != nil {
+			return err
+		}
+	}
+	if c.VXLANLocal != "" && net.ParseIP(c.VXLANLocal) == nil {
+		return fmt.Errorf("hydrogen.vxlan_local: invalid address %q", c.VXLANLocal)
+	}
+	if c.VXLANPort < 1 || c.VXLANPort > 65535 {
+		return errors.New("hydrogen.vxlan_port must be a valid port")
+	}
+	if c.RAInterval < 0 {
+		return errors.New("hydrogen.ra_interval must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("hydrogen.shutdown_timeout must be positive")
+	}
+	if c.ImageDownloadTimeout <= 0 {
+		return errors.New("hydrogen.image_download_timeout must be positive")
+	}
+	if c.MaxImageSize <= 0 {
+		return errors.New("hydrogen.max_image_size must be positive")
+	}
+	if c.VolumeDetachTimeout <= 0 {
+		return errors.New("hydrogen.volume_detach_timeout must be positive")
+	}
+	if c.CapacityInterval <= 0 {
+		return errors.New("hydrogen.capacity_interval must be positive")
+	}
+	if c.CPUOvercommit < 1 || c.MemoryOvercommit < 1 {
+		return errors.New("hydrogen.cpu_overcommit and hydrogen.memory_overcommit must be at least 1")
+	}
+	return nil
+}
+
+func (c *HeliumConfig) Validate() error {
+	if _, err := url.Parse(c.MongoURI); err != nil || c.MongoURI == "" {
+		return fmt.Errorf("helium.mongo_uri: invalid uri %q", c.MongoURI)
+	}
+	return nil
+}
+
+func (c *BerylliumConfig) Validate() error {
+	return requireSet("beryllium",
+		"proxy_config_path", c.ProxyConfigPath,
+		"proxy_cache_path", c.ProxyCachePath,
+		"openresty_path", c.OpenrestyPath,
+	)
+}
+
+// Return an Error Naming the First Empty Key, Given Alternating Keys and Values
+func requireSet(section string, keyValues ...string) error {
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i+1] == "" {
+			return fmt.Errorf("%s.%s must be set", section, keyValues[i])
+		}
+	}
+	return nil
+}
+
+// Render the Effective Config as YAML with Credentials Redacted
+func (c *Config) String() string {
+	redacted := *c
+	if u, err := url.Parse(c.Helium.MongoURI); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			redacted.Helium.MongoURI = u.String()
+		}
+	}
+	out, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
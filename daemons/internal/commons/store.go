@@ -0,0 +1,163 @@
+package commons
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+var ErrCorruptState = errors.New("state file is corrupt")
+
+// Upgrade a Document from One Schema Version to the Next
+type Migration func(data []byte) ([]byte, error)
+
+// Crash-Safe JSON State File. Writes go Through a Temporary File that is
+// Synced and Renamed into Place, with the Previous Generation Kept as a Backup
+type Store struct {
+	Path    string
+	Version int
+	// Migrations Keyed by the Version they Upgrade From. Files Written
+	// Before Versioning are Version 0
+	Migrations map[int]Migration
+}
+
+// On-Disk Layout of a Versioned State File
+type storeEnvelope struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func NewStore(path string, version int, migrations map[int]Migration) *Store {
+	return &Store{
+		Path:       path,
+		Version:    version,
+		Migrations: migrations,
+	}
+}
+
+func (s *Store) BackupPath() string {
+	return s.Path + ".bak"
+}
+
+// Atomically Replace the State File, Keeping the Old One as the Backup
+func (s *Store) Save(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(storeEnvelope{Version: s.Version, Data: data})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.Path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Keep the Current Generation as the Backup, Without Ever Leaving the
+	// Path Empty. A Corrupt Current File is Never Promoted to the Backup
+	if _, loadErr := s.load(s.Path, nil); loadErr == nil {
+		backupTmp := s.BackupPath() + ".tmp"
+		os.Remove(backupTmp)
+		if err = os.Link(s.Path, backupTmp); err == nil {
+			err = os.Rename(backupTmp, s.BackupPath())
+		}
+		if err != nil {
+			log.Printf("Unable to back up %s: %s \n", s.Path, err)
+		}
+	}
+	if err = os.Rename(tmpPath, s.Path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(s.Path))
+}
+
+// Load the State File into v, Falling Back to the Backup if it is Corrupt.
+// Returns False if Neither Exists, and ErrCorruptState if No Usable Copy
+// Remains so Callers Never Silently Start from an Empty State
+func (s *Store) Load(v interface{}) (bool, error) {
+	found, err := s.load(s.Path, v)
+	if err == nil {
+		if found {
+			return true, nil
+		}
+		// A Crash Between Backup and Rename can Leave Only the Backup
+		return s.load(s.BackupPath(), v)
+	}
+	log.Printf("Unable to load %s, trying backup: %s \n", s.Path, err)
+	// Drop Anything Partially Decoded from the Corrupt File
+	target := reflect.ValueOf(v).Elem()
+	target.Set(reflect.Zero(target.Type()))
+	found, backupErr := s.load(s.BackupPath(), v)
+	if backupErr != nil || !found {
+		return false, fmt.Errorf("%w: %s: %v", ErrCorruptState, s.Path, err)
+	}
+	log.Printf("Recovered state from %s \n", s.BackupPath())
+	return true, nil
+}
+
+// Decode and Migrate a Single State File. v may be Nil to Only Validate it
+func (s *Store) load(path string, v interface{}) (bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(content, &fields); err != nil {
+		return false, err
+	}
+	envelope := storeEnvelope{Data: content}
+	if _, ok := fields["version"]; ok && fields["data"] != nil {
+		if err = json.Unmarshal(content, &envelope); err != nil {
+			return false, err
+		}
+	}
+	if envelope.Version > s.Version {
+		return false, fmt.Errorf("schema version %d is newer than supported version %d", envelope.Version, s.Version)
+	}
+	for version := envelope.Version; version < s.Version; version++ {
+		migrate, ok := s.Migrations[version]
+		if !ok {
+			return false, fmt.Errorf("no migration from schema version %d", version)
+		}
+		if envelope.Data, err = migrate(envelope.Data); err != nil {
+			return false, fmt.Errorf("migrating from schema version %d: %w", version, err)
+		}
+	}
+	if v == nil {
+		var discard interface{}
+		return true, json.Unmarshal(envelope.Data, &discard)
+	}
+	return true, json.Unmarshal(envelope.Data, v)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
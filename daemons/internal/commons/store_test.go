@@ -0,0 +1,120 @@
+package commons
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testStore(t *testing.T, migrations map[int]Migration) *Store {
+	t.Helper()
+	return NewStore(filepath.Join(t.TempDir(), "state.json"), 1, migrations)
+}
+
+func TestStoreRoundTripKeepsBackup(t *testing.T) {
+	store := testStore(t, nil)
+	if err := store.Save(map[string]string{"a": "1"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := os.Stat(store.BackupPath()); !os.IsNotExist(err) {
+		t.Errorf("first save should not create a backup, stat = %v", err)
+	}
+	if err := store.Save(map[string]string{"a": "2"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	var current map[string]string
+	if found, err := store.Load(&current); err != nil || !found {
+		t.Fatalf("Load = %v, %v", found, err)
+	}
+	if current["a"] != "2" {
+		t.Errorf("Load = %v, want latest generation", current)
+	}
+	backup, err := os.ReadFile(store.BackupPath())
+	if err != nil || !strings.Contains(string(backup), `"a":"1"`) {
+		t.Errorf("backup = %s, %v, want previous generation", backup, err)
+	}
+}
+
+func TestStoreLoadMissing(t *testing.T) {
+	var state map[string]string
+	found, err := testStore(t, nil).Load(&state)
+	if err != nil || found {
+		t.Errorf("Load = %v, %v, want not found", found, err)
+	}
+}
+
+func TestStoreCorruptFallsBackToBackup(t *testing.T) {
+	store := testStore(t, nil)
+	store.Save(map[string]string{"a": "1"})
+	store.Save(map[string]string{"a": "2"})
+	if err := os.WriteFile(store.Path, []byte(`{"version":1,"data":{"a":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var state map[string]string
+	if found, err := store.Load(&state); err != nil || !found {
+		t.Fatalf("Load = %v, %v, want backup", found, err)
+	}
+	if !reflect.DeepEqual(state, map[string]string{"a": "1"}) {
+		t.Errorf("Load = %v, want backup generation", state)
+	}
+
+	// A Save Over a Corrupt File Must Not Overwrite the Good Backup
+	if err := store.Save(map[string]string{"a": "3"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	backup, _ := os.ReadFile(store.BackupPath())
+	if !strings.Contains(string(backup), `"a":"1"`) {
+		t.Errorf("backup = %s, corrupt file replaced the good backup", backup)
+	}
+}
+
+func TestStoreCorruptWithoutBackup(t *testing.T) {
+	store := testStore(t, nil)
+	if err := os.WriteFile(store.Path, []byte("{truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var state map[string]string
+	if _, err := store.Load(&state); !errors.Is(err, ErrCorruptState) {
+		t.Errorf("Load error = %v, want ErrCorruptState", err)
+	}
+}
+
+func TestStoreMigrations(t *testing.T) {
+	migrations := map[int]Migration{
+		0: func(data []byte) ([]byte, error) {
+			return []byte(strings.Replace(string(data), `"old"`, `"new"`, 1)), nil
+		},
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"unversioned", `{"old":"x"}`, map[string]string{"new": "x"}, false},
+		{"version 0 envelope", `{"version":0,"data":{"old":"x"}}`, map[string]string{"new": "x"}, false},
+		{"current version", `{"version":1,"data":{"old":"x"}}`, map[string]string{"old": "x"}, false},
+		{"newer version", `{"version":2,"data":{}}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t, migrations)
+			if err := os.WriteFile(store.Path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var state map[string]string
+			_, err := store.Load(&state)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(state, tt.want) {
+				t.Errorf("Load = %v, want %v", state, tt.want)
+			}
+		})
+	}
+}
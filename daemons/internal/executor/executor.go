@@ -0,0 +1,35 @@
+package executor
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Runs External Commands. Hypervisor and Proxy Code Takes an Executor
+// Rather than Calling os/exec Directly, so it can be Tested with a Fake
+type Executor interface {
+	// Run a Command and Return its Standard Output
+	Output(name string, args ...string) ([]byte, error)
+	// Run a Command and Return its Standard Output and Error Combined
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// Executor Running Commands on the Host
+type Exec struct{}
+
+func New() Executor {
+	return Exec{}
+}
+
+func (Exec) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (Exec) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Render a Command the Way it would be Typed, for Logs and Fakes
+func CommandLine(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), " ")
+}
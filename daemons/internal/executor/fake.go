@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Scripted Response to an Expected Command
+type expectation struct {
+	command string
+	output  []byte
+	err     error
+}
+
+// Executor that Records Every Command and Returns Scripted Responses.
+// Commands Must Arrive Exactly in the Order they were Expected
+type Fake struct {
+	mutex    sync.Mutex
+	expected []expectation
+	Calls    []string
+	errs     []string
+}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+// Expect a Command, Written as a Space Separated Command Line, and Script
+// its Output and Error
+func (f *Fake) Expect(command string, output string, err error) *Fake {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.expected = append(f.expected, expectation{command: command, output: []byte(output), err: err})
+	return f
+}
+
+func (f *Fake) Output(name string, args ...string) ([]byte, error) {
+	return f.run(CommandLine(name, args...))
+}
+
+func (f *Fake) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return f.run(CommandLine(name, args...))
+}
+
+func (f *Fake) run(command string) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Calls = append(f.Calls, command)
+	if len(f.expected) == 0 {
+		f.errs = append(f.errs, "unexpected command: "+command)
+		return nil, fmt.Errorf("unexpected command: %s", command)
+	}
+	next := f.expected[0]
+	f.expected = f.expected[1:]
+	if next.command != command {
+		f.errs = append(f.errs, fmt.Sprintf("got command %q, want %q", command, next.command))
+		return nil, fmt.Errorf("unexpected command: %s", command)
+	}
+	return next.output, next.err
+}
+
+// Report Commands that did Not Match and Expected Commands Never Run
+func (f *Fake) Verify() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	errs := append([]string{}, f.errs...)
+	for _, missing := range f.expected {
+		errs = append(errs, "expected command never ran: "+missing.command)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -1,26 +1,124 @@
 package message
 
+import (
+	"fmt"
+	"strconv"
+)
+
 type VMData struct {
-	ID          string `bson:"_id" json:"_id"`
-	Hostname    string `bson:"hostname" json:"hostname"`
-	Pop         string `bson:"pop" json:"pop"`
-	Project     string `bson:"project" json:"project"`
-	Os          string `bson:"os" json:"os"`
-	Vcpus       int    `bson:"vcpus" json:"vcpus"`
-	Memory      int    `bson:"memory" json:"memory"`
-	Ssd         int    `bson:"ssd" json:"ssd"`
-	Host        int    `bson:"host" json:"host"`
-	Password    int    `bson:"password" json:"password"`
+	ID       string `bson:"_id" json:"_id"`
+	Hostname string `bson:"hostname" json:"hostname"`
+	Pop      string `bson:"pop" json:"pop"`
+	Project  string `bson:"project" json:"project"`
+	Os       string `bson:"os" json:"os"`
+	Vcpus    int    `bson:"vcpus" json:"vcpus"`
+	Memory   int    `bson:"memory" json:"memory"`
+	Ssd      int    `bson:"ssd" json:"ssd"`
+	Host     int    `bson:"host" json:"host"`
+	// Only Passed Through to the Seed Image, Hashed. Never Cached
+	Password    string `bson:"password" json:"password"`
 	Phoned_home bool   `bson:"phoned_home" json:"phoned_home"`
+	UserData    string `bson:"user_data" json:"user_data"`
+	// Request a Public IPv4 Address from the Host's Pool, NAT64 Mapped to
+	// the VM's IPv6 Address
+	IPv4        bool      `bson:"ipv4" json:"ipv4"`
+	IPv4Address string    `bson:"ipv4_address" json:"ipv4_address"`
+	Firewall    Firewall  `bson:"firewall" json:"firewall"`
+	Bandwidth   Bandwidth `bson:"bandwidth" json:"bandwidth"`
+	IOTune      IOTune    `bson:"iotune" json:"iotune"`
 	Created     struct {
 		By string  `bson:"by"`
 		At float64 `bson:"at"` // unix timestamp
 	} `bson:"created"`
+	// Primary Interface on Bridge vbr<Index>
 	Index   int    `bson:"index"`
 	Prefix  string `bson:"prefix"`
+	MAC     string `bson:"mac"`
 	Gateway string `bson:"gateway"`
 	Address string `bson:"address"`
-	State   int    `bson:"state"`
+	// Additional Prefixes Routed to the Primary Address
+	Routes []string `bson:"routes" json:"routes"`
+	// Interfaces Beyond the Primary One, Each on its Own Bridge
+	Interfaces []Interface `bson:"interfaces" json:"interfaces"`
+	// Private Project Networks the VM is Attached to
+	Networks []NetworkMember `bson:"networks" json:"networks"`
+	// Running a Rescue Domain Instead of Itself
+	Rescued bool `bson:"rescued" json:"rescued"`
+	State   int  `bson:"state"`
+}
+
+// A VM Network Interface on Bridge vbr<Index>. Bridge Indexes Share the
+// PoP Wide Index Space with VMs
+type Interface struct {
+	Index   int      `bson:"index" json:"index" xml:"index,attr"`
+	Prefix  string   `bson:"prefix" json:"prefix" xml:"prefix,attr"`
+	MAC     string   `bson:"mac" json:"mac" xml:"mac,attr"`
+	Gateway string   `bson:"gateway" json:"gateway" xml:"gateway,attr"`
+	Address string   `bson:"address" json:"address" xml:"address,attr"`
+	Routes  []string `bson:"routes" json:"routes" xml:"route"` // Additional Prefixes Routed to Address
+	// Attached to a Running Domain, so the Guest Only has a SLAAC Address
+	// on it and Not the Static Address
+	Hotplugged bool `bson:"hotplugged" json:"hotplugged" xml:"hotplugged,attr,omitempty"`
+}
+
+// Private L2 Network of a Project, Bridged Across the PoP's Hypervisors
+// over VXLAN. The VNI Identifies the Network Within the PoP
+type Network struct {
+	VNI     int      `bson:"vni" json:"vni"`
+	Project string   `bson:"project" json:"project"`
+	Prefix  string   `bson:"prefix" json:"prefix"` // Private Addresses of Members
+	Peers   []string `bson:"peers" json:"peers"`   // VXLAN Addresses of the PoP's Hypervisors
+}
+
+// A VM's Interface on a Private Network
+type NetworkMember struct {
+	VNI     int    `bson:"vni" json:"vni" xml:"vni,attr"`
+	MAC     string `bson:"mac" json:"mac" xml:"mac,attr"`
+	Address string `bson:"address" json:"address" xml:"address,attr"` // CIDR Notation
+}
+
+// Temporary Root Credentials Injected into a Rescue Domain
+type Rescue struct {
+	Password string   `json:"password"`
+	SSHKeys  []string `json:"ssh_keys"`
+}
+
+// Standalone Block Volume, Attached to at Most One Domain at a Time
+type Volume struct {
+	ID      string `bson:"_id" json:"_id"`
+	Project string `bson:"project" json:"project"`
+	Size    int    `bson:"size" json:"size"`     // GB
+	Domain  string `bson:"domain" json:"domain"` // Empty while Detached
+	Target  string `bson:"target" json:"target"` // Guest Device, e.g. vdb
+}
+
+// Inbound Filter for a VM. Rules are Matched in Order and the Policy
+// Applies to Traffic no Rule Matched. An Empty Policy Means No Firewall
+type Firewall struct {
+	Policy string         `bson:"policy" json:"policy" xml:"policy,attr"` // "accept" or "drop"
+	Rules  []FirewallRule `bson:"rules" json:"rules" xml:"rule"`
+}
+
+type FirewallRule struct {
+	Action   string   `bson:"action" json:"action" xml:"action,attr"`                 // "accept" or "drop"
+	Protocol string   `bson:"protocol" json:"protocol" xml:"protocol,attr,omitempty"` // "tcp", "udp", "icmpv6" or Empty for Any
+	Ports    []string `bson:"ports" json:"ports" xml:"port"`                          // "22" or "8000-8100", tcp and udp Only
+	Sources  []string `bson:"sources" json:"sources" xml:"source"`                    // IPv6 Prefixes, Empty for Any
+}
+
+// Traffic Limits for a VM, Policed on its Bridge. Zero Means Unlimited
+type Bandwidth struct {
+	Inbound    int `bson:"inbound" json:"inbound" xml:"inbound,attr"`             // Mbit/s Towards the VM
+	Outbound   int `bson:"outbound" json:"outbound" xml:"outbound,attr"`          // Mbit/s From the VM
+	PacketRate int `bson:"packet_rate" json:"packet_rate" xml:"packet_rate,attr"` // Packets/s, Each Direction
+}
+
+// Disk I/O Limits Applied to Each of a VM's Disks. Zero Means Unlimited
+type IOTune struct {
+	ReadIOPS  int `bson:"read_iops" json:"read_iops" xml:"read_iops,attr"`
+	WriteIOPS int `bson:"write_iops" json:"write_iops" xml:"write_iops,attr"`
+	ReadMBps  int `bson:"read_mbps" json:"read_mbps" xml:"read_mbps,attr"`
+	WriteMBps int `bson:"write_mbps" json:"write_mbps" xml:"write_mbps,attr"`
 }
 
 type MessageData struct {
@@ -39,11 +137,99 @@ type ErrorMessage struct {
 	MachineID int64  `json:"machine_id"`
 }
 
+// Outcome of a Request, Published on aarch64-results. Step Names the
+// Provisioning Step that Failed, if Any
+type Result struct {
+	ID      int64  `json:"id"`
+	Action  Action `json:"action"`
+	Host    string `json:"host"`
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Step    string `json:"step,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// The Action Failed Without Side Effects to Undo and can be Sent Again
+	Retryable bool `json:"retryable,omitempty"`
+	// IPv4 Address Assigned to a New Domain
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	// Guest Details Reported by the Guest Agent
+	Guest *GuestInfo `json:"guest,omitempty"`
+}
+
+// Password to Set Inside a Guest Through its Agent. User Defaults to root
+type Credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Operating System and Addresses a Guest Agent Reports
+type GuestInfo struct {
+	OS         string           `json:"os"`
+	Kernel     string           `json:"kernel"`
+	Hostname   string           `json:"hostname"`
+	Interfaces []GuestInterface `json:"interfaces"`
+}
+
+type GuestInterface struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac"`
+	Addresses []string `json:"addresses"` // CIDR Notation
+}
+
+type ImageData struct {
+	Os       string `json:"os"`
+	Version  string `json:"version"`
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"` // "sha256:<hex>" or "sha512:<hex>"
+	Format   string `json:"format"`   // Format of the Download, "qcow2" or "raw"
+}
+
+type ImageInfo struct {
+	Os      string `json:"os"`
+	Version string `json:"version"`
+	Current bool   `json:"current"`
+	Size    int64  `json:"size"`
+}
+
+// Capacity of One Resource on a Host. Total is the Physical Amount Scaled
+// by the Overcommit Ratio, and Free may Not Drop Below Zero
+type Resource struct {
+	Physical  int64 `bson:"physical" json:"physical"`
+	Total     int64 `bson:"total" json:"total"`
+	Allocated int64 `bson:"allocated" json:"allocated"`
+	Free      int64 `bson:"free" json:"free"`
+}
+
+// Periodic Capacity Report of a Hypervisor, Stored on its Host Entry in
+// the pops Collection
+type Capacity struct {
+	Host             string      `bson:"host" json:"host"`
+	Pop              string      `bson:"pop" json:"pop"`
+	Index            int         `bson:"index" json:"index"`
+	Disabled         bool        `bson:"disabled" json:"disabled"`
+	Domains          int         `bson:"domains" json:"domains"`
+	Vcpus            Resource    `bson:"vcpus" json:"vcpus"`
+	Memory           Resource    `bson:"memory" json:"memory"` // MiB
+	CPUOvercommit    float64     `bson:"cpu_overcommit" json:"cpu_overcommit"`
+	MemoryOvercommit float64     `bson:"memory_overcommit" json:"memory_overcommit"`
+	DiskFree         uint64      `bson:"disk_free" json:"disk_free"`   // Bytes
+	DiskTotal        uint64      `bson:"disk_total" json:"disk_total"` // Bytes
+	Images           []ImageInfo `bson:"images" json:"images"`
+	Updated          int64       `bson:"updated" json:"updated"` // unix timestamp
+}
+
 type Message struct {
 	ID          int64       `json:"id"`
 	Action      Action      `json:"action"`
 	MessageData MessageData `json:"message_data"`
 	VMData      VMData      `json:"vm_data"`
+	ImageData   ImageData   `json:"image_data"`
+	Images      []ImageInfo `json:"images"`
+	Capacity    Capacity    `json:"capacity"`
+	Network     Network     `json:"network"`
+	Volume      Volume      `json:"volume"`
+	Rescue      Rescue      `json:"rescue"`
+	Credentials Credentials `json:"credentials"`
+	Guest       GuestInfo   `json:"guest"`
 }
 
 type Action int64
@@ -58,8 +244,86 @@ const (
 	// Hydrogen
 	AddDomain
 	DeleteDomain
+	SyncImage
+	ImageInventory
+	CapacityReport
+	SetFirewall
+	SetBandwidth
+	AttachInterface
+	DetachInterface
+	CreateNetwork
+	DeleteNetwork
+	JoinNetwork
+	LeaveNetwork
+	CreateVolume
+	DeleteVolume
+	AttachVolume
+	DetachVolume
+	ResizeVolume
+	SetIOTune
+	EnterRescue
+	ExitRescue
+	// Guest Agent Actions
+	SetPassword
+	QueryGuest
+	FreezeFilesystems
+	ThawFilesystems
 )
 
+// Names Operators Use for Actions, in Action Order
+var actionNames = []string{
+	"change_state",
+	"new_vm_state",
+	"add_proxy",
+	"delete_proxy",
+	"wipe_proxy",
+	"add_domain",
+	"delete_domain",
+	"sync_image",
+	"image_inventory",
+	"capacity_report",
+	"set_firewall",
+	"set_bandwidth",
+	"attach_interface",
+	"detach_interface",
+	"create_network",
+	"delete_network",
+	"join_network",
+	"leave_network",
+	"create_volume",
+	"delete_volume",
+	"attach_volume",
+	"detach_volume",
+	"resize_volume",
+	"set_iotune",
+	"enter_rescue",
+	"exit_rescue",
+	"set_password",
+	"query_guest",
+	"freeze_filesystems",
+	"thaw_filesystems",
+}
+
+func (a Action) String() string {
+	if a >= 0 && int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return fmt.Sprintf("action(%d)", int64(a))
+}
+
+// Look up an Action by Name or Number
+func ParseAction(name string) (Action, error) {
+	for i, actionName := range actionNames {
+		if actionName == name {
+			return Action(i), nil
+		}
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 0 && n < len(actionNames) {
+		return Action(n), nil
+	}
+	return 0, fmt.Errorf("unknown action %q", name)
+}
+
 type ActionEvent int64
 
 const (
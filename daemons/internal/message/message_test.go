@@ -0,0 +1,23 @@
+package message
+
+import "testing"
+
+func TestActionNames(t *testing.T) {
+	if int(ThawFilesystems) != len(actionNames)-1 {
+		t.Fatalf("%d actions but %d names", ThawFilesystems+1, len(actionNames))
+	}
+	for action := ChangeState; action <= ThawFilesystems; action++ {
+		if parsed, err := ParseAction(action.String()); err != nil || parsed != action {
+			t.Errorf("ParseAction(%q) = %v, %v", action.String(), parsed, err)
+		}
+	}
+	if action, err := ParseAction("5"); err != nil || action != AddDomain {
+		t.Errorf("ParseAction(5) = %v, %v", action, err)
+	}
+	if _, err := ParseAction("reboot_everything"); err == nil {
+		t.Error("ParseAction accepted an unknown name")
+	}
+	if name := Action(99).String(); name != "action(99)" {
+		t.Errorf("unknown action name = %s", name)
+	}
+}
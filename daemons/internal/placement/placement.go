@@ -0,0 +1,298 @@
+package placement
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+var (
+	ErrNoHost   = errors.New("no host has capacity for the vm")
+	ErrNoIndex  = errors.New("no free vm index in pop")
+	ErrNoPrefix = errors.New("no free /64 in host prefix")
+)
+
+// Bridge Indexes are Unique per PoP. Zero is Never Handed Out
+const (
+	MinIndex = 1
+	MaxIndex = 65535
+)
+
+// Host Prefixes VM /64s can be Carved from, by Prefix Length
+const (
+	MinHostPrefix = 16
+	MaxHostPrefix = 64
+)
+
+// A Hypervisor in a PoP, Identified by its Position in the PoP's Host List
+type Host struct {
+	Index    int
+	Prefix   string // Host Prefix the VM /64s are Carved from
+	Disabled bool
+	// Latest Capacity Report, Nil if the Host has Not Reported Yet
+	Capacity *message.Capacity
+}
+
+// Resources Requested for a New VM. Memory and Ssd are in GiB
+type Request struct {
+	Pop     string
+	Project string
+	Vcpus   int
+	Memory  int
+	Ssd     int
+}
+
+// Where a New VM Goes and the Network Assigned to it
+type Allocation struct {
+	Host    int
+	Index   int
+	Prefix  string
+	Gateway string
+	Address string
+}
+
+// Usage of a Candidate Host by the VMs Already Placed on it
+type Load struct {
+	Host     *Host
+	Vcpus    int
+	Memory   int
+	VMs      int
+	Projects map[string]int
+}
+
+// Fraction of the Host's vCPUs in Use, Using the Reported Total if Known
+func (l *Load) Utilisation() float64 {
+	if l.Host.Capacity == nil || l.Host.Capacity.Vcpus.Total <= 0 {
+		return float64(l.Vcpus)
+	}
+	return float64(l.Vcpus) / float64(l.Host.Capacity.Vcpus.Total)
+}
+
+// Orders Candidate Hosts. Less Reports Whether a is Preferred over b;
+// Hosts Neither Prefers Keep their Host Index Order
+type Strategy interface {
+	Less(req *Request, a *Load, b *Load) bool
+}
+
+// Prefer the Host with the Lowest vCPU Utilisation
+type LeastLoaded struct{}
+
+func (LeastLoaded) Less(req *Request, a *Load, b *Load) bool {
+	return a.Utilisation() < b.Utilisation()
+}
+
+// Prefer the Fullest Host that Still Fits, Keeping Others Free
+type BinPacking struct{}
+
+func (BinPacking) Less(req *Request, a *Load, b *Load) bool {
+	return a.Utilisation() > b.Utilisation()
+}
+
+// Prefer Hosts Running the Fewest VMs of the Same Project, then Defer to
+// the Fallback Strategy
+type AntiAffinity struct {
+	Fallback Strategy
+}
+
+func (s AntiAffinity) Less(req *Request, a *Load, b *Load) bool {
+	if a.Projects[req.Project] != b.Projects[req.Project] {
+		return a.Projects[req.Project] < b.Projects[req.Project]
+	}
+	if s.Fallback == nil {
+		return false
+	}
+	return s.Fallback.Less(req, a, b)
+}
+
+// Select a Host, Bridge Index and /64 for a New VM. vms are the Existing
+// VMs of the PoP. The Result Only Depends on the Inputs
+func Allocate(strategy Strategy, req *Request, hosts []Host, vms []message.VMData) (*Allocation, error) {
+	host, err := SelectHost(strategy, req, hosts, vms)
+	if err != nil {
+		return nil, err
+	}
+	index, err := FreeIndex(req.Pop, vms)
+	if err != nil {
+		return nil, err
+	}
+	prefix, gateway, address, err := FreePrefix(req.Pop, host.Prefix, vms)
+	if err != nil {
+		return nil, err
+	}
+	return &Allocation{
+		Host:    host.Index,
+		Index:   index,
+		Prefix:  prefix,
+		Gateway: gateway,
+		Address: address,
+	}, nil
+}
+
+// Pick the Preferred Enabled Host with Room for the Request
+func SelectHost(strategy Strategy, req *Request, hosts []Host, vms []message.VMData) (*Host, error) {
+	loads := make(map[int]*Load)
+	candidates := []*Load{}
+	for i := range hosts {
+		host := &hosts[i]
+		if host.Disabled || (host.Capacity != nil && host.Capacity.Disabled) {
+			continue
+		}
+		load := &Load{Host: host, Projects: make(map[string]int)}
+		loads[host.Index] = load
+		candidates = append(candidates, load)
+	}
+	for _, vm := range vms {
+		if load, ok := loads[vm.Host]; ok && vm.Pop == req.Pop {
+			load.Vcpus += vm.Vcpus
+			load.Memory += vm.Memory
+			load.VMs++
+			load.Projects[vm.Project]++
+		}
+	}
+
+	fitting := []*Load{}
+	for _, load := range candidates {
+		if fits(req, load) {
+			fitting = append(fitting, load)
+		}
+	}
+	if len(fitting) == 0 {
+		return nil, ErrNoHost
+	}
+	sort.SliceStable(fitting, func(i, j int) bool {
+		if strategy.Less(req, fitting[i], fitting[j]) {
+			return true
+		}
+		if strategy.Less(req, fitting[j], fitting[i]) {
+			return false
+		}
+		return fitting[i].Host.Index < fitting[j].Host.Index
+	})
+	return fitting[0].Host, nil
+}
+
+// Check a Request Against the Host's Reported Capacity. Hosts that have
+// Not Reported are Assumed to Fit
+func fits(req *Request, load *Load) bool {
+	capacity := load.Host.Capacity
+	if capacity == nil {
+		return true
+	}
+	if int64(load.Vcpus+req.Vcpus) > capacity.Vcpus.Total {
+		return false
+	}
+	if int64(load.Memory+req.Memory)*1024 > capacity.Memory.Total {
+		return false
+	}
+	return uint64(req.Ssd)<<30 <= capacity.DiskFree
+}
+
+// Lowest Bridge Index Not Used by any VM or Interface in the PoP
+func FreeIndex(pop string, vms []message.VMData) (int, error) {
+	taken := make(map[int]bool, len(vms))
+	for _, vm := range vms {
+		if vm.Pop != pop {
+			continue
+		}
+		taken[vm.Index] = true
+		for _, iface := range vm.Interfaces {
+			taken[iface.Index] = true
+		}
+	}
+	for index := MinIndex; index <= MaxIndex; index++ {
+		if !taken[index] {
+			return index, nil
+		}
+	}
+	return 0, ErrNoIndex
+}
+
+// First /64 of the Host Prefix Not Used or Routed to any VM in the PoP,
+// with the Gateway on ::1 and the VM Address on ::2
+func FreePrefix(pop string, hostPrefix string, vms []message.VMData) (string, string, string, error) {
+	_, network, err := net.ParseCIDR(hostPrefix)
+	if err != nil {
+		return "", "", "", fmt.Errorf("host prefix: %w", err)
+	}
+	ones, bits := network.Mask.Size()
+	if network.IP.To4() != nil || bits != 128 || ones < MinHostPrefix || ones > MaxHostPrefix {
+		return "", "", "", fmt.Errorf("host prefix %s is not an ipv6 prefix between /%d and /%d", hostPrefix, MinHostPrefix, MaxHostPrefix)
+	}
+	taken := make(map[string]bool, len(vms))
+	// Routed Prefixes Shorter than a /64 Cover Several Candidates, Longer
+	// Ones Take the /64 they are in
+	covering := []*net.IPNet{}
+	for _, vm := range vms {
+		if vm.Pop != pop {
+			continue
+		}
+		prefixes := append([]string{vm.Prefix}, vm.Routes...)
+		for _, iface := range vm.Interfaces {
+			prefixes = append(prefixes, iface.Prefix)
+			prefixes = append(prefixes, iface.Routes...)
+		}
+		for _, cidr := range prefixes {
+			_, prefix, err := net.ParseCIDR(cidr)
+			if err != nil || prefix.IP.To4() != nil {
+				continue
+			}
+			if ones, _ := prefix.Mask.Size(); ones < 64 {
+				covering = append(covering, prefix)
+			} else {
+				mask := net.CIDRMask(64, 128)
+				taken[(&net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}).String()] = true
+			}
+		}
+	}
+
+	// Candidates are Numbered by the Upper 64 Bits of their Address
+	first := binary.BigEndian.Uint64(network.IP[:8])
+	last := first + (uint64(1)<<uint(64-ones) - 1)
+	for candidate := first; ; candidate++ {
+		// Skip Past Covering Prefixes in One Go Rather than /64 by /64
+		if end, ok := coveredUntil(candidate, covering); ok {
+			if end >= last {
+				break
+			}
+			candidate = end
+			continue
+		}
+		ip := make(net.IP, net.IPv6len)
+		binary.BigEndian.PutUint64(ip[:8], candidate)
+		prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+		if !taken[prefix.String()] {
+			gateway := make(net.IP, net.IPv6len)
+			copy(gateway, ip)
+			gateway[15] = 1
+			address := make(net.IP, net.IPv6len)
+			copy(address, ip)
+			address[15] = 2
+			return prefix.String(), gateway.String(), address.String() + "/64", nil
+		}
+		if candidate == last {
+			break
+		}
+	}
+	return "", "", "", ErrNoPrefix
+}
+
+// Last /64, by its Upper 64 Bits, of a Prefix Covering the Candidate
+func coveredUntil(candidate uint64, prefixes []*net.IPNet) (uint64, bool) {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], candidate)
+	for _, prefix := range prefixes {
+		if !prefix.Contains(ip) {
+			continue
+		}
+		ones, _ := prefix.Mask.Size()
+		if ones == 0 {
+			return ^uint64(0), true
+		}
+		return binary.BigEndian.Uint64(prefix.IP[:8]) | (uint64(1)<<uint(64-ones) - 1), true
+	}
+	return 0, false
+}
@@ -0,0 +1,264 @@
+package placement
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fosshostorg/aarch64/daemons/internal/message"
+)
+
+func capacity(vcpus int64, memoryGiB int64, diskGiB uint64) *message.Capacity {
+	return &message.Capacity{
+		Vcpus:    message.Resource{Total: vcpus},
+		Memory:   message.Resource{Total: memoryGiB * 1024},
+		DiskFree: diskGiB << 30,
+	}
+}
+
+func vm(host int, index int, project string, vcpus int, prefix string) message.VMData {
+	return message.VMData{
+		Pop:     "ams",
+		Host:    host,
+		Index:   index,
+		Project: project,
+		Vcpus:   vcpus,
+		Memory:  vcpus * 2,
+		Prefix:  prefix,
+	}
+}
+
+func TestSelectHost(t *testing.T) {
+	hosts := []Host{
+		{Index: 0, Prefix: "2001:db8:0::/48", Capacity: capacity(16, 64, 500)},
+		{Index: 1, Prefix: "2001:db8:1::/48", Capacity: capacity(16, 64, 500)},
+		{Index: 2, Prefix: "2001:db8:2::/48", Capacity: capacity(16, 64, 500)},
+	}
+	vms := []message.VMData{
+		vm(0, 1, "alpha", 8, "2001:db8:0::/64"),
+		vm(1, 2, "beta", 4, "2001:db8:1::/64"),
+		vm(1, 3, "beta", 2, "2001:db8:1:1::/64"),
+		vm(2, 4, "alpha", 2, "2001:db8:2::/64"),
+	}
+	tests := []struct {
+		name     string
+		strategy Strategy
+		req      Request
+		hosts    []Host
+		vms      []message.VMData
+		want     int
+		wantErr  error
+	}{
+		{"least loaded", LeastLoaded{}, Request{Pop: "ams", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 2, nil},
+		{"bin packing", BinPacking{}, Request{Pop: "ams", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 0, nil},
+		{"bin packing skips full host", BinPacking{}, Request{Pop: "ams", Vcpus: 10, Memory: 4, Ssd: 20}, hosts, vms, 1, nil},
+		{"anti affinity", AntiAffinity{Fallback: LeastLoaded{}}, Request{Pop: "ams", Project: "alpha", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 1, nil},
+		{"anti affinity tie falls back", AntiAffinity{Fallback: LeastLoaded{}}, Request{Pop: "ams", Project: "gamma", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 2, nil},
+		{"anti affinity without fallback", AntiAffinity{}, Request{Pop: "ams", Project: "gamma", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 0, nil},
+		{"empty pop ties by index", LeastLoaded{}, Request{Pop: "ams", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, nil, 0, nil},
+		{"other pops ignored", LeastLoaded{}, Request{Pop: "fra", Vcpus: 2, Memory: 4, Ssd: 20}, hosts, vms, 0, nil},
+		{
+			"disabled host skipped",
+			LeastLoaded{},
+			Request{Pop: "ams", Vcpus: 2, Memory: 4, Ssd: 20},
+			[]Host{hosts[0], hosts[1], {Index: 2, Prefix: "2001:db8:2::/48", Disabled: true}},
+			vms, 1, nil,
+		},
+		{
+			"host reporting disabled skipped",
+			LeastLoaded{},
+			Request{Pop: "ams", Vcpus: 2, Memory: 4, Ssd: 20},
+			[]Host{hosts[0], hosts[1], {Index: 2, Prefix: "2001:db8:2::/48", Capacity: &message.Capacity{Disabled: true}}},
+			vms, 1, nil,
+		},
+		{
+			"memory exhausted",
+			BinPacking{},
+			Request{Pop: "ams", Vcpus: 1, Memory: 50, Ssd: 20},
+			hosts, vms, 1, nil,
+		},
+		{
+			"disk exhausted",
+			LeastLoaded{},
+			Request{Pop: "ams", Vcpus: 1, Memory: 1, Ssd: 20},
+			[]Host{{Index: 0, Capacity: capacity(16, 64, 10)}, {Index: 1, Capacity: capacity(16, 64, 100)}},
+			nil, 1, nil,
+		},
+		{
+			"unreported host fits",
+			LeastLoaded{},
+			Request{Pop: "ams", Vcpus: 64, Memory: 4, Ssd: 20},
+			[]Host{hosts[0], {Index: 3, Prefix: "2001:db8:3::/48"}},
+			vms, 3, nil,
+		},
+		{"nothing fits", LeastLoaded{}, Request{Pop: "ams", Vcpus: 32, Memory: 4, Ssd: 20}, hosts, vms, 0, ErrNoHost},
+		{"no hosts", LeastLoaded{}, Request{Pop: "ams", Vcpus: 1}, nil, nil, 0, ErrNoHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, err := SelectHost(tt.strategy, &tt.req, tt.hosts, tt.vms)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("SelectHost error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelectHost: %v", err)
+			}
+			if host.Index != tt.want {
+				t.Errorf("SelectHost = host %d, want host %d", host.Index, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreeIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		taken   []int
+		want    int
+		wantErr bool
+	}{
+		{"empty pop", nil, 1, false},
+		{"first free not last", []int{1, 2, 4, 7}, 3, false},
+		{"zero is never used", []int{0}, 1, false},
+		{"contiguous", []int{1, 2, 3}, 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vms := []message.VMData{}
+			for _, index := range tt.taken {
+				vms = append(vms, message.VMData{Pop: "ams", Index: index})
+			}
+			index, err := FreeIndex("ams", vms)
+			if (err != nil) != tt.wantErr || index != tt.want {
+				t.Errorf("FreeIndex = %d, %v, want %d", index, err, tt.want)
+			}
+		})
+	}
+
+	full := make([]message.VMData, 0, MaxIndex)
+	for index := MinIndex; index <= MaxIndex; index++ {
+		full = append(full, message.VMData{Pop: "ams", Index: index})
+	}
+	if _, err := FreeIndex("ams", full); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("FreeIndex on a full pop = %v, want ErrNoIndex", err)
+	}
+}
+
+func TestFreePrefix(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostPrefix  string
+		taken       []string
+		wantPrefix  string
+		wantGateway string
+		wantAddress string
+		wantErr     bool
+	}{
+		{"first /64", "2001:db8:5::/48", nil, "2001:db8:5::/64", "2001:db8:5::1", "2001:db8:5::2/64", false},
+		{"skips taken", "2001:db8:5::/48", []string{"2001:db8:5::/64", "2001:db8:5:1::/64", "2001:db8:5:3::/64"}, "2001:db8:5:2::/64", "2001:db8:5:2::1", "2001:db8:5:2::2/64", false},
+		{"non canonical taken prefix", "2001:db8:5::/48", []string{"2001:0db8:0005:0000::/64"}, "2001:db8:5:1::/64", "2001:db8:5:1::1", "2001:db8:5:1::2/64", false},
+		{"host bits in host prefix", "2001:db8:5::1/48", nil, "2001:db8:5::/64", "2001:db8:5::1", "2001:db8:5::2/64", false},
+		{"single /64", "2001:db8:5:9::/64", nil, "2001:db8:5:9::/64", "2001:db8:5:9::1", "2001:db8:5:9::2/64", false},
+		{"single /64 taken", "2001:db8:5:9::/64", []string{"2001:db8:5:9::/64"}, "", "", "", true},
+		{"ipv4 prefix", "192.0.2.0/24", nil, "", "", "", true},
+		{"longer than /64", "2001:db8:5::/80", nil, "", "", "", true},
+		{"shorter than /16", "2001::/15", nil, "", "", "", true},
+		{"whole address space", "::/0", nil, "", "", "", true},
+		{"shortest supported", "2001::/16", nil, "2001::/64", "2001::1", "2001::2/64", false},
+		{"invalid prefix", "not-a-prefix", nil, "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vms := []message.VMData{}
+			for _, prefix := range tt.taken {
+				vms = append(vms, message.VMData{Pop: "ams", Prefix: prefix})
+			}
+			prefix, gateway, address, err := FreePrefix("ams", tt.hostPrefix, vms)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FreePrefix error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if prefix != tt.wantPrefix || gateway != tt.wantGateway || address != tt.wantAddress {
+				t.Errorf("FreePrefix = %s %s %s, want %s %s %s", prefix, gateway, address, tt.wantPrefix, tt.wantGateway, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	hosts := []Host{
+		{Index: 0, Prefix: "2001:db8:0::/48", Capacity: capacity(16, 64, 500)},
+		{Index: 1, Prefix: "2001:db8:1::/48", Capacity: capacity(16, 64, 500)},
+	}
+	vms := []message.VMData{
+		vm(0, 1, "alpha", 8, "2001:db8:0::/64"),
+		vm(1, 3, "beta", 2, "2001:db8:1::/64"),
+	}
+	req := &Request{Pop: "ams", Project: "alpha", Vcpus: 2, Memory: 4, Ssd: 20}
+	want := Allocation{Host: 1, Index: 2, Prefix: "2001:db8:1:1::/64", Gateway: "2001:db8:1:1::1", Address: "2001:db8:1:1::2/64"}
+
+	// Repeated Calls with the Same Inputs Give the Same Result
+	for i := 0; i < 3; i++ {
+		got, err := Allocate(LeastLoaded{}, req, hosts, vms)
+		if err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+		if *got != want {
+			t.Errorf("Allocate = %+v, want %+v", *got, want)
+		}
+	}
+
+	if _, err := Allocate(LeastLoaded{}, &Request{Pop: "ams", Vcpus: 64}, hosts, vms); !errors.Is(err, ErrNoHost) {
+		t.Errorf("Allocate error = %v, want ErrNoHost", err)
+	}
+}
+
+func TestFreeIndexAndPrefixWithInterfaces(t *testing.T) {
+	vms := []message.VMData{{
+		Pop:    "ams",
+		Index:  1,
+		Prefix: "2001:db8:5::/64",
+		Routes: []string{"2001:db8:5:1::/64", "2001:db8:5:4::/62"},
+		Interfaces: []message.Interface{
+			{Index: 2, Prefix: "2001:db8:5:2::/64", Routes: []string{"2001:db8:5:3::42/128"}},
+		},
+	}}
+	if index, err := FreeIndex("ams", vms); err != nil || index != 3 {
+		t.Errorf("FreeIndex = %d, %v, want 3", index, err)
+	}
+	prefix, _, _, err := FreePrefix("ams", "2001:db8:5::/48", vms)
+	if err != nil || prefix != "2001:db8:5:8::/64" {
+		t.Errorf("FreePrefix = %s, %v, want 2001:db8:5:8::/64", prefix, err)
+	}
+}
+
+// Allocations of Another PoP Share Neither Indexes Nor Prefixes
+func TestFreeIndexAndPrefixIgnoreOtherPops(t *testing.T) {
+	vms := []message.VMData{
+		{Pop: "fra", Index: 1, Prefix: "2001:db8:5::/64"},
+		{Pop: "ams", Index: 2, Prefix: "2001:db8:5:1::/64"},
+	}
+	if index, err := FreeIndex("ams", vms); err != nil || index != 1 {
+		t.Errorf("FreeIndex = %d, %v, want 1", index, err)
+	}
+	prefix, _, _, err := FreePrefix("ams", "2001:db8:5::/48", vms)
+	if err != nil || prefix != "2001:db8:5::/64" {
+		t.Errorf("FreePrefix = %s, %v, want 2001:db8:5::/64", prefix, err)
+	}
+}
+
+// A Route Covering Most of a Short Host Prefix is Skipped Without Walking it
+func TestFreePrefixSkipsCoveringRoutes(t *testing.T) {
+	vms := []message.VMData{
+		{Pop: "ams", Index: 1, Prefix: "2001:db8::/64", Routes: []string{"2001::/17"}},
+	}
+	prefix, _, _, err := FreePrefix("ams", "2001::/16", vms)
+	if err != nil || prefix != "2001:8000::/64" {
+		t.Errorf("FreePrefix = %s, %v, want 2001:8000::/64", prefix, err)
+	}
+	vms[0].Routes = []string{"::/0"}
+	if _, _, _, err := FreePrefix("ams", "2001::/16", vms); !errors.Is(err, ErrNoPrefix) {
+		t.Errorf("FreePrefix error = %v, want ErrNoPrefix", err)
+	}
+}